@@ -0,0 +1,568 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// /api/v1 はHTMLページと同じデータをJSONで返すAPIです。
+// セッションはHTMLページと共有し、更新系のリクエストはX-CSRF-Tokenヘッダー
+// またはリクエストボディのcsrf_tokenでCSRFトークンを検証します。
+
+type apiUser struct {
+	ID          int       `json:"id"`
+	AccountName string    `json:"account_name"`
+	Authority   int       `json:"authority"`
+	Role        string    `json:"role"`
+	DisplayName string    `json:"display_name"`
+	AvatarURL   string    `json:"avatar_url"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type apiComment struct {
+	ID        int        `json:"id"`
+	PostID    int        `json:"post_id"`
+	User      apiUser    `json:"user"`
+	Comment   string     `json:"comment"`
+	CreatedAt time.Time  `json:"created_at"`
+	EditedAt  *time.Time `json:"edited_at"`
+}
+
+type apiPost struct {
+	ID           int          `json:"id"`
+	User         apiUser      `json:"user"`
+	Body         string       `json:"body"`
+	Mime         string       `json:"mime"`
+	ImageURL     string       `json:"image_url"`
+	ThumbnailURL string       `json:"thumbnail_url"`
+	CommentCount int          `json:"comment_count"`
+	LikeCount    int          `json:"like_count"`
+	Liked        bool         `json:"liked"`
+	Comments     []apiComment `json:"comments"`
+	CreatedAt    time.Time    `json:"created_at"`
+}
+
+func newAPIUser(u User) apiUser {
+	return apiUser{
+		ID:          u.ID,
+		AccountName: u.AccountName,
+		Authority:   u.Authority,
+		Role:        u.Role().Name(),
+		DisplayName: u.DisplayName,
+		AvatarURL:   avatarURL(u),
+		CreatedAt:   u.CreatedAt,
+	}
+}
+
+// newAPIMe は、ログインしていない場合にnullとなるログインユーザーを返します。
+func newAPIMe(u User) *apiUser {
+	if !isLogin(u) {
+		return nil
+	}
+	me := newAPIUser(u)
+	return &me
+}
+
+func newAPIPost(p Post) apiPost {
+	comments := make([]apiComment, 0, len(p.Comments))
+	for _, c := range p.Comments {
+		comments = append(comments, apiComment{
+			ID:        c.ID,
+			PostID:    c.PostID,
+			User:      newAPIUser(c.User),
+			Comment:   c.Comment,
+			CreatedAt: c.CreatedAt,
+			EditedAt:  c.EditedAt,
+		})
+	}
+	return apiPost{
+		ID:           p.ID,
+		User:         newAPIUser(p.User),
+		Body:         p.Body,
+		Mime:         p.Mime,
+		ImageURL:     imageURL(p),
+		ThumbnailURL: thumbnailURL(p),
+		CommentCount: p.CommentCount,
+		LikeCount:    p.LikeCount,
+		Liked:        p.Liked,
+		Comments:     comments,
+		CreatedAt:    p.CreatedAt,
+	}
+}
+
+func newAPIPosts(posts []Post) []apiPost {
+	results := make([]apiPost, 0, len(posts))
+	for _, p := range posts {
+		results = append(results, newAPIPost(p))
+	}
+	return results
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// decodeJSON は、リクエストボディをvに読み込みます。読み込めない場合は400を返してfalseを返します。
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "リクエストボディが不正です")
+		return false
+	}
+	return true
+}
+
+// apiCSRFToken は、X-CSRF-Tokenヘッダーを優先してリクエストのCSRFトークンを返します。
+func apiCSRFToken(r *http.Request, bodyToken string) string {
+	if token := r.Header.Get("X-CSRF-Token"); token != "" {
+		return token
+	}
+	return bodyToken
+}
+
+// apiRequireLogin は、ログインしていればそのユーザーを返します。
+// ログインしていない場合やCSRFトークンが一致しない場合はエラーを書き込んでfalseを返します。
+func apiRequireLogin(w http.ResponseWriter, r *http.Request, csrfToken string) (User, bool) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		writeJSONError(w, http.StatusUnauthorized, "ログインが必要です")
+		return User{}, false
+	}
+
+	if !validCSRFToken(r, apiCSRFToken(r, csrfToken)) {
+		writeJSONError(w, http.StatusUnprocessableEntity, "CSRFトークンが不正です")
+		return User{}, false
+	}
+
+	return me, true
+}
+
+// apiPostByID は、すべてのコメントを含む投稿を取得します。
+func apiPostByID(w http.ResponseWriter, r *http.Request, pid int) (apiPost, bool) {
+	post, err := repo.GetPost(pid)
+	if err == ErrNotFound {
+		writeJSONError(w, http.StatusNotFound, "投稿が見つかりません")
+		return apiPost{}, false
+	}
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError, "投稿を取得できませんでした")
+		return apiPost{}, false
+	}
+
+	posts, err := makePosts([]Post{post}, getSessionUser(r), getCSRFToken(r), true)
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError, "投稿を取得できませんでした")
+		return apiPost{}, false
+	}
+
+	return newAPIPost(posts[0]), true
+}
+
+func apiGetMe(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, struct {
+		Me        *apiUser `json:"me"`
+		CSRFToken string   `json:"csrf_token"`
+	}{newAPIMe(getSessionUser(r)), getCSRFToken(r)})
+}
+
+type apiLoginRequest struct {
+	AccountName string `json:"account_name"`
+	Password    string `json:"password"`
+}
+
+func apiPostLogin(w http.ResponseWriter, r *http.Request) {
+	req := apiLoginRequest{}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	u, notice, throttled := loginWithThrottle(r, req.AccountName, req.Password)
+	if throttled {
+		writeJSONError(w, http.StatusTooManyRequests, notice)
+		return
+	}
+	if u == nil {
+		writeJSONError(w, http.StatusUnauthorized, notice)
+		return
+	}
+
+	startSession(w, r, *u)
+
+	writeJSON(w, http.StatusOK, struct {
+		Me        *apiUser `json:"me"`
+		CSRFToken string   `json:"csrf_token"`
+	}{newAPIMe(*u), getCSRFToken(r)})
+}
+
+// apiGetPosts は、getIndex、getFollowingとgetPostsに対応します。
+// cursorまたはmax_created_atが指定された場合はその続きの投稿を返します。
+// feed=followingを指定するとフォローしているユーザーの投稿だけを返します。
+// レスポンスのnext_cursorを次のリクエストのcursorに指定すると次のページを取得できます。
+func apiGetPosts(w http.ResponseWriter, r *http.Request) {
+	m, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "クエリが不正です")
+		return
+	}
+
+	cursor, _, err := postCursorFromQuery(m.Get("cursor"), m.Get("max_created_at"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "cursorが不正です")
+		return
+	}
+
+	me := getSessionUser(r)
+	feed := m.Get("feed")
+	if feed == feedFollowing && !isLogin(me) {
+		writeJSONError(w, http.StatusUnauthorized, "ログインが必要です")
+		return
+	}
+
+	results, err := listFeedPosts(me, feed, cursor)
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError, "投稿を取得できませんでした")
+		return
+	}
+
+	posts, err := makePosts(results, me, getCSRFToken(r), false)
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError, "投稿を取得できませんでした")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Posts      []apiPost `json:"posts"`
+		NextCursor string    `json:"next_cursor"`
+	}{newAPIPosts(posts), nextCursor(posts)})
+}
+
+func apiGetPostsID(w http.ResponseWriter, r *http.Request) {
+	pid, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "投稿が見つかりません")
+		return
+	}
+
+	post, ok := apiPostByID(w, r, pid)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Post apiPost `json:"post"`
+	}{post})
+}
+
+// apiGetTagsTag は、getTagsTagに対応します。
+// レスポンスのnext_cursorを次のリクエストのcursorに指定すると次のページを取得できます。
+func apiGetTagsTag(w http.ResponseWriter, r *http.Request) {
+	tag, err := url.PathUnescape(r.PathValue("tag"))
+	if err != nil || normalizeHashtag(tag) == "" {
+		writeJSONError(w, http.StatusNotFound, "タグが見つかりません")
+		return
+	}
+	tag = normalizeHashtag(tag)
+
+	cursor, _, err := postCursorFromQuery(r.URL.Query().Get("cursor"), "")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "cursorが不正です")
+		return
+	}
+
+	results, err := repo.ListPostsByTag(tag, cursor, postsPerPage)
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError, "投稿を取得できませんでした")
+		return
+	}
+
+	posts, err := makePosts(results, getSessionUser(r), getCSRFToken(r), false)
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError, "投稿を取得できませんでした")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Tag        string    `json:"tag"`
+		Posts      []apiPost `json:"posts"`
+		NextCursor string    `json:"next_cursor"`
+	}{tag, newAPIPosts(posts), nextCursor(posts)})
+}
+
+// apiGetSearch は、getSearchに対応します。
+// レスポンスのnext_cursorを次のリクエストのcursorに指定すると次のページを取得できます。
+func apiGetSearch(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		writeJSONError(w, http.StatusBadRequest, "検索語を指定してください")
+		return
+	}
+
+	cursor, _, err := postCursorFromQuery(r.URL.Query().Get("cursor"), "")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "cursorが不正です")
+		return
+	}
+
+	results, err := searchIndex.SearchPosts(q, cursor, postsPerPage)
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError, "投稿を検索できませんでした")
+		return
+	}
+
+	posts, err := makePosts(results, getSessionUser(r), getCSRFToken(r), false)
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError, "投稿を検索できませんでした")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Query      string    `json:"q"`
+		Posts      []apiPost `json:"posts"`
+		NextCursor string    `json:"next_cursor"`
+	}{q, newAPIPosts(posts), nextCursor(posts)})
+}
+
+func apiGetAccountName(w http.ResponseWriter, r *http.Request) {
+	user, err := repo.GetActiveUserByAccountName(r.PathValue("accountName"))
+	if err == ErrNotFound {
+		writeJSONError(w, http.StatusNotFound, "ユーザーが見つかりません")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError, "ユーザーを取得できませんでした")
+		return
+	}
+
+	results, err := repo.ListPostsByUser(user.ID, postsPerPage)
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError, "投稿を取得できませんでした")
+		return
+	}
+
+	posts, err := makePosts(results, getSessionUser(r), getCSRFToken(r), false)
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError, "投稿を取得できませんでした")
+		return
+	}
+
+	stats, err := getUserStats(user.ID)
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError, "ユーザーを取得できませんでした")
+		return
+	}
+
+	followingCount, followerCount, err := repo.CountFollows(user.ID)
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError, "ユーザーを取得できませんでした")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		User           apiUser   `json:"user"`
+		PostCount      int       `json:"post_count"`
+		CommentCount   int       `json:"comment_count"`
+		CommentedCount int       `json:"commented_count"`
+		FollowingCount int       `json:"following_count"`
+		FollowerCount  int       `json:"follower_count"`
+		Posts          []apiPost `json:"posts"`
+	}{newAPIUser(user), stats.PostCount, stats.CommentCount, stats.CommentedCount, followingCount, followerCount, newAPIPosts(posts)})
+}
+
+// apiPostIndexRequest のImageはbase64でエンコードした画像データです。
+// 画像の形式は内容から判定するので、ContentTypeは省略できます。
+type apiPostIndexRequest struct {
+	Body        string `json:"body"`
+	Image       string `json:"image"`
+	ContentType string `json:"content_type"`
+	CSRFToken   string `json:"csrf_token"`
+}
+
+func apiPostIndex(w http.ResponseWriter, r *http.Request) {
+	// base64で約4/3倍になるのでアップロード上限に余裕を持たせる
+	r.Body = http.MaxBytesReader(w, r.Body, UploadLimit*2)
+
+	req := apiPostIndexRequest{}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	me, ok := apiRequireLogin(w, r, req.CSRFToken)
+	if !ok {
+		return
+	}
+
+	if req.Image == "" {
+		writeJSONError(w, http.StatusBadRequest, "画像が必須です")
+		return
+	}
+
+	filedata, err := base64.StdEncoding.DecodeString(req.Image)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "画像のエンコードが不正です")
+		return
+	}
+
+	if len(filedata) > UploadLimit {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "ファイルサイズが大きすぎます")
+		return
+	}
+
+	mime, err := inspectImage(filedata, req.ContentType)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, imageUploadNotices[err])
+		return
+	}
+
+	pid, err := createPost(me, mime, filedata, req.Body)
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError, "投稿できませんでした")
+		return
+	}
+
+	post, ok := apiPostByID(w, r, pid)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, struct {
+		Post apiPost `json:"post"`
+	}{post})
+}
+
+type apiPostCommentRequest struct {
+	PostID    int    `json:"post_id"`
+	Comment   string `json:"comment"`
+	CSRFToken string `json:"csrf_token"`
+}
+
+// apiPostComment は、コメントを投稿してコメントを含む投稿を返します。
+func apiPostComment(w http.ResponseWriter, r *http.Request) {
+	req := apiPostCommentRequest{}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	me, ok := apiRequireLogin(w, r, req.CSRFToken)
+	if !ok {
+		return
+	}
+
+	if _, err := repo.GetPost(req.PostID); err == ErrNotFound {
+		writeJSONError(w, http.StatusNotFound, "投稿が見つかりません")
+		return
+	} else if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError, "コメントできませんでした")
+		return
+	}
+
+	_, err := createComment(me, req.PostID, req.Comment)
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError, "コメントできませんでした")
+		return
+	}
+
+	post, ok := apiPostByID(w, r, req.PostID)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, struct {
+		Post apiPost `json:"post"`
+	}{post})
+}
+
+type apiDeletePostRequest struct {
+	CSRFToken string `json:"csrf_token"`
+}
+
+// apiPostPostsDelete は、postPostsDeleteに対応します。削除に成功した場合は204を返します。
+// CSRFトークンをX-CSRF-Tokenヘッダーで送る場合、リクエストボディは省略できます。
+func apiPostPostsDelete(w http.ResponseWriter, r *http.Request) {
+	req := apiDeletePostRequest{}
+	if r.ContentLength != 0 && !decodeJSON(w, r, &req) {
+		return
+	}
+
+	me, ok := apiRequireLogin(w, r, req.CSRFToken)
+	if !ok {
+		return
+	}
+
+	pid, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "投稿が見つかりません")
+		return
+	}
+
+	post, err := repo.GetPost(pid)
+	if err == ErrNotFound {
+		writeJSONError(w, http.StatusNotFound, "投稿が見つかりません")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError, "投稿を削除できませんでした")
+		return
+	}
+
+	if !canDeletePost(me, post) {
+		writeJSONError(w, http.StatusForbidden, "この投稿は削除できません")
+		return
+	}
+
+	err = deletePost(post)
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError, "投稿を削除できませんでした")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiRoutes は、/api/v1 以下のルートを登録します。
+func apiRoutes(r chi.Router) {
+	r.Get("/me", apiGetMe)
+	r.Post("/login", apiPostLogin)
+	r.Get("/posts", apiGetPosts)
+	r.Post("/posts", apiPostIndex)
+	r.Get("/posts/{id}", apiGetPostsID)
+	r.Post("/posts/{id}/delete", apiPostPostsDelete)
+	r.Post("/comments", apiPostComment)
+	r.Get("/users/{accountName}", apiGetAccountName)
+	r.Get("/tags/{tag}", apiGetTagsTag)
+	r.Get("/search", apiGetSearch)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// doJSON は、reqをJSONで送信してレスポンスをresに読み込み、ステータスコードを返します。
+func doJSON(t *testing.T, client *http.Client, method, u, csrfToken string, req, res interface{}) int {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	if req != nil {
+		if err := json.NewEncoder(body).Encode(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	httpReq, err := http.NewRequest(method, u, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if csrfToken != "" {
+		httpReq.Header.Set("X-CSRF-Token", csrfToken)
+	}
+
+	httpRes, err := client.Do(httpReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpRes.Body.Close()
+	if res != nil {
+		if err := json.NewDecoder(httpRes.Body).Decode(res); err != nil {
+			t.Fatalf("%s %s: %v", method, u, err)
+		}
+	}
+	return httpRes.StatusCode
+}
+
+func apiLogin(t *testing.T, ts *httptest.Server, client *http.Client, accountName string) string {
+	t.Helper()
+
+	res := struct {
+		Me        *apiUser `json:"me"`
+		CSRFToken string   `json:"csrf_token"`
+	}{}
+	status := doJSON(t, client, http.MethodPost, ts.URL+"/api/v1/login", "", apiLoginRequest{
+		AccountName: accountName,
+		Password:    "password",
+	}, &res)
+	if status != http.StatusOK || res.Me == nil || res.Me.AccountName != accountName || res.CSRFToken == "" {
+		t.Fatalf("login failed: status = %d, response = %+v", status, res)
+	}
+	return res.CSRFToken
+}
+
+func TestAPIPostAndComment(t *testing.T) {
+	ts, client := setupTestServer(t)
+
+	createTestUser(t, "mary")
+	csrfToken := apiLogin(t, ts, client, "mary")
+
+	created := struct {
+		Post apiPost `json:"post"`
+	}{}
+	status := doJSON(t, client, http.MethodPost, ts.URL+"/api/v1/posts", csrfToken, apiPostIndexRequest{
+		Body:        "hello api",
+		Image:       base64.StdEncoding.EncodeToString(encodeTestImage(t, "png")),
+		ContentType: "image/png",
+	}, &created)
+	if status != http.StatusCreated {
+		t.Fatalf("POST /api/v1/posts: status = %d", status)
+	}
+	if created.Post.Body != "hello api" || created.Post.User.AccountName != "mary" || created.Post.ImageURL != imageURL(Post{ID: created.Post.ID, Mime: "image/png"}) {
+		t.Errorf("unexpected post: %+v", created.Post)
+	}
+
+	commented := struct {
+		Post apiPost `json:"post"`
+	}{}
+	status = doJSON(t, client, http.MethodPost, ts.URL+"/api/v1/comments", csrfToken, apiPostCommentRequest{
+		PostID:  created.Post.ID,
+		Comment: "first!",
+	}, &commented)
+	if status != http.StatusCreated {
+		t.Fatalf("POST /api/v1/comments: status = %d", status)
+	}
+
+	got := struct {
+		Post apiPost `json:"post"`
+	}{}
+	status = doJSON(t, client, http.MethodGet, ts.URL+"/api/v1/posts/"+strconv.Itoa(created.Post.ID), "", nil, &got)
+	if status != http.StatusOK {
+		t.Fatalf("GET /api/v1/posts/{id}: status = %d", status)
+	}
+	if got.Post.Body != "hello api" {
+		t.Errorf("body = %q; want %q", got.Post.Body, "hello api")
+	}
+
+	user := struct {
+		User      apiUser   `json:"user"`
+		PostCount int       `json:"post_count"`
+		Posts     []apiPost `json:"posts"`
+	}{}
+	status = doJSON(t, client, http.MethodGet, ts.URL+"/api/v1/users/mary", "", nil, &user)
+	if status != http.StatusOK || user.PostCount != 1 || len(user.Posts) != 1 {
+		t.Errorf("GET /api/v1/users/mary: status = %d, response = %+v", status, user)
+	}
+
+	list := struct {
+		Posts []apiPost `json:"posts"`
+	}{}
+	status = doJSON(t, client, http.MethodGet, ts.URL+"/api/v1/posts", "", nil, &list)
+	if status != http.StatusOK || len(list.Posts) != 1 || list.Posts[0].ID != created.Post.ID {
+		t.Errorf("GET /api/v1/posts: status = %d, response = %+v", status, list)
+	}
+}
+
+func TestAPIRequiresLoginAndCSRFToken(t *testing.T) {
+	ts, client := setupTestServer(t)
+
+	req := apiPostCommentRequest{PostID: 1, Comment: "spam"}
+	if status := doJSON(t, client, http.MethodPost, ts.URL+"/api/v1/comments", "", req, nil); status != http.StatusUnauthorized {
+		t.Errorf("status without login = %d; want %d", status, http.StatusUnauthorized)
+	}
+
+	createTestUser(t, "mary")
+	apiLogin(t, ts, client, "mary")
+
+	if status := doJSON(t, client, http.MethodPost, ts.URL+"/api/v1/comments", "invalid", req, nil); status != http.StatusUnprocessableEntity {
+		t.Errorf("status with invalid csrf token = %d; want %d", status, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestAPIDeletePost(t *testing.T) {
+	ts, client := setupTestServer(t)
+
+	owner := createTestUser(t, "owner")
+	createTestUser(t, "other")
+	pid, err := createPost(owner, "image/png", encodeTestImage(t, "png"), "api delete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleteURL := ts.URL + "/api/v1/posts/" + strconv.Itoa(pid) + "/delete"
+
+	otherClient := newTestClient(t)
+	otherToken := apiLogin(t, ts, otherClient, "other")
+	if status := doJSON(t, otherClient, http.MethodPost, deleteURL, otherToken, nil, nil); status != http.StatusForbidden {
+		t.Errorf("delete by other user: status = %d; want %d", status, http.StatusForbidden)
+	}
+
+	csrfToken := apiLogin(t, ts, client, "owner")
+	if status := doJSON(t, client, http.MethodPost, deleteURL, "", nil, nil); status != http.StatusUnprocessableEntity {
+		t.Errorf("delete without csrf token: status = %d; want %d", status, http.StatusUnprocessableEntity)
+	}
+	if status := doJSON(t, client, http.MethodPost, deleteURL, "", apiDeletePostRequest{CSRFToken: csrfToken}, nil); status != http.StatusNoContent {
+		t.Fatalf("delete by owner: status = %d; want %d", status, http.StatusNoContent)
+	}
+	if status := doJSON(t, client, http.MethodGet, ts.URL+"/api/v1/posts/"+strconv.Itoa(pid), "", nil, nil); status != http.StatusNotFound {
+		t.Errorf("deleted post: status = %d; want %d", status, http.StatusNotFound)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	crand "crypto/rand"
 	"crypto/sha512"
 	"fmt"
@@ -20,7 +21,7 @@ import (
 	"encoding/json"
 
 	"github.com/bradfitz/gomemcache/memcache"
-	gsm "github.com/bradleypeabody/gorilla-sessions-memcache"
+	"github.com/catatsuy/private-isu/webapp/golang/imgsanitize"
 	"github.com/go-chi/chi/v5"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/sessions"
@@ -31,8 +32,12 @@ import (
 
 var (
 	db             *sqlx.DB
-	store          *gsm.MemcacheStore
-	memcacheClient *memcache.Client
+	repo           Store
+	store          sessions.Store
+	memcacheClient Cache
+	imageStore     ImageStore
+	variants       *variantCache
+	searchIndex    SearchIndex
 )
 
 const (
@@ -41,6 +46,13 @@ const (
 	UploadLimit   = 10 * 1024 * 1024 // 10mb
 )
 
+// User.DelFlgの値
+const (
+	userActive  = 0
+	userBanned  = 1
+	userDeleted = 2 // 設定画面から退会したユーザー
+)
+
 type User struct {
 	ID          int       `db:"id"`
 	AccountName string    `db:"account_name"`
@@ -48,6 +60,13 @@ type User struct {
 	Authority   int       `db:"authority"`
 	DelFlg      int       `db:"del_flg"`
 	CreatedAt   time.Time `db:"created_at"`
+	// SessionVersion は、revokeAllSessionsで進める番号です。ログインした時点と異なるセッションは無効です。
+	SessionVersion int `db:"session_version"`
+	// DisplayName、Bio、AvatarKeyは/settingsで編集するプロフィールです。getSessionUserのキャッシュにも含めます。
+	DisplayName string `db:"display_name"`
+	Bio         string `db:"bio"`
+	// AvatarKey は、アバター画像のImageStoreのキーです。設定していない場合は空文字列です。
+	AvatarKey string `db:"avatar_key"`
 }
 
 type Post struct {
@@ -56,20 +75,41 @@ type Post struct {
 	Imgdata      []byte    `db:"imgdata"`
 	Body         string    `db:"body"`
 	Mime         string    `db:"mime"`
+	ImageKey     string    `db:"image_key"`
+	DelFlg       int       `db:"del_flg"`
 	CreatedAt    time.Time `db:"created_at"`
 	CommentCount int
-	Comments     []Comment
-	User         User `db:"User"`
-	CSRFToken    string
+	LikeCount    int
+	// Liked は、表示しているユーザーがいいねしているかを表します。
+	Liked     bool
+	Comments  []Comment
+	User      User `db:"User"`
+	CSRFToken string
 }
 
 type Comment struct {
+	ID        int        `db:"id"`
+	PostID    int        `db:"post_id"`
+	UserID    int        `db:"user_id"`
+	Comment   string     `db:"comment"`
+	DelFlg    int        `db:"del_flg"`
+	CreatedAt time.Time  `db:"created_at"`
+	EditedAt  *time.Time `db:"edited_at"`
+	User      User       `db:"User"`
+	// CanModify は、表示しているユーザーがコメントを編集・削除できるかを表します。キャッシュには含めません。
+	CanModify bool `json:"-"`
+}
+
+// Notificationは、UserIDのユーザーへの通知です。ActorIDのユーザーがPostIDの投稿で行った操作をKindで表します。
+type Notification struct {
 	ID        int       `db:"id"`
-	PostID    int       `db:"post_id"`
 	UserID    int       `db:"user_id"`
-	Comment   string    `db:"comment"`
+	ActorID   int       `db:"actor_id"`
+	Kind      string    `db:"kind"`
+	PostID    int       `db:"post_id"`
+	ReadFlg   int       `db:"read_flg"`
 	CreatedAt time.Time `db:"created_at"`
-	User      User      `db:"User"`
+	Actor     User      `db:"Actor"`
 }
 
 func init() {
@@ -77,42 +117,97 @@ func init() {
 	if memdAddr == "" {
 		memdAddr = "localhost:11211"
 	}
-	memcacheClient = memcache.New(memdAddr)
-	store = gsm.NewMemcacheStore(memcacheClient, "iscogram_", []byte("sendagaya"))
+	client := memcache.New(memdAddr)
+	memcacheClient = client
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 }
 
-func dbInitialize() {
-	sqls := []string{
-		"DELETE FROM users WHERE id > 1000",
-		"DELETE FROM posts WHERE id > 10000",
-		"DELETE FROM comments WHERE id > 100000",
-		"UPDATE users SET del_flg = 0",
-		"UPDATE users SET del_flg = 1 WHERE id % 50 = 0",
+func tryLogin(accountName, password string) *User {
+	u, err := repo.GetActiveUserByAccountName(accountName)
+	if err != nil {
+		return nil
+	}
+
+	ok, needsRehash := verifyPassword(u, password)
+	if !ok {
+		return nil
 	}
 
-	for _, sql := range sqls {
-		db.Exec(sql)
+	// 旧形式やコストが古いハッシュは、ログインに成功したときに計算し直す
+	// 保存に失敗してもログインはできるので、ログに残すだけにする
+	if needsRehash {
+		passhash, err := hashPassword(password)
+		if err == nil {
+			err = repo.UpdatePasshash(u.ID, passhash)
+		}
+		if err != nil {
+			log.Print(err)
+		} else {
+			u.Passhash = passhash
+		}
 	}
+	return &u
 }
 
-func tryLogin(accountName, password string) *User {
-	u := User{}
-	err := db.Get(&u, "SELECT * FROM users WHERE account_name = ? AND del_flg = 0", accountName)
+// loginFailedNotice は、アカウント名かパスワードが間違っている場合のメッセージです。
+const loginFailedNotice = "アカウント名かパスワードが間違っています"
+
+// loginWithThrottle は、loginThrottleで試行を制限しながらtryLoginでログインします。
+// ログインできない場合は表示するメッセージを返し、試行を制限している場合はthrottledをtrueにします。
+func loginWithThrottle(r *http.Request, accountName, password string) (u *User, notice string, throttled bool) {
+	ip := clientIP(r)
+	b, blocked, err := loginThrottle.Check(accountName, ip)
 	if err != nil {
-		return nil
+		log.Print(err)
+	}
+	if blocked {
+		return nil, b.Notice(time.Now()), true
 	}
 
-	if calculatePasshash(u.AccountName, password) == u.Passhash {
-		return &u
-	} else {
-		return nil
+	u = tryLogin(accountName, password)
+	if u != nil {
+		err = loginThrottle.Succeed(accountName)
+		if err != nil {
+			log.Print(err)
+		}
+		return u, "", false
+	}
+
+	notice, throttled = failLogin(accountName, ip)
+	return nil, notice, throttled
+}
+
+// failLogin は、パスワードの確認に失敗したことをloginThrottleで数えて、表示するメッセージを返します。
+// 失敗が続いてアカウントをロックした場合は、管理者が確認できるようにStoreにも記録します。
+func failLogin(accountName, ip string) (notice string, locked bool) {
+	b, locked, err := loginThrottle.Fail(accountName, ip)
+	if err != nil {
+		log.Print(err)
+	}
+	if !locked {
+		return loginFailedNotice, false
+	}
+
+	lockedUser, err := repo.GetActiveUserByAccountName(accountName)
+	if err == nil {
+		err = repo.RecordLoginLockout(lockedUser.AccountName, b.Until)
 	}
+	if err != nil && err != ErrNotFound {
+		log.Print(err)
+	}
+	return b.Notice(time.Now()), true
 }
 
 func validateUser(accountName, password string) bool {
-	return regexp.MustCompile(`\A[0-9a-zA-Z_]{3,}\z`).MatchString(accountName) &&
-		regexp.MustCompile(`\A[0-9a-zA-Z_]{6,}\z`).MatchString(password)
+	return validateAccountName(accountName) && validatePassword(password)
+}
+
+func validateAccountName(accountName string) bool {
+	return regexp.MustCompile(`\A[0-9a-zA-Z_]{3,}\z`).MatchString(accountName)
+}
+
+func validatePassword(password string) bool {
+	return regexp.MustCompile(`\A[0-9a-zA-Z_]{6,}\z`).MatchString(password)
 }
 
 // 今回のGo実装では言語側のエスケープの仕組みが使えないのでOSコマンドインジェクション対策できない
@@ -137,20 +232,27 @@ func calculateSalt(accountName string) string {
 	return digest(accountName)
 }
 
+// calculatePasshash は、初期データと同じ旧形式のハッシュを計算します。新しいハッシュはhashPasswordで計算します。
 func calculatePasshash(accountName, password string) string {
 	return digest(password + ":" + calculateSalt(accountName))
 }
 
 func getSession(r *http.Request) *sessions.Session {
-	session, _ := store.Get(r, "isuconp-go.session")
+	session, _ := store.Get(r, sessionName)
 
 	return session
 }
 
+// sessionUserID は、セッションに保存されたuser_idをintに変換します。
+// 過去のセッションにはLastInsertIdのint64がそのまま保存されていることがあります。
+func sessionUserID(session *sessions.Session) (int, bool) {
+	return sessionInt(session, "user_id")
+}
+
 func getSessionUser(r *http.Request) User {
 	session := getSession(r)
-	uid, ok := session.Values["user_id"]
-	if !ok || uid == nil {
+	uid, ok := sessionUserID(session)
+	if !ok {
 		return User{}
 	}
 
@@ -159,7 +261,7 @@ func getSessionUser(r *http.Request) User {
 	cacheKey := fmt.Sprintf("user_%d", uid)
 	item, err := memcacheClient.Get(cacheKey)
 	if err == memcache.ErrCacheMiss {
-		err := db.Get(&u, "SELECT * FROM `users` WHERE `id` = ?", uid)
+		u, err = repo.GetUser(uid)
 		if err != nil {
 			return User{}
 		}
@@ -181,6 +283,12 @@ func getSessionUser(r *http.Request) User {
 		}
 	}
 
+	// revokeAllSessionsで無効にしたセッション。session_versionを保存する前のセッションは0として扱う
+	version, _ := sessionInt(session, "session_version")
+	if version != u.SessionVersion {
+		return User{}
+	}
+
 	return u
 }
 
@@ -201,13 +309,14 @@ func getFlash(w http.ResponseWriter, r *http.Request, key string) string {
 //
 // パラメータ:
 //   - results: 処理するPostオブジェクトのスライス。
+//   - me: 表示しているユーザー。いいねしているかの判定に使います。
 //   - csrfToken: 各投稿に含めるCSRFトークンを表す文字列。
 //   - allComments: すべてのコメントを取得するか、最新の3件に制限するかを示すブール値。
 //
 // 戻り値:
 //   - []Post: 必要な詳細が埋め込まれた投稿のスライス。
 //   - error: エラーが発生した場合、そのエラー。
-func makePosts(results []Post, csrfToken string, allComments bool) ([]Post, error) {
+func makePosts(results []Post, me User, csrfToken string, allComments bool) ([]Post, error) {
 	var posts []Post
 
 	// memcacheClient.GetMultiを使って一括で取得
@@ -232,11 +341,38 @@ func makePosts(results []Post, csrfToken string, allComments bool) ([]Post, erro
 		return nil, err
 	}
 
+	// memcacheClient.GetMultiを使って一括で取得
+	// 引数は"like_count_%d", p.IDを配列にしたもの
+	keys = make([]string, len(results))
+	for i, p := range results {
+		keys[i] = fmt.Sprintf("like_count_%d", p.ID)
+	}
+	like_count_cache, err := memcacheClient.GetMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	// 表示しているユーザーがいいねしている投稿は1回のクエリでまとめて取得する
+	liked := map[int]bool{}
+	if isLogin(me) && len(results) > 0 {
+		postIDs := make([]int, len(results))
+		for i, p := range results {
+			postIDs[i] = p.ID
+		}
+		likedIDs, err := repo.ListLikedPostIDs(me.ID, postIDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range likedIDs {
+			liked[id] = true
+		}
+	}
+
 	for _, p := range results {
 		cacheKey := fmt.Sprintf("comment_count_%d", p.ID)
 		item, ok := comment_count_cache[cacheKey]
 		if !ok {
-			err := db.Get(&p.CommentCount, "SELECT COUNT(*) AS `count` FROM `comments` WHERE `post_id` = ?", p.ID)
+			p.CommentCount, err = repo.CountComments(p.ID)
 			if err != nil {
 				return nil, err
 			}
@@ -252,20 +388,35 @@ func makePosts(results []Post, csrfToken string, allComments bool) ([]Post, erro
 			}
 		}
 
+		cacheKey = fmt.Sprintf("like_count_%d", p.ID)
+		item, ok = like_count_cache[cacheKey]
+		if !ok {
+			p.LikeCount, err = repo.CountLikes(p.ID)
+			if err != nil {
+				return nil, err
+			}
+			memcacheClient.Set(&memcache.Item{
+				Key:        cacheKey,
+				Value:      []byte(strconv.Itoa(p.LikeCount)),
+				Expiration: 10,
+			})
+		} else {
+			p.LikeCount, err = strconv.Atoi(string(item.Value))
+			if err != nil {
+				return nil, err
+			}
+		}
+		p.Liked = liked[p.ID]
+
 		var comments []Comment
 		cacheKey = fmt.Sprintf("comments_%d_%t", p.ID, allComments)
 		item, ok = comments_cache[cacheKey]
 		if !ok {
-			query := `SELECT comments.id, comments.post_id, comments.user_id, comments.comment, comments.created_at,
-				users.id as "User.id", users.account_name as "User.account_name", users.authority as "User.authority", users.del_flg as "User.del_flg", users.created_at as "User.created_at"
-				FROM comments
-				JOIN users ON comments.user_id = users.id
-				WHERE comments.post_id = ?
-				ORDER BY comments.created_at DESC`
+			limit := 0
 			if !allComments {
-				query += " LIMIT 3"
+				limit = 3
 			}
-			err = db.Select(&comments, query, p.ID)
+			comments, err = repo.ListComments(p.ID, limit)
 			if err != nil {
 				return nil, err
 			}
@@ -336,18 +487,44 @@ func makePosts(results []Post, csrfToken string, allComments bool) ([]Post, erro
 }
 
 func imageURL(p Post) string {
-	ext := ""
-	if p.Mime == "image/jpeg" {
-		ext = ".jpg"
-	} else if p.Mime == "image/png" {
-		ext = ".png"
-	} else if p.Mime == "image/gif" {
-		ext = ".gif"
+	ext := imageExt(p.Mime)
+	if ext != "" {
+		ext = "." + ext
 	}
 
 	return "/image/" + strconv.Itoa(p.ID) + ext
 }
 
+// templateFuncs は、投稿を表示するテンプレートで使う関数を返します。
+// thumbnailがtrueの場合、thumbnailURLはサムネイルのURLを返し、imgのsrcsetでサムネイルを表示します。
+// タイムライン(posts.html)ではサムネイルを、投稿ページ(post_id.html)では元画像を表示します。
+func templateFuncs(thumbnail bool) template.FuncMap {
+	fmap := template.FuncMap{
+		"imageURL":      imageURL,
+		"canDeletePost": canDeletePost,
+		"linkify":       linkifyBody,
+		"avatarURL":     avatarURL,
+		// layout.htmlで権限に応じて管理画面へのリンクを表示する
+		"can": func(me User, permission string) bool {
+			return hasPermission(me, Permission(permission))
+		},
+		// layout.htmlのヘッダーに表示する未読の通知の数
+		"unreadNotificationCount": unreadNotificationCount,
+		"postCursor": func(p Post) string {
+			return cursorAfter(p).String()
+		},
+	}
+	// 一覧ではsrcsetでサムネイルを表示する。srcは元画像のままにして、画像のURLを変えない
+	fmap["thumbnailURL"] = func(p Post) string {
+		if !thumbnail {
+			return ""
+		}
+		return thumbnailURL(p)
+	}
+	fmap["thumbnailWidth"] = func() int { return thumbnailWidth }
+	return fmap
+}
+
 func isLogin(u User) bool {
 	return u.ID != 0
 }
@@ -361,6 +538,190 @@ func getCSRFToken(r *http.Request) string {
 	return csrfToken.(string)
 }
 
+// validCSRFToken は、リクエストで送られたトークンがセッションのCSRFトークンと一致するかを返します。
+func validCSRFToken(r *http.Request, token string) bool {
+	return token != "" && token == getCSRFToken(r)
+}
+
+// startSession は、ユーザーをログイン状態にしてCSRFトークンを発行します。
+func startSession(w http.ResponseWriter, r *http.Request, u User) {
+	session := getSession(r)
+	session.Values["user_id"] = u.ID
+	session.Values["session_version"] = u.SessionVersion
+	session.Values["csrf_token"] = secureRandomStr(16)
+	session.Save(r, w)
+}
+
+// createPost は、投稿を保存して画像をImageStoreに保存し、採番された投稿IDを返します。
+func createPost(me User, mime string, filedata []byte, body string) (int, error) {
+	// スマートフォンで撮影した画像の位置情報などを配信しないよう、保存する前に取り除く
+	filedata, err := imgsanitize.Sanitize(filedata, mime)
+	if err != nil {
+		return 0, err
+	}
+
+	pid, err := repo.CreatePost(me.ID, mime, body)
+	if err != nil {
+		return 0, err
+	}
+	err = repo.AddPostTags(pid, extractHashtags(body))
+	if err != nil {
+		return 0, err
+	}
+	err = searchIndex.IndexPost(Post{ID: pid, UserID: me.ID, Body: body})
+	if err != nil {
+		return 0, err
+	}
+	// 通知は投稿の付随的な機能なので、失敗しても投稿は成功とする
+	err = notifyMentions(me, pid, body, map[int]bool{me.ID: true})
+	if err != nil {
+		log.Print(err)
+	}
+	// 画像のIDはDBのIDと同じ
+	key, err := imageStore.Put(strconv.Itoa(pid), imageExt(mime), filedata)
+	if err != nil {
+		return 0, err
+	}
+	err = repo.SetPostImageKey(pid, key)
+	if err != nil {
+		return 0, err
+	}
+	// サムネイルは初回のリクエスト時にも生成できるので、失敗しても投稿は成功とする
+	thumb, err := makeThumbnail(filedata, mime, thumbnailWidth)
+	if err == nil {
+		err = variants.Put(pid, thumbnailSuffix, thumbnailMime(mime), thumb)
+	}
+	if err != nil {
+		log.Print(err)
+	}
+	return pid, nil
+}
+
+// createComment は、コメントを作成して検索の索引に追加し、投稿者とメンションされたユーザーに通知します。
+func createComment(me User, postID int, comment string) (int, error) {
+	cid, err := repo.CreateComment(postID, me.ID, comment)
+	if err != nil {
+		return 0, err
+	}
+	err = searchIndex.IndexComment(Comment{ID: cid, PostID: postID, UserID: me.ID, Comment: comment})
+	if err != nil {
+		return 0, err
+	}
+	err = notifyComment(me, postID, comment)
+	if err != nil {
+		log.Print(err)
+	}
+	return cid, nil
+}
+
+// invalidateCommentCache は、makePostsがキャッシュした投稿のコメント数とコメント一覧を削除します。
+func invalidateCommentCache(postID int) error {
+	for _, key := range []string{
+		fmt.Sprintf("comment_count_%d", postID),
+		fmt.Sprintf("comments_%d_%t", postID, true),
+		fmt.Sprintf("comments_%d_%t", postID, false),
+	} {
+		err := memcacheClient.Delete(key)
+		if err != nil && err != memcache.ErrCacheMiss {
+			return err
+		}
+	}
+	return nil
+}
+
+// canModifyComment は、ユーザーがコメントを編集・削除できるかを返します。コメントを書いた本人とpermDeletePostsを持つユーザーができます。
+func canModifyComment(me User, c Comment) bool {
+	return isLogin(me) && (c.UserID == me.ID || hasPermission(me, permDeletePosts))
+}
+
+// canDeletePost は、ユーザーが投稿を削除できるかを返します。投稿者本人とpermDeletePostsを持つユーザーが削除できます。
+func canDeletePost(me User, p Post) bool {
+	return isLogin(me) && (p.UserID == me.ID || hasPermission(me, permDeletePosts))
+}
+
+// deletePost は、投稿を論理削除し、画像とコメントのキャッシュを削除します。
+// 画像は、同じキーを使う投稿やアバターが残っていない場合だけImageStoreから削除します。
+func deletePost(p Post) error {
+	err := repo.DeletePost(p.ID)
+	if err != nil {
+		return err
+	}
+
+	err = invalidateCommentCache(p.ID)
+	if err != nil {
+		return err
+	}
+
+	if p.ImageKey != "" {
+		err = deleteUnusedImage(p.ImageKey)
+		if err != nil {
+			return err
+		}
+	}
+	return variants.Delete(p.ID, p.Mime)
+}
+
+// deleteUnusedImage は、どの投稿もアバターも使っていない画像をImageStoreから削除します。
+// 内容が同じ画像を共有するImageStoreでは、投稿とアバターが同じキーを使っていることがあります。
+func deleteUnusedImage(key string) error {
+	n, err := repo.CountPostsWithImageKey(key)
+	if err != nil {
+		return err
+	}
+	m, err := repo.CountUsersWithAvatarKey(key)
+	if err != nil {
+		return err
+	}
+	if n+m > 0 {
+		return nil
+	}
+	return imageStore.Delete(key)
+}
+
+// deleteComment は、コメントを削除して検索の索引とキャッシュから取り除きます。
+func deleteComment(c Comment) error {
+	err := repo.DeleteComment(c.ID)
+	if err != nil {
+		return err
+	}
+	err = searchIndex.RemoveComment(c.ID)
+	if err != nil {
+		return err
+	}
+	return invalidateCommentCache(c.PostID)
+}
+
+// userStats は、ユーザーページに表示する投稿数・コメント数・被コメント数です。
+type userStats struct {
+	PostCount      int
+	CommentCount   int
+	CommentedCount int
+}
+
+func getUserStats(userID int) (userStats, error) {
+	stats := userStats{}
+
+	var err error
+	stats.CommentCount, err = repo.CountCommentsByUser(userID)
+	if err != nil {
+		return stats, err
+	}
+
+	stats.PostCount, err = repo.CountPostsByUser(userID)
+	if err != nil {
+		return stats, err
+	}
+
+	if stats.PostCount > 0 {
+		stats.CommentedCount, err = repo.CountCommentsOnUserPosts(userID)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	return stats, nil
+}
+
 // secureRandomStrは、指定されたバイト長のセキュアなランダム文字列を生成します。
 // crypto/randを使用してランダムバイトを読み取り、それらのバイトの16進数表現を返します。
 // ランダムバイトの読み取り中にエラーが発生した場合、この関数はパニックを引き起こします。
@@ -383,7 +744,29 @@ func getTemplPath(filename string) string {
 }
 
 func getInitialize(w http.ResponseWriter, r *http.Request) {
-	dbInitialize()
+	// 初期データのユーザーはアバターを持たないので、Initializeで外れるアバター画像は全て消してよい
+	avatarKeys, err := repo.ListAvatarKeys()
+	if err != nil {
+		log.Print(err)
+	}
+	err = repo.Initialize()
+	if err != nil {
+		log.Print(err)
+	}
+	for _, key := range avatarKeys {
+		err = deleteUnusedImage(key)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+	err = searchIndex.Initialize()
+	if err != nil {
+		log.Print(err)
+	}
+	err = loginThrottle.Reset()
+	if err != nil {
+		log.Print(err)
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -395,7 +778,7 @@ func getLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	template.Must(template.ParseFiles(
+	template.Must(template.New("layout.html").Funcs(templateFuncs(false)).ParseFiles(
 		getTemplPath("layout.html"),
 		getTemplPath("login.html")),
 	).Execute(w, struct {
@@ -410,18 +793,15 @@ func postLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	u := tryLogin(r.FormValue("account_name"), r.FormValue("password"))
+	u, notice, _ := loginWithThrottle(r, r.FormValue("account_name"), r.FormValue("password"))
 
 	if u != nil {
-		session := getSession(r)
-		session.Values["user_id"] = u.ID
-		session.Values["csrf_token"] = secureRandomStr(16)
-		session.Save(r, w)
+		startSession(w, r, *u)
 
 		http.Redirect(w, r, "/", http.StatusFound)
 	} else {
 		session := getSession(r)
-		session.Values["notice"] = "アカウント名かパスワードが間違っています"
+		session.Values["notice"] = notice
 		session.Save(r, w)
 
 		http.Redirect(w, r, "/login", http.StatusFound)
@@ -434,7 +814,7 @@ func getRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	template.Must(template.ParseFiles(
+	template.Must(template.New("layout.html").Funcs(templateFuncs(false)).ParseFiles(
 		getTemplPath("layout.html"),
 		getTemplPath("register.html")),
 	).Execute(w, struct {
@@ -461,11 +841,13 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	exists := 0
-	// ユーザーが存在しない場合はエラーになるのでエラーチェックはしない
-	db.Get(&exists, "SELECT 1 FROM users WHERE `account_name` = ?", accountName)
+	exists, err := repo.AccountNameExists(accountName)
+	if err != nil {
+		log.Print(err)
+		return
+	}
 
-	if exists == 1 {
+	if exists {
 		session := getSession(r)
 		session.Values["notice"] = "アカウント名がすでに使われています"
 		session.Save(r, w)
@@ -474,22 +856,19 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := "INSERT INTO `users` (`account_name`, `passhash`) VALUES (?,?)"
-	result, err := db.Exec(query, accountName, calculatePasshash(accountName, password))
+	passhash, err := hashPassword(password)
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
-	session := getSession(r)
-	uid, err := result.LastInsertId()
+	uid, err := repo.CreateUser(accountName, passhash)
 	if err != nil {
 		log.Print(err)
 		return
 	}
-	session.Values["user_id"] = uid
-	session.Values["csrf_token"] = secureRandomStr(16)
-	session.Save(r, w)
+
+	startSession(w, r, User{ID: uid})
 
 	http.Redirect(w, r, "/", http.StatusFound)
 }
@@ -503,142 +882,350 @@ func getLogout(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
-// getIndexはインデックスページのHTTPリクエストを処理します。
-// 現在のセッションユーザーを取得し、データベースから投稿を取得し、
-// それらを処理して、投稿とユーザー情報を含むインデックスページのテンプレートをレンダリングします。
-//
-// パラメータ:
-//   - w: HTTPレスポンスを書き込むためのhttp.ResponseWriter。
-//   - r: HTTPリクエストを表す*http.Request。
-//
-// この関数は以下の手順を実行します:
-//  1. 現在のセッションユーザーを取得します。
-//  2. 作成日を降順に並べ替えた投稿をデータベースから取得します。
-//  3. CSRFトークンなどの追加情報を含むように投稿を処理します。
-//  4. カスタムテンプレート関数のためのテンプレート関数マップを定義します。
-//  5. 投稿、ユーザー情報、CSRFトークン、およびフラッシュメッセージを含むインデックスページのテンプレートをレンダリングします。
-//
-// データベースクエリやテンプレートレンダリング中にエラーが発生した場合、エラーをログに記録し、レスポンスを書き込まずに戻ります。
-func getIndex(w http.ResponseWriter, r *http.Request) {
+// postLogoutAll は、ログインユーザーのすべての端末のセッションを無効にしてログアウトします。
+func postLogoutAll(w http.ResponseWriter, r *http.Request) {
 	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
 
-	results := []Post{}
-
-	query := `SELECT posts.id as id, posts.user_id as user_id, posts.body as body, posts.mime as mime, posts.created_at,
-	users.id as "User.id", users.account_name as "User.account_name", users.authority as "User.authority", users.del_flg as "User.del_flg", users.created_at as "User.created_at"
-	FROM posts 
-	JOIN users ON posts.user_id = users.id 
-	WHERE users.del_flg = 0 
-	ORDER BY posts.created_at DESC 
-	LIMIT 20`
-	err := db.Select(&results, query)
-	if err != nil {
-		log.Print(err)
+	if !validCSRFToken(r, r.FormValue("csrf_token")) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
 		return
 	}
 
-	posts, err := makePosts(results, getCSRFToken(r), false)
+	err := revokeAllSessions(me.ID)
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
-	fmap := template.FuncMap{
-		"imageURL": imageURL,
+	getLogout(w, r)
+}
+
+// getSettings は、パスワードとアカウント名の変更、退会のフォームを表示します。
+func getSettings(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
 	}
 
-	template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
+	template.Must(template.New("layout.html").Funcs(templateFuncs(false)).ParseFiles(
 		getTemplPath("layout.html"),
-		getTemplPath("index.html"),
-		getTemplPath("posts.html"),
-		getTemplPath("post.html"),
+		getTemplPath("settings.html"),
 	)).Execute(w, struct {
-		Posts     []Post
 		Me        User
 		CSRFToken string
 		Flash     string
-	}{posts, me, getCSRFToken(r), getFlash(w, r, "notice")})
+	}{me, getCSRFToken(r), getFlash(w, r, "notice")})
 }
 
-func getAccountName(w http.ResponseWriter, r *http.Request) {
-	accountName := r.PathValue("accountName")
-	user := User{}
+// settingsUser は、/settingsへのPOSTでログインとCSRFトークン、現在のパスワードを確認し、ユーザーを返します。
+// 確認できない場合はレスポンスを書き込んでfalseを返します。
+func settingsUser(w http.ResponseWriter, r *http.Request) (User, bool) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return User{}, false
+	}
 
-	err := db.Get(&user, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", accountName)
-	if err != nil {
-		log.Print(err)
-		return
+	if !validCSRFToken(r, r.FormValue("csrf_token")) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return User{}, false
 	}
 
-	if user.ID == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		return
+	u, err := reauthenticate(r, me, r.FormValue("current_password"))
+	if !finishSettings(w, r, err) {
+		return User{}, false
 	}
+	return u, true
+}
 
-	results := []Post{}
+// finishSettings は、/settingsの操作のエラーを確認します。
+// ユーザーに表示するエラーの場合はメッセージを設定して/settingsに戻し、falseを返します。
+func finishSettings(w http.ResponseWriter, r *http.Request, err error) bool {
+	if notice, ok := settingsNotice(err); ok {
+		session := getSession(r)
+		session.Values["notice"] = notice
+		session.Save(r, w)
 
-	query := `SELECT posts.id as id, posts.user_id as user_id, posts.body as body, posts.mime as mime, posts.created_at,
-	users.id as "User.id", users.account_name as "User.account_name", users.authority as "User.authority", users.del_flg as "User.del_flg", users.created_at as "User.created_at"
-	FROM posts 
-	JOIN users ON posts.user_id = users.id 
-	WHERE users.del_flg = 0 and users.id = ?
-	ORDER BY posts.created_at DESC `
-	// err = db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `user_id` = ? ORDER BY `created_at` DESC", user.ID)
-	err = db.Select(&results, query, user.ID)
+		http.Redirect(w, r, "/settings", http.StatusFound)
+		return false
+	}
 	if err != nil {
 		log.Print(err)
-		return
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
 	}
+	return true
+}
 
-	posts, err := makePosts(results, getCSRFToken(r), false)
+// restartSession は、revokeAllSessionsで無効にしたセッションの代わりに、この端末だけを新しいセッションでログインさせ直します。
+func restartSession(w http.ResponseWriter, r *http.Request, userID int, notice string) {
+	u, err := repo.GetUser(userID)
 	if err != nil {
 		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	commentCount := 0
-	err = db.Get(&commentCount, "SELECT COUNT(*) AS count FROM `comments` WHERE `user_id` = ?", user.ID)
-	if err != nil {
-		log.Print(err)
+	startSession(w, r, u)
+	session := getSession(r)
+	session.Values["notice"] = notice
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/settings", http.StatusFound)
+}
+
+// postSettingsPassword は、現在のパスワードを確認してパスワードを変更します。
+// 他の端末のセッションは無効にし、この端末はログインしたままにします。
+func postSettingsPassword(w http.ResponseWriter, r *http.Request) {
+	u, ok := settingsUser(w, r)
+	if !ok {
 		return
 	}
 
-	postIDs := []int{}
-	err = db.Select(&postIDs, "SELECT `id` FROM `posts` WHERE `user_id` = ?", user.ID)
-	if err != nil {
-		log.Print(err)
+	err := changePassword(u, r.FormValue("new_password"))
+	if !finishSettings(w, r, err) {
+		return
+	}
+
+	restartSession(w, r, u.ID, "パスワードを変更しました")
+}
+
+// postSettingsAccountName は、現在のパスワードを確認してアカウント名を変更します。
+// 他の端末のセッションは無効にし、この端末はログインしたままにします。
+func postSettingsAccountName(w http.ResponseWriter, r *http.Request) {
+	u, ok := settingsUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := changeAccountName(u, r.FormValue("account_name"), r.FormValue("current_password"))
+	if !finishSettings(w, r, err) {
+		return
+	}
+
+	restartSession(w, r, u.ID, "アカウント名を変更しました")
+}
+
+// postSettingsDelete は、現在のパスワードを確認して退会させ、ログアウトします。
+func postSettingsDelete(w http.ResponseWriter, r *http.Request) {
+	u, ok := settingsUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := deleteAccount(u)
+	if !finishSettings(w, r, err) {
+		return
+	}
+
+	getLogout(w, r)
+}
+
+// postSettingsProfile は、表示名、自己紹介、アバター画像を変更します。
+// アバター画像は投稿画像と同じく内容から形式を確認し、ファイルを選ばなかった場合は変更しません。
+func postSettingsProfile(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if !validCSRFToken(r, r.FormValue("csrf_token")) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
 		return
 	}
-	postCount := len(postIDs)
 
-	commentedCount := 0
-	if postCount > 0 {
-		s := []string{}
-		for range postIDs {
-			s = append(s, "?")
+	var mime string
+	var filedata []byte
+	file, header, err := r.FormFile("avatar")
+	if err == nil {
+		defer file.Close()
+
+		filedata, err = io.ReadAll(file)
+		if err != nil {
+			log.Print(err)
+			return
 		}
-		placeholder := strings.Join(s, ", ")
 
-		// convert []int -> []interface{}
-		args := make([]interface{}, len(postIDs))
-		for i, v := range postIDs {
-			args[i] = v
+		if len(filedata) > UploadLimit {
+			session := getSession(r)
+			session.Values["notice"] = "ファイルサイズが大きすぎます"
+			session.Save(r, w)
+
+			http.Redirect(w, r, "/settings", http.StatusFound)
+			return
 		}
 
-		err = db.Get(&commentedCount, "SELECT COUNT(*) AS count FROM `comments` WHERE `post_id` IN ("+placeholder+")", args...)
+		mime, err = inspectImage(filedata, header.Header.Get("Content-Type"))
 		if err != nil {
-			log.Print(err)
+			session := getSession(r)
+			session.Values["notice"] = imageUploadNotices[err]
+			session.Save(r, w)
+
+			http.Redirect(w, r, "/settings", http.StatusFound)
 			return
 		}
 	}
 
+	err = updateProfile(me, r.FormValue("display_name"), r.FormValue("bio"), mime, filedata)
+	notice, ok := profileNotices[err]
+	if !ok && err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		notice = "プロフィールを変更しました"
+	}
+
+	session := getSession(r)
+	session.Values["notice"] = notice
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/settings", http.StatusFound)
+}
+
+// getIndexはインデックスページのHTTPリクエストを処理します。
+// 現在のセッションユーザーを取得し、データベースから投稿を取得し、
+// それらを処理して、投稿とユーザー情報を含むインデックスページのテンプレートをレンダリングします。
+//
+// パラメータ:
+//   - w: HTTPレスポンスを書き込むためのhttp.ResponseWriter。
+//   - r: HTTPリクエストを表す*http.Request。
+//
+// この関数は以下の手順を実行します:
+//  1. 現在のセッションユーザーを取得します。
+//  2. 作成日を降順に並べ替えた投稿をデータベースから取得します。
+//  3. CSRFトークンなどの追加情報を含むように投稿を処理します。
+//  4. カスタムテンプレート関数のためのテンプレート関数マップを定義します。
+//  5. 投稿、ユーザー情報、CSRFトークン、およびフラッシュメッセージを含むインデックスページのテンプレートをレンダリングします。
+//
+// データベースクエリやテンプレートレンダリング中にエラーが発生した場合、エラーをログに記録し、レスポンスを書き込まずに戻ります。
+func getIndex(w http.ResponseWriter, r *http.Request) {
+	renderIndex(w, r, getSessionUser(r), "")
+}
+
+// getFollowing は、フォローしているユーザーの投稿だけを並べたタイムラインを表示します。
+func getFollowing(w http.ResponseWriter, r *http.Request) {
 	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
 
-	fmap := template.FuncMap{
-		"imageURL": imageURL,
+	renderIndex(w, r, me, feedFollowing)
+}
+
+// feedFollowing は、ログインユーザーがフォローしているユーザーの投稿だけを並べるタイムラインです。
+// タイムラインの指定が空の場合は、すべてのユーザーの投稿を並べます。
+const feedFollowing = "following"
+
+// listFeedPosts は、feedのタイムラインでcursorより後ろ(古い側)の投稿を1ページ分返します。
+// ログインしていない場合、フォロー中のタイムラインは空になります。
+func listFeedPosts(me User, feed string, cursor PostCursor) ([]Post, error) {
+	if feed == feedFollowing {
+		if !isLogin(me) {
+			return []Post{}, nil
+		}
+		return repo.ListFollowingPosts(me.ID, cursor, postsPerPage)
+	}
+	return repo.ListPosts(cursor, postsPerPage)
+}
+
+// listMorePosts は、getPostsのクエリに応じて、タグ(tag)、検索(q)、タイムライン(feed)のいずれかの
+// cursorより後ろ(古い側)の投稿を1ページ分返します。
+func listMorePosts(me User, m url.Values, cursor PostCursor) ([]Post, error) {
+	if tag := m.Get("tag"); tag != "" {
+		return repo.ListPostsByTag(normalizeHashtag(tag), cursor, postsPerPage)
+	}
+	if q := m.Get("q"); q != "" {
+		return searchIndex.SearchPosts(q, cursor, postsPerPage)
+	}
+	return listFeedPosts(me, m.Get("feed"), cursor)
+}
+
+// renderIndex は、feedのタイムラインの最初のページをインデックスページのテンプレートでレンダリングします。
+func renderIndex(w http.ResponseWriter, r *http.Request, me User, feed string) {
+	results, err := listFeedPosts(me, feed, PostCursor{})
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	posts, err := makePosts(results, me, getCSRFToken(r), false)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	template.Must(template.New("layout.html").Funcs(templateFuncs(true)).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("index.html"),
+		getTemplPath("posts.html"),
+		getTemplPath("post.html"),
+	)).Execute(w, struct {
+		Posts     []Post
+		Me        User
+		CSRFToken string
+		Flash     string
+		Feed      string
+	}{posts, me, getCSRFToken(r), getFlash(w, r, "notice"), feed})
+}
+
+func getAccountName(w http.ResponseWriter, r *http.Request) {
+	accountName := r.PathValue("accountName")
+
+	user, err := repo.GetActiveUserByAccountName(accountName)
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	me := getSessionUser(r)
+
+	results, err := repo.ListPostsByUser(user.ID, postsPerPage)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	posts, err := makePosts(results, me, getCSRFToken(r), false)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	stats, err := getUserStats(user.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	followingCount, followerCount, err := repo.CountFollows(user.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	following := false
+	if isLogin(me) && me.ID != user.ID {
+		following, err = repo.IsFollowing(me.ID, user.ID)
+		if err != nil {
+			log.Print(err)
+			return
+		}
 	}
 
-	template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
+	template.Must(template.New("layout.html").Funcs(templateFuncs(true)).ParseFiles(
 		getTemplPath("layout.html"),
 		getTemplPath("user.html"),
 		getTemplPath("posts.html"),
@@ -649,8 +1236,12 @@ func getAccountName(w http.ResponseWriter, r *http.Request) {
 		PostCount      int
 		CommentCount   int
 		CommentedCount int
+		FollowingCount int
+		FollowerCount  int
+		Following      bool
 		Me             User
-	}{posts, user, postCount, commentCount, commentedCount, me})
+		CSRFToken      string
+	}{posts, user, stats.PostCount, stats.CommentCount, stats.CommentedCount, followingCount, followerCount, following, me, getCSRFToken(r)})
 }
 
 func getPosts(w http.ResponseWriter, r *http.Request) {
@@ -660,52 +1251,104 @@ func getPosts(w http.ResponseWriter, r *http.Request) {
 		log.Print(err)
 		return
 	}
-	maxCreatedAt := m.Get("max_created_at")
-	if maxCreatedAt == "" {
+	// 従来のmax_created_atと、created_atとidを組み合わせたcursorのどちらでも受け付ける
+	cursor, ok, err := postCursorFromQuery(m.Get("cursor"), m.Get("max_created_at"))
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if !ok {
 		return
 	}
 
-	t, err := time.Parse(ISO8601Format, maxCreatedAt)
+	me := getSessionUser(r)
+	results, err := listMorePosts(me, m, cursor)
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
-	results := []Post{}
-	query := `SELECT posts.id as id, posts.user_id as user_id, posts.body as body, posts.mime as mime, posts.created_at,
-		users.id as "User.id", users.account_name as "User.account_name", users.authority as "User.authority", users.del_flg as "User.del_flg", users.created_at as "User.created_at" 
-		FROM posts 
-		JOIN users ON posts.user_id = users.id 
-		WHERE users.del_flg = 0 and
-		posts.created_at <= ?
-		ORDER BY posts.created_at DESC 
-		LIMIT 20`
-	// err = db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `created_at` <= ? ORDER BY `created_at` DESC", t.Format(ISO8601Format))
-	err = db.Select(&results, query, t.Format(ISO8601Format))
+	posts, err := makePosts(results, me, getCSRFToken(r), false)
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
-	posts, err := makePosts(results, getCSRFToken(r), false)
+	if len(posts) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	template.Must(template.New("posts.html").Funcs(templateFuncs(true)).ParseFiles(
+		getTemplPath("posts.html"),
+		getTemplPath("post.html"),
+	)).Execute(w, posts)
+}
+
+// getTagsTag は、タグが付いた投稿の一覧を表示します。続きはgetPostsにtagを指定して読み込みます。
+func getTagsTag(w http.ResponseWriter, r *http.Request) {
+	tag, err := url.PathUnescape(r.PathValue("tag"))
+	if err != nil || normalizeHashtag(tag) == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	tag = normalizeHashtag(tag)
+
+	results, err := repo.ListPostsByTag(tag, PostCursor{}, postsPerPage)
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
-	if len(posts) == 0 {
-		w.WriteHeader(http.StatusNotFound)
+	me := getSessionUser(r)
+	posts, err := makePosts(results, me, getCSRFToken(r), false)
+	if err != nil {
+		log.Print(err)
 		return
 	}
 
-	fmap := template.FuncMap{
-		"imageURL": imageURL,
+	template.Must(template.New("layout.html").Funcs(templateFuncs(true)).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("tag.html"),
+		getTemplPath("posts.html"),
+		getTemplPath("post.html"),
+	)).Execute(w, struct {
+		Tag   string
+		Posts []Post
+		Me    User
+	}{tag, posts, me})
+}
+
+// getSearch は、qに一致する投稿を検索して表示します。qが空の場合は検索フォームだけを表示します。
+func getSearch(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	me := getSessionUser(r)
+
+	posts := []Post{}
+	if q != "" {
+		results, err := searchIndex.SearchPosts(q, PostCursor{}, postsPerPage)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+
+		posts, err = makePosts(results, me, getCSRFToken(r), false)
+		if err != nil {
+			log.Print(err)
+			return
+		}
 	}
 
-	template.Must(template.New("posts.html").Funcs(fmap).ParseFiles(
+	template.Must(template.New("layout.html").Funcs(templateFuncs(true)).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("search.html"),
 		getTemplPath("posts.html"),
 		getTemplPath("post.html"),
-	)).Execute(w, posts)
+	)).Execute(w, struct {
+		Query string
+		Posts []Post
+		Me    User
+	}{q, posts, me})
 }
 
 func getPostsID(w http.ResponseWriter, r *http.Request) {
@@ -717,19 +1360,16 @@ func getPostsID(w http.ResponseWriter, r *http.Request) {
 	}
 
 	results := []Post{}
-	query := `SELECT posts.id as id, posts.user_id as user_id, posts.body as body, posts.mime as mime, posts.created_at,
-	users.id as "User.id", users.account_name as "User.account_name", users.authority as "User.authority", users.del_flg as "User.del_flg", users.created_at as "User.created_at"
-	FROM posts 
-	JOIN users ON posts.user_id = users.id 
-	WHERE users.del_flg = 0 and posts.id = ?`
-	// err = db.Select(&results, "SELECT * FROM `posts` WHERE `id` = ?", pid)
-	err = db.Select(&results, query, pid)
-	if err != nil {
+	post, err := repo.GetPost(pid)
+	if err != nil && err != ErrNotFound {
 		log.Print(err)
 		return
 	}
+	if err == nil {
+		results = append(results, post)
+	}
 
-	posts, err := makePosts(results, getCSRFToken(r), true)
+	posts, err := makePosts(results, getSessionUser(r), getCSRFToken(r), true)
 	if err != nil {
 		log.Print(err)
 		return
@@ -743,12 +1383,11 @@ func getPostsID(w http.ResponseWriter, r *http.Request) {
 	p := posts[0]
 
 	me := getSessionUser(r)
-
-	fmap := template.FuncMap{
-		"imageURL": imageURL,
+	for i := range p.Comments {
+		p.Comments[i].CanModify = canModifyComment(me, p.Comments[i])
 	}
 
-	template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
+	template.Must(template.New("layout.html").Funcs(templateFuncs(false)).ParseFiles(
 		getTemplPath("layout.html"),
 		getTemplPath("post_id.html"),
 		getTemplPath("post.html"),
@@ -765,7 +1404,7 @@ func postIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if r.FormValue("csrf_token") != getCSRFToken(r) {
+	if !validCSRFToken(r, r.FormValue("csrf_token")) {
 		w.WriteHeader(http.StatusUnprocessableEntity)
 		return
 	}
@@ -780,25 +1419,7 @@ func postIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	mime := ""
-	if file != nil {
-		// 投稿のContent-Typeからファイルのタイプを決定する
-		contentType := header.Header["Content-Type"][0]
-		if strings.Contains(contentType, "jpeg") {
-			mime = "image/jpeg"
-		} else if strings.Contains(contentType, "png") {
-			mime = "image/png"
-		} else if strings.Contains(contentType, "gif") {
-			mime = "image/gif"
-		} else {
-			session := getSession(r)
-			session.Values["notice"] = "投稿できる画像形式はjpgとpngとgifだけです"
-			session.Save(r, w)
-
-			http.Redirect(w, r, "/", http.StatusFound)
-			return
-		}
-	}
+	defer file.Close()
 
 	filedata, err := io.ReadAll(file)
 	if err != nil {
@@ -815,84 +1436,147 @@ func postIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := "INSERT INTO `posts` (`user_id`, `mime`, `imgdata`, `body`) VALUES (?,?,?,?)"
-	result, err := db.Exec(
-		query,
-		me.ID,
-		mime,
-		filedata,
-		r.FormValue("body"),
-	)
-	if err != nil {
-		log.Print(err)
-		return
-	}
-	// 画像はサーバに保存する
-	// 画像のIDはDBのIDと同じ
-	pid, _ := result.LastInsertId()
-	imagePath := fmt.Sprintf("../public/image/%d.%s", pid, strings.TrimPrefix(mime, "image/"))
-	err = os.WriteFile(imagePath, filedata, 0666)
+	// クライアントが送ったContent-Typeではなく、画像の内容からファイルのタイプを決定する
+	mime, err := inspectImage(filedata, header.Header.Get("Content-Type"))
 	if err != nil {
-		log.Print(err)
+		session := getSession(r)
+		session.Values["notice"] = imageUploadNotices[err]
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
 
+	pid, err := createPost(me, mime, filedata, r.FormValue("body"))
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
-	http.Redirect(w, r, "/posts/"+strconv.FormatInt(pid, 10), http.StatusFound)
+	http.Redirect(w, r, "/posts/"+strconv.Itoa(pid), http.StatusFound)
 }
 
+// loadImage は、投稿の元画像を返します。
+// ImageStoreに移行していない投稿はDBの画像データをそのまま返します。
+func loadImage(post Post) ([]byte, error) {
+	if post.ImageKey == "" {
+		return post.Imgdata, nil
+	}
+	return imageStore.Get(post.ImageKey)
+}
+
+// getImage は、/image/{id}.{ext} で元画像を、/image/{id}_thumb.{ext} でサムネイルを返します。
+// 元画像は、Acceptヘッダーに応じてnegotiateImageMimeが決めた形式に変換して返すことがあります。
+// nginxのtry_filesで画像ファイルが直接配信される場合は変換されません。
+// 条件付きリクエストとRangeリクエストに対応していて、Last-Modifiedには投稿日時を返します。
 func getImage(w http.ResponseWriter, r *http.Request) {
-	pidStr := r.PathValue("id")
+	pidStr, thumbnail := strings.CutSuffix(r.PathValue("id"), thumbnailSuffix)
 	pid, err := strconv.Atoi(pidStr)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	post := Post{}
-	err = db.Get(&post, "SELECT * FROM `posts` WHERE `id` = ?", pid)
+	post, err := repo.GetPostImage(pid)
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
+	mime := post.Mime
+	if thumbnail {
+		mime = thumbnailMime(post.Mime)
+	}
 	ext := r.PathValue("ext")
-
-	// 取得したイメージをサーバに保存する
-	imagePath := fmt.Sprintf("../public/image/%d.%s", pid, ext)
-	err = os.WriteFile(imagePath, post.Imgdata, 0666)
-	if err != nil {
-		log.Print(err)
+	if ext == "" || mimeFromExt(ext) != mime {
+		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	if ext == "jpg" && post.Mime == "image/jpeg" ||
-		ext == "png" && post.Mime == "image/png" ||
-		ext == "gif" && post.Mime == "image/gif" {
-		w.Header().Set("Content-Type", post.Mime)
-		_, err := w.Write(post.Imgdata)
-		if err != nil {
-			log.Print(err)
-			return
+	var imgdata []byte
+	if thumbnail {
+		imgdata, err = loadThumbnail(post)
+	} else {
+		// 同じURLでもAcceptヘッダーによって別の形式の画像を返すことがある
+		if f, _ := imageFormatByMime(mime); f.Fallback != "" || f.Alternate != "" {
+			w.Header().Set("Vary", "Accept")
 		}
+		mime = negotiateImageMime(post.Mime, r.Header.Get("Accept"))
+		if mime == post.Mime {
+			imgdata, err = loadImage(post)
+		} else {
+			imgdata, err = loadAlternateImage(post, mime)
+		}
+	}
+	if err == ErrImageNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Print(err)
 		return
 	}
 
-	w.WriteHeader(http.StatusNotFound)
+	// 同じURLの画像は内容が変わらないので、ブラウザに長期間キャッシュさせる
+	w.Header().Set("Content-Type", mime)
+	w.Header().Set("ETag", imageETag(imgdata))
+	w.Header().Set("Cache-Control", imageCacheControl)
+	// If-None-Match、If-Modified-SinceとRangeはServeContentが処理する
+	http.ServeContent(w, r, "", post.CreatedAt, bytes.NewReader(imgdata))
 }
 
-func postComment(w http.ResponseWriter, r *http.Request) {
-	me := getSessionUser(r)
-	if !isLogin(me) {
-		http.Redirect(w, r, "/login", http.StatusFound)
+// getAvatar は、ユーザーのアバター画像を返します。URLはavatarURLで作ります。
+func getAvatar(w http.ResponseWriter, r *http.Request) {
+	uid, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	user, err := repo.GetUser(uid)
+	if err == ErrNotFound || (err == nil && (user.DelFlg != userActive || user.AvatarKey == "")) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	if "."+r.PathValue("ext") != path.Ext(user.AvatarKey) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	imgdata, err := imageStore.Get(user.AvatarKey)
+	if err == ErrImageNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", mimeFromExt(r.PathValue("ext")))
+	w.Header().Set("ETag", imageETag(imgdata))
+	// 画像を変更するとavatarURLのURLが変わるので、同じURLの画像は内容が変わらない
+	w.Header().Set("Cache-Control", imageCacheControl)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(imgdata))
+}
+
+func postComment(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
 		return
 	}
 
-	if r.FormValue("csrf_token") != getCSRFToken(r) {
+	if !validCSRFToken(r, r.FormValue("csrf_token")) {
 		w.WriteHeader(http.StatusUnprocessableEntity)
 		return
 	}
@@ -903,8 +1587,15 @@ func postComment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := "INSERT INTO `comments` (`post_id`, `user_id`, `comment`) VALUES (?,?,?)"
-	_, err = db.Exec(query, postID, me.ID, r.FormValue("comment"))
+	if _, err := repo.GetPost(postID); err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Print(err)
+		return
+	}
+
+	_, err = createComment(me, postID, r.FormValue("comment"))
 	if err != nil {
 		log.Print(err)
 		return
@@ -913,75 +1604,740 @@ func postComment(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, fmt.Sprintf("/posts/%d", postID), http.StatusFound)
 }
 
-func getAdminBanned(w http.ResponseWriter, r *http.Request) {
+// commentToModify は、URLのidのコメントと操作するユーザーを返します。
+// ログインしていない場合、CSRFトークンが一致しない場合、コメントを編集・削除する権限がない場合は
+// レスポンスを書き込んでfalseを返します。
+func commentToModify(w http.ResponseWriter, r *http.Request) (Comment, bool) {
 	me := getSessionUser(r)
 	if !isLogin(me) {
-		http.Redirect(w, r, "/", http.StatusFound)
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return Comment{}, false
+	}
+
+	if !validCSRFToken(r, r.FormValue("csrf_token")) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return Comment{}, false
+	}
+
+	cid, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return Comment{}, false
+	}
+
+	c, err := repo.GetComment(cid)
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return Comment{}, false
+	}
+	if err != nil {
+		log.Print(err)
+		return Comment{}, false
+	}
+
+	if !canModifyComment(me, c) {
+		w.WriteHeader(http.StatusForbidden)
+		return Comment{}, false
+	}
+	return c, true
+}
+
+func postCommentsEdit(w http.ResponseWriter, r *http.Request) {
+	c, ok := commentToModify(w, r)
+	if !ok {
 		return
 	}
 
-	if me.Authority == 0 {
+	err := repo.UpdateComment(c.ID, r.FormValue("comment"))
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	c.Comment = r.FormValue("comment")
+	err = searchIndex.IndexComment(c)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	err = invalidateCommentCache(c.PostID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/posts/%d", c.PostID), http.StatusFound)
+}
+
+func postCommentsDelete(w http.ResponseWriter, r *http.Request) {
+	c, ok := commentToModify(w, r)
+	if !ok {
+		return
+	}
+
+	err := deleteComment(c)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/posts/%d", c.PostID), http.StatusFound)
+}
+
+// postPostsDelete は、投稿者本人または管理者の操作で投稿を削除します。
+func postPostsDelete(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if !validCSRFToken(r, r.FormValue("csrf_token")) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	pid, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	post, err := repo.GetPost(pid)
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	if !canDeletePost(me, post) {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
-	users := []User{}
-	err := db.Select(&users, "SELECT * FROM `users` WHERE `authority` = 0 AND `del_flg` = 0 ORDER BY `created_at` DESC")
+	err = deletePost(post)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// createReport は、フォームのreasonを理由として投稿またはコメントを通報し、投稿のページに戻ります。
+// 自分の投稿・コメントは通報できません。
+func createReport(w http.ResponseWriter, r *http.Request, me User, authorID, postID, commentID int) {
+	if authorID == me.ID {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	reason, err := normalizeReportReason(r.FormValue("reason"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	_, err = repo.CreateReport(me.ID, postID, commentID, reason)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/posts/%d", postID), http.StatusFound)
+}
+
+func postPostsReport(w http.ResponseWriter, r *http.Request) {
+	me, post, ok := postFromRequest(w, r)
+	if !ok {
+		return
+	}
+	createReport(w, r, me, post.UserID, post.ID, 0)
+}
+
+func postCommentsReport(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if !validCSRFToken(r, r.FormValue("csrf_token")) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	cid, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	c, err := repo.GetComment(cid)
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	createReport(w, r, me, c.UserID, c.PostID, c.ID)
+}
+
+// postFromRequest は、URLのidで指定された、いいね・いいねの取り消し・通報の対象の投稿を返します。
+// ログイン、CSRFトークン、投稿の存在を確認し、問題があればレスポンスを書いてfalseを返します。
+func postFromRequest(w http.ResponseWriter, r *http.Request) (User, Post, bool) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return User{}, Post{}, false
+	}
+
+	if !validCSRFToken(r, r.FormValue("csrf_token")) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return User{}, Post{}, false
+	}
+
+	pid, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return User{}, Post{}, false
+	}
+
+	post, err := repo.GetPost(pid)
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return User{}, Post{}, false
+	}
 	if err != nil {
 		log.Print(err)
+		return User{}, Post{}, false
+	}
+	return me, post, true
+}
+
+// invalidateLikeCache は、makePostsがキャッシュした投稿のいいね数を削除します。
+func invalidateLikeCache(postID int) error {
+	err := memcacheClient.Delete(fmt.Sprintf("like_count_%d", postID))
+	if err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
+	return nil
+}
+
+func postPostsLike(w http.ResponseWriter, r *http.Request) {
+	me, post, ok := postFromRequest(w, r)
+	if !ok {
 		return
 	}
 
-	template.Must(template.ParseFiles(
+	liked, err := repo.LikePost(post.ID, me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	// すでにいいねしていた場合は、投稿者に通知し直さない
+	if liked {
+		err = invalidateLikeCache(post.ID)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		err = notify(post.UserID, me.ID, notificationLike, post.ID)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/posts/%d", post.ID), http.StatusFound)
+}
+
+func postPostsUnlike(w http.ResponseWriter, r *http.Request) {
+	me, post, ok := postFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	err := repo.UnlikePost(post.ID, me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	err = invalidateLikeCache(post.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/posts/%d", post.ID), http.StatusFound)
+}
+
+// userToFollow は、フォロー・フォロー解除の対象のユーザーを返します。
+// ログイン、CSRFトークン、ユーザーの存在を確認し、問題があればレスポンスを書いてfalseを返します。
+// 自分自身はフォローできません。
+func userToFollow(w http.ResponseWriter, r *http.Request) (User, User, bool) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return User{}, User{}, false
+	}
+
+	if !validCSRFToken(r, r.FormValue("csrf_token")) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return User{}, User{}, false
+	}
+
+	user, err := repo.GetActiveUserByAccountName(r.PathValue("accountName"))
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return User{}, User{}, false
+	}
+	if err != nil {
+		log.Print(err)
+		return User{}, User{}, false
+	}
+
+	if user.ID == me.ID {
+		w.WriteHeader(http.StatusBadRequest)
+		return User{}, User{}, false
+	}
+	return me, user, true
+}
+
+func postAccountNameFollow(w http.ResponseWriter, r *http.Request) {
+	me, user, ok := userToFollow(w, r)
+	if !ok {
+		return
+	}
+
+	err := repo.Follow(me.ID, user.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	http.Redirect(w, r, "/@"+user.AccountName, http.StatusFound)
+}
+
+func postAccountNameUnfollow(w http.ResponseWriter, r *http.Request) {
+	me, user, ok := userToFollow(w, r)
+	if !ok {
+		return
+	}
+
+	err := repo.Unfollow(me.ID, user.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	http.Redirect(w, r, "/@"+user.AccountName, http.StatusFound)
+}
+
+// getNotifications は、ログインユーザーへの通知を新しい順に表示し、すべて既読にします。
+func getNotifications(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	notifications, err := repo.ListNotifications(me.ID, notificationsPerPage)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	// 表示する通知は既読にする前に取得しているので、今回の表示では未読の通知を区別できる
+	err = repo.MarkNotificationsRead(me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	err = invalidateUnreadNotificationCount(me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	template.Must(template.New("layout.html").Funcs(templateFuncs(false)).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("notifications.html"),
+	)).Execute(w, struct {
+		Notifications []Notification
+		Me            User
+	}{notifications, me})
+}
+
+func getAdminBanned(w http.ResponseWriter, r *http.Request) {
+	me := permittedUser(r)
+
+	users, err := repo.ListBannableUsers()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	bannedUsers, err := repo.ListBannedUsers()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	openReports, err := repo.CountOpenReports()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	template.Must(template.New("layout.html").Funcs(templateFuncs(false)).ParseFiles(
 		getTemplPath("layout.html"),
 		getTemplPath("banned.html")),
 	).Execute(w, struct {
-		Users     []User
+		Users       []User
+		BannedUsers []User
+		OpenReports int
+		Me          User
+		CSRFToken   string
+		Flash       string
+	}{users, bannedUsers, openReports, me, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+func postAdminBanned(w http.ResponseWriter, r *http.Request) {
+	moderateUsersFromForm(w, r, moderationBan)
+}
+
+func postAdminUnbanned(w http.ResponseWriter, r *http.Request) {
+	moderateUsersFromForm(w, r, moderationUnban)
+}
+
+// moderateUsersFromForm は、フォームのuid[]のユーザーをreasonの理由でBANまたはBAN解除して/admin/bannedに戻ります。
+// 理由が空の場合や対象に誤りがある場合は、誰も操作せずにメッセージを表示します。
+// reasonの欄がないBANは、旧来のフォームからの送信としてlegacyBanReasonを記録します。
+func moderateUsersFromForm(w http.ResponseWriter, r *http.Request, action string) {
+	me := permittedUser(r)
+
+	if !validCSRFToken(r, r.FormValue("csrf_token")) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	reason := r.FormValue("reason")
+	if _, ok := r.Form["reason"]; !ok && action == moderationBan {
+		reason = legacyBanReason
+	}
+
+	err = moderateUsers(me, r.Form["uid[]"], action, reason)
+	if notice, ok := moderationNotices[err]; ok {
+		session := getSession(r)
+		session.Values["notice"] = notice
+		session.Save(r, w)
+	} else if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/banned", http.StatusFound)
+}
+
+// getAdminAudit は、モデレーション操作の監査ログを新しい順に表示します。
+// action、account_nameで絞り込み、beforeに前のページの最後のIDを指定して続きを表示します。
+func getAdminAudit(w http.ResponseWriter, r *http.Request) {
+	me := permittedUser(r)
+
+	q := r.URL.Query()
+	filter := ModerationLogFilter{
+		Action:      q.Get("action"),
+		AccountName: strings.TrimSpace(q.Get("account_name")),
+	}
+	if before := q.Get("before"); before != "" {
+		id, err := strconv.Atoi(before)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		filter.BeforeID = id
+	}
+
+	logs, err := repo.ListModerationLogs(filter, moderationLogsPerPage)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	// 1ページ分ある場合だけ次のページへのリンクを表示する
+	next := ""
+	if len(logs) == moderationLogsPerPage {
+		v := url.Values{}
+		if filter.Action != "" {
+			v.Set("action", filter.Action)
+		}
+		if filter.AccountName != "" {
+			v.Set("account_name", filter.AccountName)
+		}
+		v.Set("before", strconv.Itoa(logs[len(logs)-1].ID))
+		next = "/admin/audit?" + v.Encode()
+	}
+
+	template.Must(template.New("layout.html").Funcs(templateFuncs(false)).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("audit.html")),
+	).Execute(w, struct {
+		Logs    []ModerationLog
+		Filter  ModerationLogFilter
+		NextURL string
+		Me      User
+	}{logs, filter, next, me})
+}
+
+// getAdminReports は、未対応の通報を古い順に、通報された投稿またはコメントとともに表示します。
+func getAdminReports(w http.ResponseWriter, r *http.Request) {
+	me := permittedUser(r)
+
+	reports, err := repo.ListOpenReports(reportsPerPage)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	entries := make([]reportEntry, 0, len(reports))
+	for _, rp := range reports {
+		e, err := loadReportEntry(rp)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		entries = append(entries, e)
+	}
+
+	template.Must(template.New("layout.html").Funcs(templateFuncs(false)).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("reports.html")),
+	).Execute(w, struct {
+		Reports   []reportEntry
 		Me        User
 		CSRFToken string
-	}{users, me, getCSRFToken(r)})
+		Flash     string
+	}{entries, me, getCSRFToken(r), getFlash(w, r, "notice")})
 }
 
-func postAdminBanned(w http.ResponseWriter, r *http.Request) {
-	me := getSessionUser(r)
-	if !isLogin(me) {
-		http.Redirect(w, r, "/", http.StatusFound)
+// postAdminReportsID は、通報にフォームのactionで対応して/admin/reportsに戻ります。
+// 見送り(dismiss)、投稿・コメントの削除(delete)、投稿者のBAN(ban)のいずれかを選べます。
+func postAdminReportsID(w http.ResponseWriter, r *http.Request) {
+	me := permittedUser(r)
+
+	if !validCSRFToken(r, r.FormValue("csrf_token")) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
 		return
 	}
 
-	if me.Authority == 0 {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	rp, err := repo.GetReport(id)
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	action := r.FormValue("action")
+	if action == reportActionDelete && !hasPermission(me, permDeletePosts) {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
-	if r.FormValue("csrf_token") != getCSRFToken(r) {
+	// すでに対応済みの通報は何もせずに一覧に戻る
+	if rp.Status == reportOpen {
+		e, err := loadReportEntry(rp)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+
+		err = resolveReport(me, e, action, r.FormValue("reason"))
+		if notice, ok := moderationNotices[err]; ok {
+			session := getSession(r)
+			session.Values["notice"] = notice
+			session.Save(r, w)
+		} else if err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	http.Redirect(w, r, "/admin/reports", http.StatusFound)
+}
+
+// getAdminLockouts は、ログインの失敗が続いてロックされているアカウントを表示します。
+func getAdminLockouts(w http.ResponseWriter, r *http.Request) {
+	me := permittedUser(r)
+
+	lockouts, err := repo.ListLoginLockouts(time.Now())
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	template.Must(template.New("layout.html").Funcs(templateFuncs(false)).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("lockouts.html")),
+	).Execute(w, struct {
+		Lockouts  []LoginLockout
+		Me        User
+		CSRFToken string
+		Flash     string
+	}{lockouts, me, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+// postAdminLockoutsUnlock は、フォームのaccount_nameのアカウントのロックを解除して/admin/lockoutsに戻ります。
+func postAdminLockoutsUnlock(w http.ResponseWriter, r *http.Request) {
+	me := permittedUser(r)
+
+	if !validCSRFToken(r, r.FormValue("csrf_token")) {
 		w.WriteHeader(http.StatusUnprocessableEntity)
 		return
 	}
 
-	query := "UPDATE `users` SET `del_flg` = ? WHERE `id` = ?"
+	err := unlockAccount(me, r.FormValue("account_name"), r.FormValue("reason"))
+	if notice, ok := moderationNotices[err]; ok {
+		session := getSession(r)
+		session.Values["notice"] = notice
+		session.Save(r, w)
+	} else if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-	err := r.ParseForm()
+	http.Redirect(w, r, "/admin/lockouts", http.StatusFound)
+}
+
+// getAdminRoles は、一般ユーザー以外の役割を持つユーザーの一覧と、役割を変更するフォームを表示します。
+func getAdminRoles(w http.ResponseWriter, r *http.Request) {
+	me := permittedUser(r)
+
+	users, err := repo.ListStaffUsers()
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
-	for _, id := range r.Form["uid[]"] {
-		db.Exec(query, 1, id)
+	template.Must(template.New("layout.html").Funcs(templateFuncs(false)).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("roles.html")),
+	).Execute(w, struct {
+		Users     []User
+		Roles     []Role
+		Me        User
+		CSRFToken string
+		Flash     string
+	}{users, roles, me, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+// postAdminRoles は、フォームのaccount_nameのユーザーの役割をroleに変更して/admin/rolesに戻ります。
+func postAdminRoles(w http.ResponseWriter, r *http.Request) {
+	me := permittedUser(r)
+
+	if !validCSRFToken(r, r.FormValue("csrf_token")) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
 	}
 
-	http.Redirect(w, r, "/admin/banned", http.StatusFound)
+	err := changeUserRole(me, r.FormValue("account_name"), r.FormValue("role"), r.FormValue("reason"))
+	if notice, ok := moderationNotices[err]; ok {
+		session := getSession(r)
+		session.Values["notice"] = notice
+		session.Save(r, w)
+	} else if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/roles", http.StatusFound)
 }
 
-func main() {
-	// profiler
-	runtime.SetBlockProfileRate(1)
-	runtime.SetMutexProfileFraction(1)
-	go func() {
-		log.Fatal(http.ListenAndServe(":6060", nil))
-	}()
+// newRouter は、webappのすべてのハンドラーを登録したルーターを返します。
+func newRouter() http.Handler {
+	r := chi.NewRouter()
+
+	r.Get("/initialize", getInitialize)
+	r.Get("/login", getLogin)
+	r.Post("/login", postLogin)
+	r.Get("/register", getRegister)
+	r.Post("/register", postRegister)
+	r.Get("/logout", getLogout)
+	r.Post("/logout/all", postLogoutAll)
+	r.Get("/settings", getSettings)
+	r.Post("/settings/password", postSettingsPassword)
+	r.Post("/settings/account_name", postSettingsAccountName)
+	r.Post("/settings/delete", postSettingsDelete)
+	r.Post("/settings/profile", postSettingsProfile)
+	r.Get("/", getIndex)
+	r.Get("/following", getFollowing)
+	r.Get("/posts", getPosts)
+	r.Get("/posts/{id}", getPostsID)
+	r.Post("/posts/{id}/delete", postPostsDelete)
+	r.Post("/posts/{id}/like", postPostsLike)
+	r.Post("/posts/{id}/unlike", postPostsUnlike)
+	r.Post("/posts/{id}/report", postPostsReport)
+	r.Post("/", postIndex)
+	r.Get("/image/{id}.{ext}", getImage)
+	r.Get("/avatar/{id}.{ext}", getAvatar)
+	r.Post("/comment", postComment)
+	r.Post("/comments/{id}/edit", postCommentsEdit)
+	r.Post("/comments/{id}/delete", postCommentsDelete)
+	r.Post("/comments/{id}/report", postCommentsReport)
+	r.Group(func(r chi.Router) {
+		r.Use(requirePermission(permBanUsers))
+		r.Get("/admin/banned", getAdminBanned)
+		r.Post("/admin/banned", postAdminBanned)
+		r.Post("/admin/unbanned", postAdminUnbanned)
+		r.Get("/admin/audit", getAdminAudit)
+		r.Get("/admin/reports", getAdminReports)
+		r.Post("/admin/reports/{id}", postAdminReportsID)
+		r.Get("/admin/lockouts", getAdminLockouts)
+		r.Post("/admin/lockouts/unlock", postAdminLockoutsUnlock)
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(requirePermission(permManageRoles))
+		r.Get("/admin/roles", getAdminRoles)
+		r.Post("/admin/roles", postAdminRoles)
+	})
+	r.Get(`/@{accountName:[a-zA-Z]+}`, getAccountName)
+	r.Post(`/@{accountName:[a-zA-Z]+}/follow`, postAccountNameFollow)
+	r.Post(`/@{accountName:[a-zA-Z]+}/unfollow`, postAccountNameUnfollow)
+	r.Get("/tags/{tag}", getTagsTag)
+	r.Get("/search", getSearch)
+	r.Get("/notifications", getNotifications)
+	r.Route("/api/v1", apiRoutes)
+	r.Get("/*", func(w http.ResponseWriter, r *http.Request) {
+		http.FileServer(http.Dir("../public")).ServeHTTP(w, r)
+	})
+
+	return r
+}
 
+// openMySQL は、環境変数ISUCONP_DB_*の設定でMySQLに接続します。
+func openMySQL() (*sqlx.DB, error) {
 	host := os.Getenv("ISUCONP_DB_HOST")
 	if host == "" {
 		host = "localhost"
@@ -1013,32 +2369,63 @@ func main() {
 		dbname,
 	)
 
-	db, err = sqlx.Open("mysql", dsn)
-	if err != nil {
-		log.Fatalf("Failed to connect to DB: %s.", err.Error())
-	}
-	defer db.Close()
+	return sqlx.Open("mysql", dsn)
+}
 
-	r := chi.NewRouter()
+func main() {
+	exitIfMigrate()
 
-	r.Get("/initialize", getInitialize)
-	r.Get("/login", getLogin)
-	r.Post("/login", postLogin)
-	r.Get("/register", getRegister)
-	r.Post("/register", postRegister)
-	r.Get("/logout", getLogout)
-	r.Get("/", getIndex)
-	r.Get("/posts", getPosts)
-	r.Get("/posts/{id}", getPostsID)
-	r.Post("/", postIndex)
-	r.Get("/image/{id}.{ext}", getImage)
-	r.Post("/comment", postComment)
-	r.Get("/admin/banned", getAdminBanned)
-	r.Post("/admin/banned", postAdminBanned)
-	r.Get(`/@{accountName:[a-zA-Z]+}`, getAccountName)
-	r.Get("/*", func(w http.ResponseWriter, r *http.Request) {
-		http.FileServer(http.Dir("../public")).ServeHTTP(w, r)
-	})
+	// profiler
+	runtime.SetBlockProfileRate(1)
+	runtime.SetMutexProfileFraction(1)
+	go func() {
+		log.Fatal(http.ListenAndServe(":6060", nil))
+	}()
+
+	err := loadPasswordHashParamsFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure password hashing: %s.", err.Error())
+	}
+	err = loadLoginThrottleIPExemptFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure login throttling: %s.", err.Error())
+	}
+	imageStore, err = newImageStoreFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure image store: %s.", err.Error())
+	}
+	variants = newVariantCacheFromEnv()
+
+	// ISUCONP_STORE=memory の場合はMySQLとmemcachedを使わずにメモリ上だけで動かす
+	sessionBackend := "memcache"
+	switch backend := os.Getenv("ISUCONP_STORE"); backend {
+	case "memory":
+		repo = newMemoryStore()
+		memcacheClient = newMemoryCache()
+		sessionBackend = "memory"
+		searchIndex = newMemorySearchIndex(repo)
+	case "", "mysql":
+		db, err = openMySQL()
+		if err != nil {
+			log.Fatalf("Failed to connect to DB: %s.", err.Error())
+		}
+		defer db.Close()
+		s := newMySQLStore(db)
+		err = s.CheckSchema()
+		if err != nil {
+			log.Fatalf("Failed to check DB schema: %s.", err.Error())
+		}
+		repo = s
+		searchIndex = newMySQLSearchIndex(db)
+	default:
+		log.Fatalf("Unknown store backend ISUCONP_STORE=%q.", backend)
+	}
+	store, err = newSessionStoreFromEnv(sessionBackend)
+	if err != nil {
+		log.Fatalf("Failed to configure session store: %s.", err.Error())
+	}
+	// memcachedが落ちていてもログインの試行を制限できるよう、プロセス内のメモリにフォールバックする
+	loginThrottle = newLoginThrottler(newFallbackCache(memcacheClient, newMemoryCache()))
 
-	log.Fatal(http.ListenAndServe(":8080", r))
+	log.Fatal(http.ListenAndServe(":8080", newRouter()))
 }
@@ -1,7 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	gsm "github.com/bradleypeabody/gorilla-sessions-memcache"
 )
 
 func TestDigest(t *testing.T) {
@@ -21,3 +37,1489 @@ func TestDigest(t *testing.T) {
 		}
 	}
 }
+
+// setupTestServer は、インメモリのStore・Cache・セッションでwebappを起動します。
+func setupTestServer(t *testing.T) (*httptest.Server, *http.Client) {
+	t.Helper()
+
+	repo = newMemoryStore()
+	memcacheClient = newMemoryCache()
+	store = gsm.NewDumbMemorySessionStore()
+	imageStore = newLocalImageStore(t.TempDir())
+	variants = newVariantCache(t.TempDir())
+	searchIndex = newMemorySearchIndex(repo)
+	loginThrottle = newLoginThrottler(memcacheClient)
+
+	// テストではハッシュの計算を速くするためにコストを下げる
+	params := passwordHashParams
+	passwordHashParams = argon2Params{Time: 1, Memory: 64, Threads: 1}
+	t.Cleanup(func() { passwordHashParams = params })
+
+	ts := httptest.NewServer(newRouter())
+	t.Cleanup(ts.Close)
+
+	return ts, newTestClient(t)
+}
+
+// newTestClient は、Cookieを保持してリダイレクトを辿らないクライアントを返します。
+func newTestClient(t *testing.T) *http.Client {
+	t.Helper()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// createTestUser は、パスワードを"password"としてユーザーを作成します。
+func createTestUser(t *testing.T, accountName string) User {
+	t.Helper()
+
+	passhash, err := hashPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := repo.CreateUser(accountName, passhash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := repo.GetUser(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// login は、clientでログインしてCSRFトークンを返します。
+func login(t *testing.T, ts *httptest.Server, client *http.Client, accountName string) string {
+	t.Helper()
+
+	res, err := client.PostForm(ts.URL+"/login", url.Values{
+		"account_name": {accountName},
+		"password":     {"password"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusFound || res.Header.Get("Location") != "/" {
+		t.Fatalf("login failed: status = %d, location = %q", res.StatusCode, res.Header.Get("Location"))
+	}
+
+	body := getBody(t, client, ts.URL+"/")
+	m := regexp.MustCompile(`name="csrf_token" value="([0-9a-f]+)"`).FindStringSubmatch(body)
+	if m == nil {
+		t.Fatal("csrf_token not found")
+	}
+	return m[1]
+}
+
+func getBody(t *testing.T, client *http.Client, u string) string {
+	t.Helper()
+
+	res, err := client.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status = %d", u, res.StatusCode)
+	}
+	return string(b)
+}
+
+func TestPostCommentWithMemoryStore(t *testing.T) {
+	ts, client := setupTestServer(t)
+
+	author := createTestUser(t, "author")
+	pid, err := repo.CreatePost(author.ID, "image/png", "first post")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createTestUser(t, "commenter")
+	csrfToken := login(t, ts, client, "commenter")
+
+	res, err := client.PostForm(ts.URL+"/comment", url.Values{
+		"post_id":    {strconv.Itoa(pid)},
+		"comment":    {"nice photo"},
+		"csrf_token": {csrfToken},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if want := "/posts/" + strconv.Itoa(pid); res.Header.Get("Location") != want {
+		t.Fatalf("Location = %q; want %q", res.Header.Get("Location"), want)
+	}
+
+	body := getBody(t, client, ts.URL+"/posts/"+strconv.Itoa(pid))
+	if !strings.Contains(body, "nice photo") || !strings.Contains(body, "first post") {
+		t.Errorf("post page does not contain the post and comment:\n%s", body)
+	}
+
+	count, err := repo.CountCommentsOnUserPosts(author.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("CountCommentsOnUserPosts = %d; want 1", count)
+	}
+
+	// 存在しない投稿にはコメントできない
+	res, err = client.PostForm(ts.URL+"/comment", url.Values{
+		"post_id":    {strconv.Itoa(pid + 1)},
+		"comment":    {"lost"},
+		"csrf_token": {csrfToken},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("comment on missing post: status = %d; want %d", res.StatusCode, http.StatusNotFound)
+	}
+	if count, err := repo.CountCommentsOnUserPosts(author.ID); err != nil || count != 1 {
+		t.Errorf("CountCommentsOnUserPosts = %d, %v; want 1", count, err)
+	}
+}
+
+func TestPostAdminBannedWithMemoryStore(t *testing.T) {
+	ts, client := setupTestServer(t)
+
+	admin := createTestUser(t, "admin")
+	repo.(*memoryStore).users[admin.ID-1].Authority = 1
+	target := createTestUser(t, "target")
+	if _, err := repo.CreatePost(target.ID, "image/jpeg", "to be hidden"); err != nil {
+		t.Fatal(err)
+	}
+
+	csrfToken := login(t, ts, client, "admin")
+	if body := getBody(t, client, ts.URL+"/"); !strings.Contains(body, "to be hidden") {
+		t.Fatal("post is not shown before ban")
+	}
+
+	// 理由が空のBANは受け付けない
+	res, err := client.PostForm(ts.URL+"/admin/banned", url.Values{
+		"uid[]":      {strconv.Itoa(target.ID)},
+		"reason":     {" "},
+		"csrf_token": {csrfToken},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if _, err := repo.GetActiveUserByAccountName("target"); err != nil {
+		t.Fatalf("user should not be banned without a reason: %v", err)
+	}
+	if body := getBody(t, client, ts.URL+"/admin/banned"); !strings.Contains(body, "理由を入力してください") {
+		t.Error("missing reason should be reported")
+	}
+
+	res, err = client.PostForm(ts.URL+"/admin/banned", url.Values{
+		"uid[]":      {strconv.Itoa(target.ID)},
+		"reason":     {"spam"},
+		"csrf_token": {csrfToken},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if body := getBody(t, client, ts.URL+"/"); strings.Contains(body, "to be hidden") {
+		t.Error("post of banned user is shown on index")
+	}
+	if _, err := repo.GetActiveUserByAccountName("target"); err != ErrNotFound {
+		t.Errorf("GetActiveUserByAccountName error = %v; want ErrNotFound", err)
+	}
+
+	// 理由の欄がない旧来のフォーム(ベンチマーカー)からのBANは、既定の理由で受け付ける
+	legacy := createTestUser(t, "legacy")
+	res, err = client.PostForm(ts.URL+"/admin/banned", url.Values{
+		"uid[]":      {strconv.Itoa(legacy.ID)},
+		"csrf_token": {csrfToken},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if _, err := repo.GetActiveUserByAccountName("legacy"); err != ErrNotFound {
+		t.Errorf("user should be banned by the legacy form: %v", err)
+	}
+	logs, err := repo.ListModerationLogs(ModerationLogFilter{AccountName: "legacy"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 || logs[0].Reason != legacyBanReason {
+		t.Errorf("moderation logs of legacy ban = %+v", logs)
+	}
+}
+
+func TestGetImageFromImageStore(t *testing.T) {
+	ts, client := setupTestServer(t)
+
+	u := createTestUser(t, "mary")
+	data := encodeTestImage(t, "png")
+	pid, err := createPost(u, "image/png", data, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body := getBody(t, client, ts.URL+"/image/"+strconv.Itoa(pid)+".png"); body != string(data) {
+		t.Errorf("image body should be the posted image")
+	}
+
+	res, err := client.Get(ts.URL + "/image/" + strconv.Itoa(pid) + ".jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("status for mismatched extension = %d; want %d", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestGetImageConditionalAndRange(t *testing.T) {
+	ts, client := setupTestServer(t)
+
+	u := createTestUser(t, "mary")
+	data := encodeTestImage(t, "png")
+	pid, err := createPost(u, "image/png", data, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := ts.URL + "/image/" + strconv.Itoa(pid) + ".png"
+
+	get := func(header map[string]string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { res.Body.Close() })
+		return res
+	}
+
+	res := get(nil)
+	etag := res.Header.Get("ETag")
+	lastModified := res.Header.Get("Last-Modified")
+	if res.StatusCode != http.StatusOK || etag == "" || strings.HasPrefix(etag, "W/") || lastModified == "" {
+		t.Fatalf("status = %d, ETag = %q, Last-Modified = %q", res.StatusCode, etag, lastModified)
+	}
+	if !strings.Contains(res.Header.Get("Cache-Control"), "max-age=") {
+		t.Errorf("Cache-Control = %q", res.Header.Get("Cache-Control"))
+	}
+
+	if res := get(map[string]string{"If-None-Match": etag}); res.StatusCode != http.StatusNotModified {
+		t.Errorf("If-None-Match: status = %d; want %d", res.StatusCode, http.StatusNotModified)
+	}
+	if res := get(map[string]string{"If-None-Match": `"other"`}); res.StatusCode != http.StatusOK {
+		t.Errorf("If-None-Match with other ETag: status = %d; want %d", res.StatusCode, http.StatusOK)
+	}
+	if res := get(map[string]string{"If-Modified-Since": lastModified}); res.StatusCode != http.StatusNotModified {
+		t.Errorf("If-Modified-Since: status = %d; want %d", res.StatusCode, http.StatusNotModified)
+	}
+
+	res = get(map[string]string{"Range": "bytes=0-3"})
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusPartialContent || !bytes.Equal(body, data[:4]) {
+		t.Errorf("Range: status = %d, body = %q; want %d, %q", res.StatusCode, body, http.StatusPartialContent, data[:4])
+	}
+}
+
+// postImage は、Content-Typeヘッダーなしで画像をmultipartで投稿し、レスポンスを返します。
+func postImage(t *testing.T, ts *httptest.Server, client *http.Client, csrfToken string, data []byte) *http.Response {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {`form-data; name="file"; filename="upload"`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	mw.WriteField("body", "uploaded")
+	mw.WriteField("csrf_token", csrfToken)
+	mw.Close()
+
+	res, err := client.Post(ts.URL+"/", mw.FormDataContentType(), buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res
+}
+
+func TestPostIndexDetectsImageTypeFromContent(t *testing.T) {
+	ts, client := setupTestServer(t)
+
+	createTestUser(t, "mary")
+	csrfToken := login(t, ts, client, "mary")
+
+	res := postImage(t, ts, client, csrfToken, encodeTestImage(t, "gif"))
+	if res.StatusCode != http.StatusFound || !strings.HasPrefix(res.Header.Get("Location"), "/posts/") {
+		t.Fatalf("upload failed: status = %d, location = %q", res.StatusCode, res.Header.Get("Location"))
+	}
+	body := getBody(t, client, ts.URL+res.Header.Get("Location"))
+	if !strings.Contains(body, `src="/image/1.gif"`) {
+		t.Errorf("image URL is not derived from the sniffed type:\n%s", body)
+	}
+
+	res = postImage(t, ts, client, csrfToken, []byte("\x89PNG\r\n\x1a\nbroken"))
+	if res.Header.Get("Location") != "/" {
+		t.Fatalf("corrupted upload: location = %q; want /", res.Header.Get("Location"))
+	}
+	if body := getBody(t, client, ts.URL+"/"); !strings.Contains(body, imageUploadNotices[errCorruptedImage]) {
+		t.Error("flash message for corrupted upload is not shown")
+	}
+}
+
+func TestPostIndexStripsImageMetadata(t *testing.T) {
+	ts, client := setupTestServer(t)
+
+	createTestUser(t, "mary")
+	csrfToken := login(t, ts, client, "mary")
+
+	// 位置情報の代わりに目印の文字列を入れたEXIFのAPP1セグメントをSOIの直後に挿入する
+	jpg := encodeTestImage(t, "jpg")
+	payload := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\x00\x00GPS 35.6N 139.7E")
+	segment := append([]byte{0xff, 0xe1, 0, byte(len(payload) + 2)}, payload...)
+	withExif := append(append(append([]byte{}, jpg[:2]...), segment...), jpg[2:]...)
+
+	res := postImage(t, ts, client, csrfToken, withExif)
+	if res.StatusCode != http.StatusFound || !strings.HasPrefix(res.Header.Get("Location"), "/posts/") {
+		t.Fatalf("upload failed: status = %d, location = %q", res.StatusCode, res.Header.Get("Location"))
+	}
+
+	body := getBody(t, client, ts.URL+"/image/1.jpg")
+	if strings.Contains(body, "GPS") {
+		t.Error("EXIF should be removed before the image is stored")
+	}
+	if body != string(jpg) {
+		t.Error("image data other than EXIF should be kept")
+	}
+
+	// ベンチマーカーは配信された画像が投稿した画像と一致することを確認するので、
+	// 位置情報を持たない画像はコメントなどのメタデータがあってもそのまま保存する
+	comment := []byte("converted by ImageMagick")
+	withComment := append(append(append([]byte{}, jpg[:2]...), append([]byte{0xff, 0xfe, 0, byte(len(comment) + 2)}, comment...)...), jpg[2:]...)
+	postImage(t, ts, client, csrfToken, withComment)
+	if body := getBody(t, client, ts.URL+"/image/2.jpg"); body != string(withComment) {
+		t.Error("an image without EXIF should be stored as uploaded")
+	}
+}
+
+func TestDeletePost(t *testing.T) {
+	ts, client := setupTestServer(t)
+
+	owner := createTestUser(t, "owner")
+	createTestUser(t, "other")
+	admin := createTestUser(t, "admin")
+	repo.(*memoryStore).users[admin.ID-1].Authority = 1
+
+	pid, err := createPost(owner, "image/png", encodeTestImage(t, "png"), "to be deleted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateComment(pid, owner.ID, "comment on deleted post"); err != nil {
+		t.Fatal(err)
+	}
+	post, err := repo.GetPost(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleteURL := ts.URL + "/posts/" + strconv.Itoa(pid) + "/delete"
+	postDelete := func(client *http.Client, csrfToken string) *http.Response {
+		t.Helper()
+		res, err := client.PostForm(deleteURL, url.Values{"csrf_token": {csrfToken}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	otherClient := newTestClient(t)
+	if res := postDelete(otherClient, login(t, ts, otherClient, "other")); res.StatusCode != http.StatusForbidden {
+		t.Errorf("delete by other user: status = %d; want %d", res.StatusCode, http.StatusForbidden)
+	}
+
+	csrfToken := login(t, ts, client, "owner")
+	// コメントのキャッシュを作っておく
+	if body := getBody(t, client, ts.URL+"/posts/"+strconv.Itoa(pid)); !strings.Contains(body, `action="/posts/`+strconv.Itoa(pid)+`/delete"`) {
+		t.Error("delete form should be shown to the owner")
+	}
+	if res := postDelete(client, "wrong"); res.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("delete with wrong csrf token: status = %d; want %d", res.StatusCode, http.StatusUnprocessableEntity)
+	}
+	if res := postDelete(client, csrfToken); res.StatusCode != http.StatusFound {
+		t.Fatalf("delete by owner: status = %d; want %d", res.StatusCode, http.StatusFound)
+	}
+
+	res, err := client.Get(ts.URL + "/posts/" + strconv.Itoa(pid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("deleted post page: status = %d; want %d", res.StatusCode, http.StatusNotFound)
+	}
+	res, err = client.Get(ts.URL + imageURL(post))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("deleted post image: status = %d; want %d", res.StatusCode, http.StatusNotFound)
+	}
+	if _, err := imageStore.Get(post.ImageKey); err != ErrImageNotFound {
+		t.Errorf("image should be removed from the image store: %v", err)
+	}
+	if _, err := memcacheClient.Get("comments_" + strconv.Itoa(pid) + "_true"); err != memcache.ErrCacheMiss {
+		t.Errorf("comments cache should be invalidated: %v", err)
+	}
+	if body := getBody(t, client, ts.URL+"/"); strings.Contains(body, "to be deleted") {
+		t.Error("deleted post is shown on index")
+	}
+	if n, _ := repo.CountCommentsByUser(owner.ID); n != 0 {
+		t.Errorf("comments on deleted post should not be counted: %d", n)
+	}
+
+	// 管理者は他のユーザーの投稿を削除できる
+	pid, err = createPost(owner, "image/png", encodeTestImage(t, "png"), "deleted by admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleteURL = ts.URL + "/posts/" + strconv.Itoa(pid) + "/delete"
+	adminClient := newTestClient(t)
+	if res := postDelete(adminClient, login(t, ts, adminClient, "admin")); res.StatusCode != http.StatusFound {
+		t.Errorf("delete by admin: status = %d; want %d", res.StatusCode, http.StatusFound)
+	}
+	if _, err := repo.GetPost(pid); err != ErrNotFound {
+		t.Errorf("GetPost error = %v; want ErrNotFound", err)
+	}
+}
+
+func TestDeleteImageSharedWithAvatar(t *testing.T) {
+	setupTestServer(t)
+	// 内容が同じ画像は同じキーになるImageStoreで、投稿とアバターに同じ画像を使う
+	imageStore = newContentAddressedImageStore(t.TempDir())
+
+	u := createTestUser(t, "alice")
+	pid, err := createPost(u, "image/png", encodeTestImage(t, "png"), "shared image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	post, err := repo.GetPost(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.UpdateProfile(u.ID, "", "", post.ImageKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := deletePost(post); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := imageStore.Get(post.ImageKey); err != nil {
+		t.Fatalf("image used as an avatar should be kept: %v", err)
+	}
+
+	// アバターを変更すると、どこからも使われなくなった画像を削除する
+	u, err = repo.GetUser(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := updateProfile(u, "", "", "image/jpeg", encodeTestImage(t, "jpg")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := imageStore.Get(post.ImageKey); err != ErrImageNotFound {
+		t.Errorf("unused image should be removed from the image store: %v", err)
+	}
+}
+
+func TestEditAndDeleteComment(t *testing.T) {
+	ts, client := setupTestServer(t)
+
+	author := createTestUser(t, "author")
+	createTestUser(t, "other")
+	admin := createTestUser(t, "admin")
+	repo.(*memoryStore).users[admin.ID-1].Authority = 1
+
+	pid, err := createPost(author, "image/png", encodeTestImage(t, "png"), "post")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cid, err := repo.CreateComment(pid, author.ID, "typpo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	postURL := ts.URL + "/posts/" + strconv.Itoa(pid)
+	commentURL := ts.URL + "/comments/" + strconv.Itoa(cid)
+
+	postForm := func(client *http.Client, u string, values url.Values) *http.Response {
+		t.Helper()
+		res, err := client.PostForm(u, values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	csrfToken := login(t, ts, client, "author")
+	// makePostsがコメントをキャッシュした状態で編集する
+	if body := getBody(t, client, ts.URL+"/"); !strings.Contains(body, "typpo") {
+		t.Fatal("comment is not shown")
+	}
+	if body := getBody(t, client, postURL); !strings.Contains(body, `action="/comments/`+strconv.Itoa(cid)+`/edit"`) {
+		t.Error("edit form should be shown to the author")
+	}
+
+	otherClient := newTestClient(t)
+	otherToken := login(t, ts, otherClient, "other")
+	if body := getBody(t, otherClient, postURL); strings.Contains(body, "/comments/"+strconv.Itoa(cid)+"/edit") {
+		t.Error("edit form should not be shown to other users")
+	}
+	res := postForm(otherClient, commentURL+"/edit", url.Values{"comment": {"hijacked"}, "csrf_token": {otherToken}})
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("edit by other user: status = %d; want %d", res.StatusCode, http.StatusForbidden)
+	}
+
+	res = postForm(client, commentURL+"/edit", url.Values{"comment": {"typo"}, "csrf_token": {csrfToken}})
+	if res.StatusCode != http.StatusFound || res.Header.Get("Location") != "/posts/"+strconv.Itoa(pid) {
+		t.Fatalf("edit by author: status = %d, location = %q", res.StatusCode, res.Header.Get("Location"))
+	}
+	for _, u := range []string{ts.URL + "/", postURL} {
+		body := getBody(t, client, u)
+		if strings.Contains(body, "typpo") || !strings.Contains(body, "typo") {
+			t.Errorf("%s: edited comment is not shown", u)
+		}
+		if !strings.Contains(body, "isu-comment-edited") {
+			t.Errorf("%s: edited marker is not shown", u)
+		}
+	}
+
+	// 管理者は他のユーザーのコメントを削除できる
+	adminClient := newTestClient(t)
+	adminToken := login(t, ts, adminClient, "admin")
+	res = postForm(adminClient, commentURL+"/delete", url.Values{"csrf_token": {adminToken}})
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("delete by admin: status = %d; want %d", res.StatusCode, http.StatusFound)
+	}
+	body := getBody(t, client, ts.URL+"/")
+	if strings.Contains(body, "typo") || !strings.Contains(body, "comments: <b>0</b>") {
+		t.Error("deleted comment should not be shown or counted")
+	}
+	if res := postForm(client, commentURL+"/edit", url.Values{"comment": {"again"}, "csrf_token": {csrfToken}}); res.StatusCode != http.StatusNotFound {
+		t.Errorf("edit deleted comment: status = %d; want %d", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestLikePost(t *testing.T) {
+	ts, client := setupTestServer(t)
+
+	author := createTestUser(t, "author")
+	createTestUser(t, "fan")
+
+	pid, err := createPost(author, "image/png", encodeTestImage(t, "png"), "post")
+	if err != nil {
+		t.Fatal(err)
+	}
+	postURL := ts.URL + "/posts/" + strconv.Itoa(pid)
+
+	postForm := func(client *http.Client, u string, values url.Values) *http.Response {
+		t.Helper()
+		res, err := client.PostForm(u, values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	if res := postForm(client, postURL+"/like", url.Values{}); res.StatusCode != http.StatusFound || res.Header.Get("Location") != "/login" {
+		t.Errorf("like without login: status = %d, location = %q", res.StatusCode, res.Header.Get("Location"))
+	}
+
+	csrfToken := login(t, ts, client, "fan")
+	// makePostsがいいね数をキャッシュした状態でいいねする
+	if body := getBody(t, client, ts.URL+"/"); !strings.Contains(body, `likes: <b class="isu-post-like-count">0</b>`) {
+		t.Fatal("like count is not shown")
+	}
+	if res := postForm(client, postURL+"/like", url.Values{"csrf_token": {"wrong"}}); res.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("like with wrong csrf token: status = %d; want %d", res.StatusCode, http.StatusUnprocessableEntity)
+	}
+	if res := postForm(client, ts.URL+"/posts/9999/like", url.Values{"csrf_token": {csrfToken}}); res.StatusCode != http.StatusNotFound {
+		t.Errorf("like missing post: status = %d; want %d", res.StatusCode, http.StatusNotFound)
+	}
+
+	// 2回いいねしても1件と数える
+	for i := 0; i < 2; i++ {
+		res := postForm(client, postURL+"/like", url.Values{"csrf_token": {csrfToken}})
+		if res.StatusCode != http.StatusFound || res.Header.Get("Location") != "/posts/"+strconv.Itoa(pid) {
+			t.Fatalf("like: status = %d, location = %q", res.StatusCode, res.Header.Get("Location"))
+		}
+	}
+	body := getBody(t, client, ts.URL+"/")
+	if !strings.Contains(body, `likes: <b class="isu-post-like-count">1</b>`) {
+		t.Error("like count should be 1")
+	}
+	// 投稿者への通知も1件だけ
+	if n, err := repo.CountUnreadNotifications(author.ID); err != nil || n != 1 {
+		t.Errorf("CountUnreadNotifications = %d, %v; want 1", n, err)
+	}
+	if !strings.Contains(body, `action="/posts/`+strconv.Itoa(pid)+`/unlike"`) {
+		t.Error("unlike form should be shown to the user who liked the post")
+	}
+
+	// いいねしていないユーザーにはいいねのフォームを表示する
+	authorClient := newTestClient(t)
+	login(t, ts, authorClient, "author")
+	if body := getBody(t, authorClient, postURL); !strings.Contains(body, `action="/posts/`+strconv.Itoa(pid)+`/like"`) {
+		t.Error("like form should be shown to the user who has not liked the post")
+	}
+
+	if res := postForm(client, postURL+"/unlike", url.Values{"csrf_token": {csrfToken}}); res.StatusCode != http.StatusFound {
+		t.Fatalf("unlike: status = %d; want %d", res.StatusCode, http.StatusFound)
+	}
+	body = getBody(t, client, postURL)
+	if !strings.Contains(body, `likes: <b class="isu-post-like-count">0</b>`) {
+		t.Error("like count should be 0 after unlike")
+	}
+	if !strings.Contains(body, `action="/posts/`+strconv.Itoa(pid)+`/like"`) {
+		t.Error("like form should be shown after unlike")
+	}
+}
+
+func TestFollowingTimeline(t *testing.T) {
+	ts, client := setupTestServer(t)
+
+	reader := createTestUser(t, "reader")
+	writer := createTestUser(t, "writer")
+	stranger := createTestUser(t, "stranger")
+
+	for i := 0; i < postsPerPage+1; i++ {
+		if _, err := repo.CreatePost(writer.ID, "image/png", fmt.Sprintf("writer post %d.", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := repo.CreatePost(stranger.ID, "image/png", "stranger post"); err != nil {
+		t.Fatal(err)
+	}
+
+	postForm := func(u string, values url.Values) *http.Response {
+		t.Helper()
+		res, err := client.PostForm(u, values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	res, err := client.Get(ts.URL + "/following")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusFound || res.Header.Get("Location") != "/login" {
+		t.Errorf("following timeline without login: status = %d, location = %q", res.StatusCode, res.Header.Get("Location"))
+	}
+
+	csrfToken := login(t, ts, client, "reader")
+	if res := postForm(ts.URL+"/@reader/follow", url.Values{"csrf_token": {csrfToken}}); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("follow myself: status = %d; want %d", res.StatusCode, http.StatusBadRequest)
+	}
+	if res := postForm(ts.URL+"/@writer/follow", url.Values{"csrf_token": {"wrong"}}); res.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("follow with wrong csrf token: status = %d; want %d", res.StatusCode, http.StatusUnprocessableEntity)
+	}
+	if body := getBody(t, client, ts.URL+"/following"); strings.Contains(body, "isu-post-text") {
+		t.Error("following timeline should be empty before following")
+	}
+
+	res = postForm(ts.URL+"/@writer/follow", url.Values{"csrf_token": {csrfToken}})
+	if res.StatusCode != http.StatusFound || res.Header.Get("Location") != "/@writer" {
+		t.Fatalf("follow: status = %d, location = %q", res.StatusCode, res.Header.Get("Location"))
+	}
+	body := getBody(t, client, ts.URL+"/@writer")
+	if !strings.Contains(body, `<span class="isu-follower-count">1</span>`) || !strings.Contains(body, `action="/@writer/unfollow"`) {
+		t.Error("user page should show the follower count and the unfollow form")
+	}
+
+	body = getBody(t, client, ts.URL+"/following")
+	if strings.Contains(body, "stranger post") {
+		t.Error("following timeline should not contain posts of users not followed")
+	}
+	if strings.Contains(body, "writer post 0.") || !strings.Contains(body, fmt.Sprintf("writer post %d.", postsPerPage)) {
+		t.Error("following timeline should show the latest page of followed users' posts")
+	}
+	if !strings.Contains(body, `data-feed="following"`) {
+		t.Error("following timeline should load more posts from the same feed")
+	}
+	if body := getBody(t, client, ts.URL+"/"); !strings.Contains(body, "stranger post") {
+		t.Error("global timeline should still contain all posts")
+	}
+
+	// 2ページ目もフォロー中のタイムラインから読み込む
+	last, err := repo.ListFollowingPosts(reader.ID, PostCursor{}, postsPerPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor := cursorAfter(last[len(last)-1]).String()
+	body = getBody(t, client, ts.URL+"/posts?feed=following&cursor="+url.QueryEscape(cursor))
+	if !strings.Contains(body, "writer post 0.") || strings.Contains(body, "stranger post") {
+		t.Error("next page of following timeline should contain only the oldest followed post")
+	}
+
+	if res := postForm(ts.URL+"/@writer/unfollow", url.Values{"csrf_token": {csrfToken}}); res.StatusCode != http.StatusFound {
+		t.Fatalf("unfollow: status = %d; want %d", res.StatusCode, http.StatusFound)
+	}
+	if body := getBody(t, client, ts.URL+"/following"); strings.Contains(body, "writer post") {
+		t.Error("following timeline should be empty after unfollowing")
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	ts, client := setupTestServer(t)
+
+	alice := createTestUser(t, "alice")
+	bob := createTestUser(t, "bob")
+	createTestUser(t, "carol")
+
+	pid, err := createPost(alice, "image/png", encodeTestImage(t, "png"), "hello @carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	postURL := ts.URL + "/posts/" + strconv.Itoa(pid)
+
+	bobClient := newTestClient(t)
+	bobToken := login(t, ts, bobClient, "bob")
+	for _, req := range []struct {
+		path   string
+		values url.Values
+	}{
+		{"/comment", url.Values{"post_id": {strconv.Itoa(pid)}, "comment": {"@carol @alice @nobody nice"}}},
+		{"/comment", url.Values{"post_id": {strconv.Itoa(pid)}, "comment": {"another"}}},
+		{"/posts/" + strconv.Itoa(pid) + "/like", url.Values{}},
+	} {
+		req.values.Set("csrf_token", bobToken)
+		res, err := bobClient.PostForm(ts.URL+req.path, req.values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusFound {
+			t.Fatalf("POST %s: status = %d; want %d", req.path, res.StatusCode, http.StatusFound)
+		}
+	}
+
+	body := getBody(t, bobClient, postURL)
+	if !strings.Contains(body, `<a href="/@carol" class="isu-mention">@carol</a> <a href="/@alice" class="isu-mention">@alice</a>`) {
+		t.Error("mentions in comments should be linkified")
+	}
+	if strings.Contains(body, "isu-unread-count") {
+		t.Error("bob should have no unread notifications")
+	}
+
+	// aliceにはメンション1件(コメント通知と重複させない)、コメント1件、いいね1件
+	login(t, ts, client, "alice")
+	if body := getBody(t, client, ts.URL+"/"); !strings.Contains(body, `<span class="isu-unread-count">(3)</span>`) {
+		t.Error("alice should have 3 unread notifications")
+	}
+	body = getBody(t, client, ts.URL+"/notifications")
+	for _, want := range []string{"あなたをメンションしました", "あなたの投稿にコメントしました", "あなたの投稿にいいねしました"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("notifications should contain %q", want)
+		}
+	}
+	if strings.Count(body, `class="isu-notification unread"`) != 3 {
+		t.Error("notifications should be shown as unread on the first visit")
+	}
+	if strings.Contains(body, "isu-unread-count") {
+		t.Error("notifications should be marked as read")
+	}
+	if body := getBody(t, client, ts.URL+"/notifications"); strings.Contains(body, "unread") {
+		t.Error("notifications should be read on the second visit")
+	}
+
+	// carolには投稿とコメントのメンションが1件ずつ
+	carolClient := newTestClient(t)
+	login(t, ts, carolClient, "carol")
+	if body := getBody(t, carolClient, ts.URL+"/"); !strings.Contains(body, `<span class="isu-unread-count">(2)</span>`) {
+		t.Error("carol should have 2 unread notifications")
+	}
+
+	// BANされたユーザーからの通知は表示しない
+	if err := repo.BanUser(bob.ID); err != nil {
+		t.Fatal(err)
+	}
+	if body := getBody(t, carolClient, ts.URL+"/notifications"); strings.Contains(body, "bob") || !strings.Contains(body, "alice") {
+		t.Error("notifications from banned users should be hidden")
+	}
+}
+
+func TestAdminUnbanAndAudit(t *testing.T) {
+	ts, client := setupTestServer(t)
+
+	admin := createTestUser(t, "admin")
+	repo.(*memoryStore).users[admin.ID-1].Authority = 1
+	target := createTestUser(t, "target")
+	other := createTestUser(t, "other")
+	createTestUser(t, "normal")
+
+	moderate := func(path string, reason string, uids ...int) {
+		t.Helper()
+		values := url.Values{"reason": {reason}, "csrf_token": {login(t, ts, client, "admin")}}
+		for _, uid := range uids {
+			values.Add("uid[]", strconv.Itoa(uid))
+		}
+		res, err := client.PostForm(ts.URL+path, values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusFound || res.Header.Get("Location") != "/admin/banned" {
+			t.Fatalf("POST %s: status = %d, location = %q", path, res.StatusCode, res.Header.Get("Location"))
+		}
+	}
+
+	normalClient := newTestClient(t)
+	login(t, ts, normalClient, "normal")
+	res, err := normalClient.Get(ts.URL + "/admin/audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("audit log by normal user: status = %d; want %d", res.StatusCode, http.StatusForbidden)
+	}
+
+	moderate("/admin/banned", "spam", target.ID, other.ID)
+	// 対象に管理者が含まれる場合は誰も操作しない
+	moderate("/admin/unbanned", "mistake", target.ID, admin.ID)
+	if _, err := repo.GetActiveUserByAccountName("target"); err != ErrNotFound {
+		t.Fatal("unban should not be applied when one of the targets is invalid")
+	}
+
+	body := getBody(t, client, ts.URL+"/admin/banned")
+	if !strings.Contains(body, `data-banned-account-name="target"`) || strings.Contains(body, `data-account-name="target"`) {
+		t.Error("banned user should be listed in the unban form")
+	}
+
+	moderate("/admin/unbanned", "mistake", target.ID)
+	if _, err := repo.GetActiveUserByAccountName("target"); err != nil {
+		t.Fatalf("target should be unbanned: %v", err)
+	}
+
+	logs, err := repo.ListModerationLogs(ModerationLogFilter{}, moderationLogsPerPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 3 {
+		t.Fatalf("%d audit logs; want 3", len(logs))
+	}
+	if l := logs[0]; l.Action != moderationUnban || l.ActorAccountName != "admin" || l.TargetAccountName != "target" || l.Reason != "mistake" {
+		t.Errorf("latest audit log = %+v", l)
+	}
+
+	body = getBody(t, client, ts.URL+"/admin/audit?action=ban&account_name=other")
+	if n := strings.Count(body, `class="isu-audit-log"`); n != 1 || !strings.Contains(body, "spam") {
+		t.Errorf("filtered audit log shows %d rows; want 1", n)
+	}
+	if body := getBody(t, client, ts.URL+"/admin/audit?account_name=admin"); strings.Count(body, `class="isu-audit-log"`) != 3 {
+		t.Error("audit log should be filtered by the actor")
+	}
+}
+
+func TestAdminRoles(t *testing.T) {
+	ts, client := setupTestServer(t)
+
+	admin := createTestUser(t, "admin")
+	repo.(*memoryStore).users[admin.ID-1].Authority = int(roleAdmin)
+	createTestUser(t, "mod")
+	createTestUser(t, "normal")
+	csrfToken := login(t, ts, client, "admin")
+
+	changeRole := func(accountName, role, reason string) {
+		t.Helper()
+		res, err := client.PostForm(ts.URL+"/admin/roles", url.Values{
+			"account_name": {accountName},
+			"role":         {role},
+			"reason":       {reason},
+			"csrf_token":   {csrfToken},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusFound || res.Header.Get("Location") != "/admin/roles" {
+			t.Fatalf("POST /admin/roles: status = %d, location = %q", res.StatusCode, res.Header.Get("Location"))
+		}
+	}
+	status := func(client *http.Client, path string) int {
+		t.Helper()
+		res, err := client.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	modClient := newTestClient(t)
+	login(t, ts, modClient, "mod")
+	if code := status(modClient, "/admin/banned"); code != http.StatusForbidden {
+		t.Errorf("GET /admin/banned by user: status = %d; want %d", code, http.StatusForbidden)
+	}
+
+	changeRole("mod", "moderator", "")
+	changeRole("admin", "user", "self")
+	if body := getBody(t, client, ts.URL+"/admin/roles"); strings.Contains(body, `data-account-name="mod"`) || !strings.Contains(body, "自分自身は操作できません") {
+		t.Error("role change without a reason or to oneself should be rejected")
+	}
+
+	changeRole("mod", "moderator", "trusted")
+	if body := getBody(t, client, ts.URL+"/admin/roles"); !strings.Contains(body, `data-account-name="mod"`) {
+		t.Error("moderator should be listed")
+	}
+
+	// モデレーターはBANできるが、役割は変更できない
+	if code := status(modClient, "/admin/banned"); code != http.StatusOK {
+		t.Errorf("GET /admin/banned by moderator: status = %d; want %d", code, http.StatusOK)
+	}
+	if code := status(modClient, "/admin/roles"); code != http.StatusForbidden {
+		t.Errorf("GET /admin/roles by moderator: status = %d; want %d", code, http.StatusForbidden)
+	}
+	if body := getBody(t, modClient, ts.URL+"/"); !strings.Contains(body, `href="/admin/banned"`) || strings.Contains(body, `href="/admin/roles"`) {
+		t.Error("header links should follow the permissions")
+	}
+
+	changeRole("mod", "user", "inactive")
+	if code := status(modClient, "/admin/banned"); code != http.StatusForbidden {
+		t.Errorf("GET /admin/banned by demoted user: status = %d; want %d", code, http.StatusForbidden)
+	}
+
+	body := getBody(t, client, ts.URL+"/admin/audit?action=role")
+	if n := strings.Count(body, `class="isu-audit-log"`); n != 2 || !strings.Contains(body, "moderator -&gt; user") {
+		t.Errorf("role changes should be recorded in the audit log: %d rows", n)
+	}
+}
+
+func TestReports(t *testing.T) {
+	ts, client := setupTestServer(t)
+
+	author := createTestUser(t, "author")
+	commenter := createTestUser(t, "commenter")
+	createTestUser(t, "reporter")
+	mod := createTestUser(t, "mod")
+	repo.(*memoryStore).users[mod.ID-1].Authority = int(roleModerator)
+
+	pid, err := createPost(author, "image/png", encodeTestImage(t, "png"), "post")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cid, err := repo.CreateComment(pid, commenter.ID, "abuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	postForm := func(client *http.Client, path string, values url.Values) *http.Response {
+		t.Helper()
+		res, err := client.PostForm(ts.URL+path, values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	csrfToken := login(t, ts, client, "reporter")
+	postPath := "/posts/" + strconv.Itoa(pid)
+	if res := postForm(client, postPath+"/report", url.Values{"reason": {"spam"}, "csrf_token": {csrfToken}}); res.StatusCode != http.StatusFound || res.Header.Get("Location") != postPath {
+		t.Fatalf("report post: status = %d, location = %q", res.StatusCode, res.Header.Get("Location"))
+	}
+	if res := postForm(client, "/comments/"+strconv.Itoa(cid)+"/report", url.Values{"reason": {"rude"}, "csrf_token": {csrfToken}}); res.StatusCode != http.StatusFound {
+		t.Fatalf("report comment: status = %d", res.StatusCode)
+	}
+	if res := postForm(client, "/admin/reports/1", url.Values{"action": {"dismiss"}, "csrf_token": {csrfToken}}); res.StatusCode != http.StatusForbidden {
+		t.Errorf("resolve report by user: status = %d; want %d", res.StatusCode, http.StatusForbidden)
+	}
+
+	// 自分の投稿は通報できない
+	authorClient := newTestClient(t)
+	authorToken := login(t, ts, authorClient, "author")
+	if res := postForm(authorClient, postPath+"/report", url.Values{"csrf_token": {authorToken}}); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("report own post: status = %d; want %d", res.StatusCode, http.StatusBadRequest)
+	}
+
+	modClient := newTestClient(t)
+	modToken := login(t, ts, modClient, "mod")
+	if body := getBody(t, modClient, ts.URL+"/admin/banned"); !strings.Contains(body, "通報 (2)") {
+		t.Error("open report count should be shown on the admin page")
+	}
+	body := getBody(t, modClient, ts.URL+"/admin/reports")
+	if n := strings.Count(body, `class="isu-report"`); n != 2 || !strings.Contains(body, "abuse") || !strings.Contains(body, "spam") {
+		t.Fatalf("%d reports in the queue; want 2", n)
+	}
+
+	resolve := func(id int, action, reason string) {
+		t.Helper()
+		res := postForm(modClient, "/admin/reports/"+strconv.Itoa(id), url.Values{"action": {action}, "reason": {reason}, "csrf_token": {modToken}})
+		if res.StatusCode != http.StatusFound || res.Header.Get("Location") != "/admin/reports" {
+			t.Fatalf("resolve report: status = %d, location = %q", res.StatusCode, res.Header.Get("Location"))
+		}
+	}
+
+	// 削除には理由が必要
+	resolve(2, "delete", "")
+	if _, err := repo.GetComment(cid); err != nil {
+		t.Fatal("comment should not be deleted without a reason")
+	}
+	resolve(2, "delete", "harassment")
+	if _, err := repo.GetComment(cid); err != ErrNotFound {
+		t.Error("reported comment should be deleted")
+	}
+
+	resolve(1, "ban", "spammer")
+	if _, err := repo.GetActiveUserByAccountName("author"); err != ErrNotFound {
+		t.Error("author of the reported post should be banned")
+	}
+	if n, err := repo.CountOpenReports(); err != nil || n != 0 {
+		t.Errorf("CountOpenReports() = %d, %v; want 0", n, err)
+	}
+
+	logs, err := repo.ListModerationLogs(ModerationLogFilter{AccountName: "mod"}, moderationLogsPerPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 || logs[0].Action != moderationBan || logs[1].Action != moderationDeleteComment || logs[1].TargetAccountName != "commenter" {
+		t.Errorf("audit logs = %+v", logs)
+	}
+}
+
+func TestLoginRehashesLegacyPasshash(t *testing.T) {
+	ts, client := setupTestServer(t)
+
+	id, err := repo.CreateUser("legacy", calculatePasshash("legacy", "password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := client.PostForm(ts.URL+"/login", url.Values{"account_name": {"legacy"}, "password": {"wrong"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if u, _ := repo.GetUser(id); strings.HasPrefix(u.Passhash, passhashArgon2idPrefix) {
+		t.Fatal("passhash should not be upgraded by a failed login")
+	}
+
+	login(t, ts, client, "legacy")
+	u, err := repo.GetUser(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(u.Passhash, passhashArgon2idPrefix) {
+		t.Fatalf("passhash = %q; want an argon2id hash", u.Passhash)
+	}
+
+	// 置き換えたハッシュでもログインできる
+	login(t, ts, newTestClient(t), "legacy")
+}
+
+func TestLoginLockout(t *testing.T) {
+	ts, client := setupTestServer(t)
+
+	params := accountLoginThrottleParams
+	accountLoginThrottleParams = loginThrottleParams{Window: time.Minute, FreeAttempts: 1, BaseDelay: time.Second, MaxDelay: time.Second, LockoutThreshold: 3, LockoutDuration: time.Minute}
+	t.Cleanup(func() { accountLoginThrottleParams = params })
+	now := time.Now()
+	loginThrottle.now = func() time.Time { return now }
+
+	admin := createTestUser(t, "admin")
+	repo.(*memoryStore).users[admin.ID-1].Authority = int(roleAdmin)
+	createTestUser(t, "victim")
+
+	tryLogin := func(password string) string {
+		t.Helper()
+		res, err := client.PostForm(ts.URL+"/login", url.Values{"account_name": {"victim"}, "password": {password}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusFound || res.Header.Get("Location") != "/login" {
+			t.Fatalf("login: status = %d, location = %q", res.StatusCode, res.Header.Get("Location"))
+		}
+		m := regexp.MustCompile(`(?s)id="notice-message"[^>]*>\s*(.*?)\s*</div>`).FindStringSubmatch(getBody(t, client, ts.URL+"/login"))
+		if m == nil {
+			t.Fatal("notice message not found")
+		}
+		return m[1]
+	}
+
+	if notice := tryLogin("wrong"); notice != loginFailedNotice {
+		t.Errorf("notice = %q", notice)
+	}
+	tryLogin("wrong")
+	// 待ち時間の間は正しいパスワードでもログインできない
+	if notice := tryLogin("password"); !strings.Contains(notice, "試行が多すぎます") {
+		t.Errorf("notice during backoff = %q", notice)
+	}
+	now = now.Add(2 * time.Second)
+	if notice := tryLogin("wrong"); !strings.Contains(notice, "ロックしました") {
+		t.Errorf("notice on lockout = %q", notice)
+	}
+	now = now.Add(2 * time.Second)
+	if notice := tryLogin("password"); !strings.Contains(notice, "ロックしました") {
+		t.Errorf("notice while locked = %q", notice)
+	}
+
+	adminClient := newTestClient(t)
+	csrfToken := login(t, ts, adminClient, "admin")
+	if body := getBody(t, adminClient, ts.URL+"/admin/lockouts"); !strings.Contains(body, `data-account-name="victim"`) {
+		t.Fatal("locked account should be listed")
+	}
+
+	res, err := adminClient.PostForm(ts.URL+"/admin/lockouts/unlock", url.Values{"account_name": {"victim"}, "reason": {"verified"}, "csrf_token": {csrfToken}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusFound || res.Header.Get("Location") != "/admin/lockouts" {
+		t.Fatalf("unlock: status = %d, location = %q", res.StatusCode, res.Header.Get("Location"))
+	}
+	if body := getBody(t, adminClient, ts.URL+"/admin/lockouts"); strings.Contains(body, `data-account-name="victim"`) {
+		t.Error("unlocked account should not be listed")
+	}
+	login(t, ts, client, "victim")
+}
+
+func TestInitializeResetsLoginThrottle(t *testing.T) {
+	ts, client := setupTestServer(t)
+
+	params := accountLoginThrottleParams
+	accountLoginThrottleParams = loginThrottleParams{Window: time.Minute, FreeAttempts: 0, BaseDelay: time.Second, MaxDelay: time.Second, LockoutThreshold: 1, LockoutDuration: time.Minute}
+	t.Cleanup(func() { accountLoginThrottleParams = params })
+
+	createTestUser(t, "victim")
+	res, err := client.PostForm(ts.URL+"/login", url.Values{"account_name": {"victim"}, "password": {"wrong"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if _, blocked, err := loginThrottle.Check("victim", "127.0.0.1"); err != nil || !blocked {
+		t.Fatalf("Check() = %v, %v; want blocked", blocked, err)
+	}
+
+	getBody(t, client, ts.URL+"/initialize")
+	// メモリ上のStoreは/initializeで空になるので、同じアカウント名で作り直す
+	createTestUser(t, "victim")
+	login(t, ts, client, "victim")
+}
+
+func TestLogoutAllDevices(t *testing.T) {
+	for _, backend := range []string{"memory", "cookie"} {
+		t.Run(backend, func(t *testing.T) {
+			ts, client := setupTestServer(t)
+			var err error
+			store, err = newSessionStore(backend, []string{"secret"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			createTestUser(t, "alice")
+			csrfToken := login(t, ts, client, "alice")
+			otherDevice := newTestClient(t)
+			login(t, ts, otherDevice, "alice")
+
+			res, err := client.PostForm(ts.URL+"/logout/all", url.Values{"csrf_token": {csrfToken}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusFound {
+				t.Fatalf("logout all: status = %d", res.StatusCode)
+			}
+
+			for _, c := range []*http.Client{client, otherDevice} {
+				if body := getBody(t, c, ts.URL+"/"); strings.Contains(body, `<span class="isu-account-name">alice</span>`) {
+					t.Error("all sessions should be revoked")
+				}
+			}
+
+			// 無効にした後にログインし直せる
+			login(t, ts, otherDevice, "alice")
+			if body := getBody(t, otherDevice, ts.URL+"/"); !strings.Contains(body, `<span class="isu-account-name">alice</span>`) {
+				t.Error("user should be able to log in again")
+			}
+		})
+	}
+}
+
+func TestSettings(t *testing.T) {
+	ts, client := setupTestServer(t)
+
+	alice := createTestUser(t, "alice")
+	bob := createTestUser(t, "bob")
+	csrfToken := login(t, ts, client, "alice")
+	otherDevice := newTestClient(t)
+	login(t, ts, otherDevice, "alice")
+
+	postSettings := func(path string, v url.Values) *http.Response {
+		t.Helper()
+		v.Set("csrf_token", csrfToken)
+		res, err := client.PostForm(ts.URL+path, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+	loggedInAs := func(c *http.Client, accountName string) bool {
+		t.Helper()
+		return strings.Contains(getBody(t, c, ts.URL+"/"), `<span class="isu-account-name">`+accountName+`</span>`)
+	}
+	refreshCSRFToken := func() {
+		t.Helper()
+		m := regexp.MustCompile(`name="csrf_token" value="([0-9a-f]+)"`).FindStringSubmatch(getBody(t, client, ts.URL+"/settings"))
+		if m == nil {
+			t.Fatal("csrf_token not found")
+		}
+		csrfToken = m[1]
+	}
+
+	res, err := client.PostForm(ts.URL+"/settings/password", url.Values{"current_password": {"password"}, "new_password": {"newpassword"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("without csrf_token: status = %d; want %d", res.StatusCode, http.StatusUnprocessableEntity)
+	}
+
+	postSettings("/settings/password", url.Values{"current_password": {"wrong"}, "new_password": {"newpassword"}})
+	if body := getBody(t, client, ts.URL+"/settings"); !strings.Contains(body, "現在のパスワードが間違っています") {
+		t.Error("wrong current password should be rejected")
+	}
+
+	// パスワードを変更すると、他の端末はログアウトし、変更した端末はログインしたまま
+	res = postSettings("/settings/password", url.Values{"current_password": {"password"}, "new_password": {"newpassword"}})
+	if res.StatusCode != http.StatusFound || res.Header.Get("Location") != "/settings" {
+		t.Fatalf("change password: status = %d, location = %q", res.StatusCode, res.Header.Get("Location"))
+	}
+	if !loggedInAs(client, "alice") {
+		t.Error("the current session should stay logged in")
+	}
+	if loggedInAs(otherDevice, "alice") {
+		t.Error("other sessions should be revoked")
+	}
+	if u, err := repo.GetUser(alice.ID); err != nil {
+		t.Fatal(err)
+	} else if ok, _ := verifyPassword(u, "newpassword"); !ok {
+		t.Error("password should be changed")
+	}
+	refreshCSRFToken()
+
+	postSettings("/settings/account_name", url.Values{"current_password": {"newpassword"}, "account_name": {"bob"}})
+	if body := getBody(t, client, ts.URL+"/settings"); !strings.Contains(body, "アカウント名がすでに使われています") {
+		t.Error("an account name in use should be rejected")
+	}
+	// 確認の後に他のユーザーが同じアカウント名にした場合も、パスワードのハッシュは変更しない
+	before, err := repo.GetUser(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.UpdateAccountName(alice.ID, "bob", "changed"); err != ErrAccountNameTaken {
+		t.Errorf("UpdateAccountName error = %v; want ErrAccountNameTaken", err)
+	}
+	if after, _ := repo.GetUser(alice.ID); after.AccountName != before.AccountName || after.Passhash != before.Passhash {
+		t.Error("a failed rename should not change the account")
+	}
+	postSettings("/settings/account_name", url.Values{"current_password": {"newpassword"}, "account_name": {"alicia"}})
+	if !loggedInAs(client, "alicia") {
+		t.Error("account name should be changed")
+	}
+	refreshCSRFToken()
+
+	pid, err := createPost(alice, "image/png", encodeTestImage(t, "png"), "alice's post")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobPost, err := createPost(bob, "image/png", encodeTestImage(t, "png"), "bob's post")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateComment(bobPost, alice.ID, "alice's comment"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 退会すると、投稿とコメントを削除してログアウトする
+	res = postSettings("/settings/delete", url.Values{"current_password": {"newpassword"}})
+	if res.StatusCode != http.StatusFound || res.Header.Get("Location") != "/" {
+		t.Fatalf("delete account: status = %d, location = %q", res.StatusCode, res.Header.Get("Location"))
+	}
+	if u, err := repo.GetUser(alice.ID); err != nil {
+		t.Fatal(err)
+	} else if u.DelFlg != userDeleted {
+		t.Errorf("del_flg = %d; want %d", u.DelFlg, userDeleted)
+	}
+	if _, err := repo.GetPost(pid); err != ErrNotFound {
+		t.Errorf("post should be deleted: err = %v", err)
+	}
+	if comments, err := repo.ListCommentsByUser(alice.ID); err != nil {
+		t.Fatal(err)
+	} else if len(comments) != 0 {
+		t.Errorf("comments should be deleted: %d left", len(comments))
+	}
+	if _, err := repo.GetPost(bobPost); err != nil {
+		t.Errorf("other user's post should remain: err = %v", err)
+	}
+	if loggedInAs(client, "alicia") {
+		t.Error("session should be revoked after deleting the account")
+	}
+
+	res, err = client.PostForm(ts.URL+"/login", url.Values{"account_name": {"alicia"}, "password": {"newpassword"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.Header.Get("Location") != "/login" {
+		t.Error("deleted user should not be able to log in")
+	}
+}
+
+func TestProfile(t *testing.T) {
+	ts, client := setupTestServer(t)
+
+	alice := createTestUser(t, "alice")
+	csrfToken := login(t, ts, client, "alice")
+
+	postProfile := func(displayName, bio string, avatar []byte) {
+		t.Helper()
+		buf := &bytes.Buffer{}
+		mw := multipart.NewWriter(buf)
+		if avatar != nil {
+			part, err := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Disposition": {`form-data; name="avatar"; filename="avatar"`},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			part.Write(avatar)
+		}
+		mw.WriteField("display_name", displayName)
+		mw.WriteField("bio", bio)
+		mw.WriteField("csrf_token", csrfToken)
+		mw.Close()
+
+		res, err := client.Post(ts.URL+"/settings/profile", mw.FormDataContentType(), buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusFound || res.Header.Get("Location") != "/settings" {
+			t.Fatalf("update profile: status = %d, location = %q", res.StatusCode, res.Header.Get("Location"))
+		}
+	}
+
+	// キャッシュしたユーザーを読み込んだ後に変更しても、新しいプロフィールが表示される
+	getBody(t, client, ts.URL+"/")
+	postProfile("  Alice\nLiddell ", "hello #wonderland", encodeTestImage(t, "png"))
+
+	u, err := repo.GetUser(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.DisplayName != "Alice Liddell" || u.Bio != "hello #wonderland" || u.AvatarKey == "" {
+		t.Fatalf("profile = %q, %q, %q", u.DisplayName, u.Bio, u.AvatarKey)
+	}
+
+	body := getBody(t, client, ts.URL+"/@alice")
+	for _, want := range []string{
+		`<div class="isu-user-display-name">Alice Liddell</div>`,
+		`<a href="/tags/wonderland" class="isu-hashtag">#wonderland</a>`,
+		avatarURL(u),
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("user page should contain %q", want)
+		}
+	}
+
+	item, err := memcacheClient.Get("user_" + strconv.Itoa(alice.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(item.Value), "Alice Liddell") {
+		t.Error("cached user should contain the profile")
+	}
+
+	res, err := client.Get(ts.URL + avatarURL(u))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("avatar: status = %d, content-type = %q", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+
+	pid, err := createPost(u, "image/png", encodeTestImage(t, "png"), "post")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := getBody(t, client, ts.URL+"/posts/"+strconv.Itoa(pid)); !strings.Contains(body, `<span class="isu-post-display-name">Alice Liddell</span>`) {
+		t.Error("display name should be shown next to the account name")
+	}
+
+	// アバター画像を変更すると、古い画像は削除する
+	postProfile("Alice", "", encodeTestImage(t, "jpg"))
+	updated, err := repo.GetUser(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.AvatarKey == u.AvatarKey || !strings.HasSuffix(updated.AvatarKey, ".jpg") {
+		t.Errorf("avatar key = %q", updated.AvatarKey)
+	}
+	if _, err := imageStore.Get(u.AvatarKey); err != ErrImageNotFound {
+		t.Errorf("old avatar should be deleted: err = %v", err)
+	}
+
+	postProfile(strings.Repeat("a", maxDisplayNameLength+1), "", nil)
+	if body := getBody(t, client, ts.URL+"/settings"); !strings.Contains(body, profileNotices[errProfileDisplayNameTooLong]) {
+		t.Error("a too long display name should be rejected")
+	}
+	if u, err := repo.GetUser(alice.ID); err != nil {
+		t.Fatal(err)
+	} else if u.DisplayName != "Alice" || u.AvatarKey != updated.AvatarKey {
+		t.Errorf("profile should not be changed: %q, %q", u.DisplayName, u.AvatarKey)
+	}
+
+	// /initializeでアバターが外れると、画像も削除する
+	getBody(t, client, ts.URL+"/initialize")
+	if _, err := imageStore.Get(updated.AvatarKey); err != ErrImageNotFound {
+		t.Errorf("avatar should be deleted on initialize: err = %v", err)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// Cacheは、webappが使うmemcacheクライアントの操作をまとめたインターフェースです。
+// *memcache.Clientがそのまま満たすほか、memcachedなしで動かすためのmemoryCacheがあります。
+type Cache interface {
+	Get(key string) (*memcache.Item, error)
+	GetMulti(keys []string) (map[string]*memcache.Item, error)
+	Set(item *memcache.Item) error
+	// Add は、keyがない場合だけitemを保存します。すでにある場合はmemcache.ErrNotStoredを返します。
+	Add(item *memcache.Item) error
+	// Increment は、10進数の数値として保存された値にdeltaを加えます。keyがない場合はmemcache.ErrCacheMissを返します。
+	Increment(key string, delta uint64) (uint64, error)
+	Delete(key string) error
+}
+
+var _ Cache = (*memcache.Client)(nil)
+
+// memcachedが相対秒数ではなくUNIX時刻として扱うExpirationの境界値(30日)
+const memcacheRelativeExpirationLimit = 60 * 60 * 24 * 30
+
+type memoryCacheEntry struct {
+	value     []byte
+	flags     uint32
+	expiresAt time.Time
+}
+
+// memoryCacheは、プロセス内のmapを使うCacheの実装です。
+// Expirationはmemcachedと同じく秒数またはUNIX時刻として解釈します。
+type memoryCache struct {
+	mu    sync.Mutex
+	items map[string]memoryCacheEntry
+}
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{items: make(map[string]memoryCacheEntry)}
+}
+
+// lookup は、期限切れのエントリを削除しつつkeyに対応するアイテムを返します。呼び出し元でロックを取得してください。
+func (c *memoryCache) lookup(key string) (*memcache.Item, bool) {
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	if !e.expiresAt.IsZero() && !time.Now().Before(e.expiresAt) {
+		delete(c.items, key)
+		return nil, false
+	}
+	value := make([]byte, len(e.value))
+	copy(value, e.value)
+	return &memcache.Item{Key: key, Value: value, Flags: e.flags}, true
+}
+
+func (c *memoryCache) Get(key string) (*memcache.Item, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	item, ok := c.lookup(key)
+	if !ok {
+		return nil, memcache.ErrCacheMiss
+	}
+	return item, nil
+}
+
+func (c *memoryCache) GetMulti(keys []string) (map[string]*memcache.Item, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	items := make(map[string]*memcache.Item, len(keys))
+	for _, key := range keys {
+		if item, ok := c.lookup(key); ok {
+			items[key] = item
+		}
+	}
+	return items, nil
+}
+
+func (c *memoryCache) Set(item *memcache.Item) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.set(item)
+	return nil
+}
+
+// set は、itemを保存します。呼び出し元でロックを取得してください。
+func (c *memoryCache) set(item *memcache.Item) {
+	e := memoryCacheEntry{flags: item.Flags}
+	e.value = make([]byte, len(item.Value))
+	copy(e.value, item.Value)
+	switch {
+	case item.Expiration <= 0:
+	case item.Expiration > memcacheRelativeExpirationLimit:
+		e.expiresAt = time.Unix(int64(item.Expiration), 0)
+	default:
+		e.expiresAt = time.Now().Add(time.Duration(item.Expiration) * time.Second)
+	}
+	c.items[item.Key] = e
+}
+
+func (c *memoryCache) Add(item *memcache.Item) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.lookup(item.Key); ok {
+		return memcache.ErrNotStored
+	}
+	c.set(item)
+	return nil
+}
+
+// Increment は、memcachedと同じく有効期限を変えずに値を更新します。
+func (c *memoryCache) Increment(key string, delta uint64) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.lookup(key); !ok {
+		return 0, memcache.ErrCacheMiss
+	}
+	e := c.items[key]
+	v, err := strconv.ParseUint(string(e.value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot increment non-numeric value: %w", err)
+	}
+	v += delta
+	e.value = []byte(strconv.FormatUint(v, 10))
+	c.items[key] = e
+	return v, nil
+}
+
+func (c *memoryCache) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.lookup(key); !ok {
+		return memcache.ErrCacheMiss
+	}
+	delete(c.items, key)
+	return nil
+}
+
+// fallbackCacheは、primaryにつながらない場合にfallbackを使うCacheです。
+// memcachedが落ちていても、ログインの試行回数の制限などをプロセス内で続けるために使います。
+// ErrCacheMissなどのmemcachedの応答としてのエラーは、そのまま返します。
+type fallbackCache struct {
+	primary  Cache
+	fallback Cache
+}
+
+func newFallbackCache(primary, fallback Cache) *fallbackCache {
+	return &fallbackCache{primary: primary, fallback: fallback}
+}
+
+// unavailable は、errがmemcachedにつながらなかったことによるエラーかを返します。
+func (c *fallbackCache) unavailable(err error) bool {
+	if err == nil || errors.Is(err, memcache.ErrCacheMiss) || errors.Is(err, memcache.ErrNotStored) || errors.Is(err, memcache.ErrCASConflict) {
+		return false
+	}
+	log.Printf("cache is unavailable, falling back: %s", err)
+	return true
+}
+
+func (c *fallbackCache) Get(key string) (*memcache.Item, error) {
+	item, err := c.primary.Get(key)
+	if c.unavailable(err) {
+		return c.fallback.Get(key)
+	}
+	return item, err
+}
+
+func (c *fallbackCache) GetMulti(keys []string) (map[string]*memcache.Item, error) {
+	items, err := c.primary.GetMulti(keys)
+	if c.unavailable(err) {
+		return c.fallback.GetMulti(keys)
+	}
+	return items, err
+}
+
+func (c *fallbackCache) Set(item *memcache.Item) error {
+	err := c.primary.Set(item)
+	if c.unavailable(err) {
+		return c.fallback.Set(item)
+	}
+	return err
+}
+
+func (c *fallbackCache) Add(item *memcache.Item) error {
+	err := c.primary.Add(item)
+	if c.unavailable(err) {
+		return c.fallback.Add(item)
+	}
+	return err
+}
+
+func (c *fallbackCache) Increment(key string, delta uint64) (uint64, error) {
+	v, err := c.primary.Increment(key, delta)
+	if c.unavailable(err) {
+		return c.fallback.Increment(key, delta)
+	}
+	return v, err
+}
+
+func (c *fallbackCache) Delete(key string) error {
+	err := c.primary.Delete(key)
+	if c.unavailable(err) {
+		return c.fallback.Delete(key)
+	}
+	return err
+}
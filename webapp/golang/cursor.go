@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// PostCursorは、投稿一覧のページング位置を表します。
+// 投稿は(created_at, id)の降順に並ぶので、同じ秒に作成された投稿が複数あっても
+// 重複や取りこぼしなく次のページを取得できます。
+// ゼロ値は先頭(最新の投稿)を表します。
+type PostCursor struct {
+	CreatedAt time.Time
+	ID        int
+}
+
+// IsZero は、カーソルが先頭を表すかどうかを返します。
+func (c PostCursor) IsZero() bool {
+	return c.CreatedAt.IsZero() && c.ID == 0
+}
+
+// Before は、投稿がカーソルより後ろ(古い側)に並ぶかどうかを返します。
+func (c PostCursor) Before(p Post) bool {
+	if c.IsZero() {
+		return true
+	}
+	if p.CreatedAt.Equal(c.CreatedAt) {
+		return p.ID < c.ID
+	}
+	return p.CreatedAt.Before(c.CreatedAt)
+}
+
+// cursorAfter は、投稿の次から始まるカーソルを返します。
+func cursorAfter(p Post) PostCursor {
+	return PostCursor{CreatedAt: p.CreatedAt, ID: p.ID}
+}
+
+// cursorFromMaxCreatedAt は、従来のmax_created_atと同じく、
+// maxCreatedAt以前に作成されたすべての投稿を含むカーソルを返します。
+func cursorFromMaxCreatedAt(maxCreatedAt time.Time) PostCursor {
+	return PostCursor{CreatedAt: maxCreatedAt, ID: math.MaxInt32}
+}
+
+// String は、クライアントに渡す不透明なカーソル文字列を返します。
+func (c PostCursor) String() string {
+	if c.IsZero() {
+		return ""
+	}
+	raw := strconv.FormatInt(c.CreatedAt.Unix(), 10) + "_" + strconv.Itoa(c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// parsePostCursor は、PostCursor.Stringで生成したカーソル文字列を読み込みます。
+func parsePostCursor(s string) (PostCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return PostCursor{}, errInvalidCursor
+	}
+	unix, id, ok := strings.Cut(string(raw), "_")
+	if !ok {
+		return PostCursor{}, errInvalidCursor
+	}
+	sec, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil || sec <= 0 {
+		return PostCursor{}, errInvalidCursor
+	}
+	pid, err := strconv.Atoi(id)
+	if err != nil || pid <= 0 {
+		return PostCursor{}, errInvalidCursor
+	}
+	return PostCursor{CreatedAt: time.Unix(sec, 0), ID: pid}, nil
+}
+
+// postCursorFromQuery は、cursorまたは従来のmax_created_atのクエリからカーソルを決定します。
+// どちらも指定されていない場合はokがfalseになります。
+func postCursorFromQuery(cursor, maxCreatedAt string) (c PostCursor, ok bool, err error) {
+	if cursor != "" {
+		c, err = parsePostCursor(cursor)
+		return c, err == nil, err
+	}
+	if maxCreatedAt != "" {
+		t, err := time.Parse(ISO8601Format, maxCreatedAt)
+		if err != nil {
+			return PostCursor{}, false, err
+		}
+		return cursorFromMaxCreatedAt(t), true, nil
+	}
+	return PostCursor{}, false, nil
+}
+
+// nextCursor は、postsの最後の投稿の次から始まるカーソル文字列を返します。
+// postsが1ページ分に満たない場合は続きがないので空文字列を返します。
+func nextCursor(posts []Post) string {
+	if len(posts) < postsPerPage {
+		return ""
+	}
+	return cursorAfter(posts[len(posts)-1]).String()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPostCursorRoundTrip(t *testing.T) {
+	c := PostCursor{CreatedAt: time.Unix(1700000000, 0), ID: 42}
+
+	got, err := parsePostCursor(c.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.CreatedAt.Equal(c.CreatedAt) || got.ID != c.ID {
+		t.Errorf("parsePostCursor(%q) = %+v; want %+v", c.String(), got, c)
+	}
+}
+
+func TestParsePostCursorInvalid(t *testing.T) {
+	for _, s := range []string{"", "!!!", "MTcwMDAwMDAwMA", "MTcwMDAwMDAwMF94"} {
+		if _, err := parsePostCursor(s); err == nil {
+			t.Errorf("parsePostCursor(%q) succeeded; want error", s)
+		}
+	}
+}
+
+func TestListPostsCursorWithDuplicateTimestamps(t *testing.T) {
+	s := newMemoryStore()
+	uid, _ := s.CreateUser("mary", "")
+	createdAt := time.Unix(1700000000, 0)
+	for i := 0; i < postsPerPage+5; i++ {
+		pid, _ := s.CreatePost(uid, "image/png", "")
+		s.posts[pid-1].CreatedAt = createdAt
+	}
+
+	seen := map[int]bool{}
+	cursor := PostCursor{}
+	for page := 0; page < 3; page++ {
+		posts, err := s.ListPosts(cursor, postsPerPage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range posts {
+			if seen[p.ID] {
+				t.Fatalf("post %d appears twice", p.ID)
+			}
+			seen[p.ID] = true
+		}
+		if len(posts) == 0 {
+			break
+		}
+		cursor = cursorAfter(posts[len(posts)-1])
+	}
+	if len(seen) != postsPerPage+5 {
+		t.Errorf("got %d posts; want %d", len(seen), postsPerPage+5)
+	}
+
+	// 従来のmax_created_atは同じ作成日時の投稿をすべて含む
+	posts, err := s.ListPosts(cursorFromMaxCreatedAt(createdAt), postsPerPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != postsPerPage {
+		t.Errorf("max_created_at: got %d posts; want %d", len(posts), postsPerPage)
+	}
+}
+
+func TestGetPostsWithCursor(t *testing.T) {
+	ts, client := setupTestServer(t)
+
+	u := createTestUser(t, "mary")
+	for i := 0; i < postsPerPage+1; i++ {
+		if _, err := repo.CreatePost(u.ID, "image/png", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	last, err := repo.GetPost(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := getBody(t, client, ts.URL+"/")
+	if !strings.Contains(body, `data-cursor="`+cursorAfter(last).String()+`"`) {
+		t.Fatal("index does not emit the cursor of the last post")
+	}
+
+	body = getBody(t, client, ts.URL+"/posts?cursor="+cursorAfter(last).String())
+	if got := strings.Count(body, `class="isu-post"`); got != 1 {
+		t.Errorf("got %d posts on the next page; want 1", got)
+	}
+	if !strings.Contains(body, `id="pid_1"`) {
+		t.Error("next page does not contain the oldest post")
+	}
+}
@@ -0,0 +1,9 @@
+#!/bin/sh
+# サーバーはスキーマの移行(app migrate schema)が済んでいないと起動しないので、先に移行する。
+# MySQLのコンテナは初期データの読み込みが終わるまで接続できないため、移行できるまで繰り返す。
+until /bin/server migrate schema; do
+  echo "Waiting for MySQL to apply schema migrations..." >&2
+  sleep 5
+done
+
+exec /bin/server "$@"
@@ -1,18 +1,22 @@
 module github.com/catatsuy/private-isu/webapp/golang
 
-go 1.23
+go 1.23.0
 
 require (
+	github.com/HugoSmits86/nativewebp v1.2.1
 	github.com/bradfitz/gomemcache v0.0.0-20230905024940-24af94b03874
 	github.com/bradleypeabody/gorilla-sessions-memcache v0.0.0-20240916143655-c0e34fd2f304
 	github.com/go-chi/chi/v5 v5.1.0
 	github.com/go-sql-driver/mysql v1.8.1
 	github.com/gorilla/sessions v1.4.0
 	github.com/jmoiron/sqlx v1.4.0
+	golang.org/x/crypto v0.36.0
+	golang.org/x/image v0.25.0
 )
 
 require (
 	filippo.io/edwards25519 v1.1.0 // indirect
 	github.com/gorilla/securecookie v1.1.2 // indirect
 	github.com/memcachier/mc/v3 v3.0.3 // indirect
+	golang.org/x/sys v0.31.0 // indirect
 )
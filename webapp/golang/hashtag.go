@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// タグの最大文字数。post_tags.tagの長さと合わせる
+const maxHashtagLength = 64
+
+// hashtagPatternは、本文中の#タグに一致します。
+// 英数字などの直後の#(URLのフラグメントなど)はタグとみなしません。
+var hashtagPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_&/])#([\p{L}\p{N}_]+)`)
+
+// normalizeHashtag は、大文字と小文字を区別せずに検索できるよう、タグを小文字にします。
+// 空またはmaxHashtagLengthより長いタグの場合は空文字列を返します。
+func normalizeHashtag(tag string) string {
+	tag = strings.ToLower(tag)
+	if tag == "" || len([]rune(tag)) > maxHashtagLength {
+		return ""
+	}
+	return tag
+}
+
+// extractHashtags は、本文に含まれるタグを出現順に重複なく返します。
+func extractHashtags(body string) []string {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, m := range hashtagPattern.FindAllStringSubmatch(body, -1) {
+		tag := normalizeHashtag(m[1])
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// hashtagURL は、タグのページのURLを返します。
+func hashtagURL(tag string) string {
+	return "/tags/" + url.PathEscape(normalizeHashtag(tag))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestExtractHashtags(t *testing.T) {
+	testCases := []struct {
+		body string
+		want []string
+	}{
+		{"no tags", []string{}},
+		{"#Go と #isucon の #go", []string{"go", "isucon"}},
+		{"#日本語タグ、#snake_case.", []string{"日本語タグ", "snake_case"}},
+		{"http://example.com/#fragment a#b", []string{}},
+		{"#" + strings.Repeat("a", maxHashtagLength+1) + " #ok", []string{"ok"}},
+	}
+
+	for _, tc := range testCases {
+		if got := extractHashtags(tc.body); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("extractHashtags(%q) = %q; want %q", tc.body, got, tc.want)
+		}
+	}
+}
+
+func TestTagPages(t *testing.T) {
+	ts, client := setupTestServer(t)
+
+	alice := createTestUser(t, "alice")
+	banned := createTestUser(t, "banned")
+	for i := 0; i < postsPerPage+1; i++ {
+		if _, err := createPost(alice, "image/png", encodeTestImage(t, "png"), "tagged #Isucon post"+strconv.Itoa(i)+"."); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := createPost(alice, "image/png", encodeTestImage(t, "png"), "untagged post"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createPost(banned, "image/png", encodeTestImage(t, "png"), "banned #isucon post"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.BanUser(banned.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	body := getBody(t, client, ts.URL+"/tags/ISUCON")
+	if !strings.Contains(body, `<a href="/tags/isucon" class="isu-hashtag">#Isucon</a>`) {
+		t.Error("hashtags should be linkified")
+	}
+	if strings.Contains(body, "untagged post") || strings.Contains(body, "banned #isucon post") {
+		t.Error("tag page should contain only tagged posts of active users")
+	}
+	if !strings.Contains(body, `data-tag="isucon"`) {
+		t.Error("tag page should load more posts of the same tag")
+	}
+
+	res := struct {
+		Tag        string    `json:"tag"`
+		Posts      []apiPost `json:"posts"`
+		NextCursor string    `json:"next_cursor"`
+	}{}
+	if status := doJSON(t, client, http.MethodGet, ts.URL+"/api/v1/tags/isucon", "", nil, &res); status != http.StatusOK {
+		t.Fatalf("status = %d; want %d", status, http.StatusOK)
+	}
+	if res.Tag != "isucon" || len(res.Posts) != postsPerPage || res.NextCursor == "" {
+		t.Fatalf("first page: tag = %q, %d posts, next_cursor = %q", res.Tag, len(res.Posts), res.NextCursor)
+	}
+	next := res.NextCursor
+	if status := doJSON(t, client, http.MethodGet, ts.URL+"/api/v1/tags/isucon?cursor="+url.QueryEscape(next), "", nil, &res); status != http.StatusOK {
+		t.Fatalf("status = %d; want %d", status, http.StatusOK)
+	}
+	if len(res.Posts) != 1 || res.Posts[0].Body != "tagged #Isucon post0." || res.NextCursor != "" {
+		t.Errorf("second page: %d posts, next_cursor = %q", len(res.Posts), res.NextCursor)
+	}
+
+	// HTMLの「もっと見る」も同じカーソルで続きを読み込む
+	if body := getBody(t, client, ts.URL+"/posts?tag=isucon&cursor="+url.QueryEscape(next)); !strings.Contains(body, "post0.") || strings.Contains(body, "post1.") {
+		t.Error("getPosts should page through tagged posts")
+	}
+}
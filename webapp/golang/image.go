@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/HugoSmits86/nativewebp"
+	_ "golang.org/x/image/webp"
+)
+
+// 展開後のメモリ使用量を抑えるため、デコードする画像の画素数に上限を設ける
+const maxImagePixels = 50 * 1000 * 1000
+
+// サムネイルなどを生成するときのJPEGの品質
+const imageJPEGQuality = 85
+
+// imageCacheControlは、画像のレスポンスに付けるCache-Controlです。
+// 投稿画像は後から変更されないので、1年間キャッシュしてよいものとして扱います。
+const imageCacheControl = "public, max-age=31536000, immutable"
+
+// imageFormatは、投稿できる画像の形式です。
+// mimeと拡張子の対応はimageFormatsだけで管理します。
+type imageFormat struct {
+	Mime string
+	Ext  string
+	// Name は、image.Decodeが返す形式名です。
+	Name string
+	// Fallback は、この形式を表示できないクライアントに代わりに返す形式のmimeです。
+	Fallback string
+	// Alternate は、クライアントがAcceptヘッダーで明示的に受け入れる場合に代わりに返す、より小さい形式のmimeです。
+	Alternate string
+}
+
+// imageFormatsは、投稿できる画像の形式の一覧です。
+// AVIFはデコーダーがないため、アップロードされた画像を検査できず受け付けていません。
+// WebPのエンコーダーは可逆圧縮だけなので、JPEGの代わりにWebPを返すことはしません。
+var imageFormats = []imageFormat{
+	{Mime: "image/jpeg", Ext: "jpg", Name: "jpeg"},
+	{Mime: "image/png", Ext: "png", Name: "png", Alternate: "image/webp"},
+	{Mime: "image/gif", Ext: "gif", Name: "gif"},
+	{Mime: "image/webp", Ext: "webp", Name: "webp", Fallback: "image/png"},
+}
+
+func imageFormatByMime(mime string) (imageFormat, bool) {
+	for _, f := range imageFormats {
+		if f.Mime == mime {
+			return f, true
+		}
+	}
+	return imageFormat{}, false
+}
+
+// imageExt は、画像のmimeに対応する拡張子を返します。
+func imageExt(mime string) string {
+	f, _ := imageFormatByMime(mime)
+	return f.Ext
+}
+
+// mimeFromExt は、画像の拡張子に対応するmimeを返します。
+func mimeFromExt(ext string) string {
+	for _, f := range imageFormats {
+		if f.Ext == ext {
+			return f.Mime
+		}
+	}
+	return ""
+}
+
+// mimeFromFormatName は、image.Decodeが返す形式名に対応するmimeを返します。
+func mimeFromFormatName(name string) string {
+	for _, f := range imageFormats {
+		if f.Name == name {
+			return f.Mime
+		}
+	}
+	return ""
+}
+
+// mimeFromContentType は、クライアントが申告したContent-Typeが示す画像のmimeを返します。
+// 画像の形式を示していない場合は空文字列を返します。
+func mimeFromContentType(contentType string) string {
+	for _, f := range imageFormats {
+		if strings.Contains(contentType, f.Name) {
+			return f.Mime
+		}
+	}
+	return ""
+}
+
+var (
+	errUnsupportedImage  = errors.New("unsupported image format")
+	errImageTypeMismatch = errors.New("image content does not match the declared content type")
+	errCorruptedImage    = errors.New("corrupted image")
+)
+
+// imageUploadNotices は、画像の検査エラーごとにユーザーに表示するメッセージです。
+var imageUploadNotices = map[error]string{
+	errUnsupportedImage:  "投稿できる画像形式はjpgとpngとgifとwebpだけです",
+	errImageTypeMismatch: "画像の形式がファイルの種類と一致しません",
+	errCorruptedImage:    "画像が壊れています",
+}
+
+// sniffImageMime は、データ先頭のマジックバイトから画像のmimeを判定します。
+// 投稿できない形式の場合は空文字列を返します。
+func sniffImageMime(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return "image/jpeg"
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "image/png"
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return "image/gif"
+	case len(data) >= 12 && bytes.HasPrefix(data, []byte("RIFF")) && string(data[8:12]) == "WEBP":
+		return "image/webp"
+	}
+	return ""
+}
+
+// inspectImage は、アップロードされた画像の形式を内容から判定し、実際にデコードできることを確認してmimeを返します。
+// クライアントが申告したContent-Typeが画像の形式を示していて内容と一致しない場合はerrImageTypeMismatchを返します。
+// Content-Typeは空でも構いません。
+func inspectImage(data []byte, declaredContentType string) (string, error) {
+	mime := sniffImageMime(data)
+	if mime == "" {
+		return "", errUnsupportedImage
+	}
+
+	if declared := mimeFromContentType(declaredContentType); declared != "" && declared != mime {
+		return "", errImageTypeMismatch
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || mimeFromFormatName(format) != mime {
+		return "", errCorruptedImage
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxImagePixels {
+		return "", errCorruptedImage
+	}
+
+	_, _, err = image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", errCorruptedImage
+	}
+
+	return mime, nil
+}
+
+// encodeImage は、画像をmimeの形式でエンコードします。
+func encodeImage(img image.Image, mime string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	var err error
+	switch mime {
+	case "image/jpeg":
+		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: imageJPEGQuality})
+	case "image/png":
+		err = png.Encode(buf, img)
+	case "image/gif":
+		err = gif.Encode(buf, img, nil)
+	case "image/webp":
+		err = nativewebp.Encode(buf, img, nil)
+	default:
+		err = errUnsupportedImage
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// convertImage は、画像をデコードしてmimeの形式でエンコードし直します。
+func convertImage(data []byte, mime string) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return encodeImage(img, mime)
+}
+
+// negotiateImageMime は、Acceptヘッダーに応じて、mimeの投稿画像の代わりに返す形式を決めます。
+// 元の形式のまま返す場合はmimeをそのまま返します。
+func negotiateImageMime(mime, accept string) string {
+	f, ok := imageFormatByMime(mime)
+	if !ok {
+		return mime
+	}
+	if f.Fallback != "" && !acceptsMime(accept, f.Mime, false) {
+		return f.Fallback
+	}
+	if f.Alternate != "" && acceptsMime(accept, f.Alternate, true) {
+		return f.Alternate
+	}
+	return mime
+}
+
+// acceptsMime は、Acceptヘッダーがmimeを受け入れるかを返します。
+// explicitがtrueの場合、image/*や*/*ではなくmimeそのものが書かれている場合だけ受け入れるとみなします。
+// Acceptヘッダーがない場合は、すべての形式を受け入れるとみなします。
+func acceptsMime(accept, mimeType string, explicit bool) bool {
+	if accept == "" {
+		return !explicit
+	}
+
+	// 最も具体的に一致したメディアレンジの品質値で判定する
+	typ, _, _ := strings.Cut(mimeType, "/")
+	bestSpecificity, bestQ := -1, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaRange, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		specificity := -1
+		switch {
+		case mediaRange == mimeType:
+			specificity = 2
+		case mediaRange == typ+"/*" && !explicit:
+			specificity = 1
+		case mediaRange == "*/*" && !explicit:
+			specificity = 0
+		}
+		if specificity <= bestSpecificity {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+		}
+		bestSpecificity, bestQ = specificity, q
+	}
+	return bestQ > 0
+}
+
+// imageETag は、画像の内容のSHA-256から強いETagを作ります。
+func imageETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
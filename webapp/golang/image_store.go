@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrImageNotFound は、ImageStoreに画像が存在しないことを表します。
+var ErrImageNotFound = errors.New("image store: not found")
+
+// ImageStoreは、投稿画像の保存先を抽象化したインターフェースです。
+// Putが返すキーをposts.image_keyに保存し、GetとDeleteではそのキーで画像を扱います。
+type ImageStore interface {
+	// Put は、名前と拡張子(jpg, png, gif)に対応する画像を保存し、取得に使うキーを返します。
+	// 投稿画像の名前は投稿IDで、アバター画像はavatarImageNameの名前です。
+	Put(name string, ext string, data []byte) (string, error)
+	// Get は、キーに対応する画像を返します。存在しない場合はErrImageNotFoundを返します。
+	Get(key string) ([]byte, error)
+	// Delete は、キーに対応する画像を削除します。存在しない場合もエラーにしません。
+	Delete(key string) error
+}
+
+// newImageStoreFromEnv は、環境変数ISUCONP_IMAGE_STOREの設定に応じたImageStoreを返します。
+//
+//   - local(デフォルト): ISUCONP_IMAGE_DIRに{id}.{ext}で保存し、nginxからそのまま配信できる
+//   - cas: ISUCONP_IMAGE_DIRに内容のSHA-256をファイル名として保存し、同じ画像を重複して保存しない
+//   - s3: ISUCONP_S3_*で指定したS3互換ストレージに保存する
+func newImageStoreFromEnv() (ImageStore, error) {
+	dir := os.Getenv("ISUCONP_IMAGE_DIR")
+	if dir == "" {
+		dir = "../public/image"
+	}
+
+	switch backend := os.Getenv("ISUCONP_IMAGE_STORE"); backend {
+	case "", "local":
+		return newLocalImageStore(dir), nil
+	case "cas":
+		return newContentAddressedImageStore(dir), nil
+	case "s3":
+		s := &s3ImageStore{
+			Endpoint:        os.Getenv("ISUCONP_S3_ENDPOINT"),
+			Bucket:          os.Getenv("ISUCONP_S3_BUCKET"),
+			Region:          os.Getenv("ISUCONP_S3_REGION"),
+			AccessKeyID:     os.Getenv("ISUCONP_S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("ISUCONP_S3_SECRET_ACCESS_KEY"),
+			Client:          http.DefaultClient,
+		}
+		if s.Endpoint == "" || s.Bucket == "" {
+			return nil, errors.New("ISUCONP_S3_ENDPOINT and ISUCONP_S3_BUCKET are required")
+		}
+		if s.Region == "" {
+			s.Region = "us-east-1"
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unknown image store backend ISUCONP_IMAGE_STORE=%q", backend)
+	}
+}
+
+// writeFileAtomic は、書き込み途中のファイルが配信されないよう一時ファイル経由でファイルを書き込みます。
+func writeFileAtomic(path string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(f.Name(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func readImageFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrImageNotFound
+	}
+	return data, err
+}
+
+func removeImageFile(path string) error {
+	err := os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// validImageKey は、キーがディレクトリの外を指していないかを確認します。
+func validImageKey(key string) bool {
+	return key != "" && filepath.IsLocal(key)
+}
+
+// localImageStoreは、{name}.{ext}というファイル名でディレクトリに画像を保存します。
+// ディレクトリを../public/imageにすると、nginxのtry_filesで直接配信されます。
+type localImageStore struct {
+	dir string
+}
+
+func newLocalImageStore(dir string) *localImageStore {
+	return &localImageStore{dir: dir}
+}
+
+func (s *localImageStore) Put(name string, ext string, data []byte) (string, error) {
+	key := name + "." + ext
+	err := writeFileAtomic(filepath.Join(s.dir, key), data)
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+func (s *localImageStore) Get(key string) ([]byte, error) {
+	if !validImageKey(key) {
+		return nil, ErrImageNotFound
+	}
+	return readImageFile(filepath.Join(s.dir, key))
+}
+
+func (s *localImageStore) Delete(key string) error {
+	if !validImageKey(key) {
+		return nil
+	}
+	return removeImageFile(filepath.Join(s.dir, key))
+}
+
+// contentAddressedImageStoreは、画像の内容のSHA-256をファイル名として保存します。
+// 同じ内容の画像は1つのファイルを共有します。
+type contentAddressedImageStore struct {
+	dir string
+}
+
+func newContentAddressedImageStore(dir string) *contentAddressedImageStore {
+	return &contentAddressedImageStore{dir: dir}
+}
+
+func (s *contentAddressedImageStore) Put(name string, ext string, data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	// 1つのディレクトリにファイルが集中しないよう先頭2文字でディレクトリを分ける
+	key := digest[:2] + "/" + digest + "." + ext
+
+	path := filepath.Join(s.dir, filepath.FromSlash(key))
+	if _, err := os.Stat(path); err == nil {
+		return key, nil
+	}
+	err := writeFileAtomic(path, data)
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+func (s *contentAddressedImageStore) Get(key string) ([]byte, error) {
+	if !validImageKey(filepath.FromSlash(key)) {
+		return nil, ErrImageNotFound
+	}
+	return readImageFile(filepath.Join(s.dir, filepath.FromSlash(key)))
+}
+
+func (s *contentAddressedImageStore) Delete(key string) error {
+	if !validImageKey(filepath.FromSlash(key)) {
+		return nil
+	}
+	return removeImageFile(filepath.Join(s.dir, filepath.FromSlash(key)))
+}
+
+// s3ImageStoreは、S3互換ストレージ(AWS S3, MinIOなど)に画像を保存します。
+// 依存を増やさないよう、パス形式のURLとAWS Signature Version 4による署名を自前で実装しています。
+type s3ImageStore struct {
+	// Endpoint は、http://localhost:9000 のようなストレージのURLです。
+	Endpoint        string
+	Bucket          string
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	Client          *http.Client
+}
+
+func (s *s3ImageStore) objectURL(key string) string {
+	return strings.TrimRight(s.Endpoint, "/") + "/" + s.Bucket + "/" + key
+}
+
+func (s *s3ImageStore) do(method, key string, body []byte, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(key), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	signS3Request(req, body, s.Region, s.AccessKeyID, s.SecretAccessKey, time.Now().UTC())
+
+	return s.Client.Do(req)
+}
+
+func (s *s3ImageStore) Put(name string, ext string, data []byte) (string, error) {
+	key := name + "." + ext
+	res, err := s.do(http.MethodPut, key, data, mimeFromExt(ext))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("s3: PUT %s: %s", key, res.Status)
+	}
+	return key, nil
+}
+
+func (s *s3ImageStore) Get(key string) ([]byte, error) {
+	res, err := s.do(http.MethodGet, key, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrImageNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("s3: GET %s: %s", key, res.Status)
+	}
+	return io.ReadAll(res.Body)
+}
+
+func (s *s3ImageStore) Delete(key string) error {
+	res, err := s.do(http.MethodDelete, key, nil, "")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("s3: DELETE %s: %s", key, res.Status)
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// s3SigningKey は、AWS Signature Version 4の署名鍵を導出します。
+func s3SigningKey(secretAccessKey, date, region, service string) []byte {
+	k := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, service)
+	return hmacSHA256(k, "aws4_request")
+}
+
+// signS3Request は、リクエストにAWS Signature Version 4のAuthorizationヘッダーを付与します。
+// 画像のキーはURLエンコードの不要な文字だけで構成されるので、パスはそのまま正規化パスとして扱います。
+func signS3Request(req *http.Request, body []byte, region, accessKeyID, secretAccessKey string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signature := hex.EncodeToString(hmacSHA256(s3SigningKey(secretAccessKey, date, region, "s3"), stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, signature,
+	))
+}
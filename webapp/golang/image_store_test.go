@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func testImageStore(t *testing.T, s ImageStore) {
+	t.Helper()
+
+	key, err := s.Put("1", "png", []byte("png data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := s.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "png data" {
+		t.Errorf("Get(%q) = %q; want %q", key, data, "png data")
+	}
+
+	if err := s.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(key); err != ErrImageNotFound {
+		t.Errorf("Get after Delete error = %v; want ErrImageNotFound", err)
+	}
+	if err := s.Delete(key); err != nil {
+		t.Errorf("Delete of missing image error = %v; want nil", err)
+	}
+}
+
+func TestLocalImageStore(t *testing.T) {
+	s := newLocalImageStore(t.TempDir())
+	testImageStore(t, s)
+
+	key, err := s.Put("42", "jpg", []byte("jpg data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nginxから直接配信できるファイル名で保存する
+	if key != "42.jpg" {
+		t.Errorf("key = %q; want %q", key, "42.jpg")
+	}
+
+	if _, err := s.Get("../42.jpg"); err != ErrImageNotFound {
+		t.Errorf("Get outside of the directory error = %v; want ErrImageNotFound", err)
+	}
+}
+
+func TestContentAddressedImageStore(t *testing.T) {
+	s := newContentAddressedImageStore(t.TempDir())
+	testImageStore(t, s)
+
+	key1, err := s.Put("1", "gif", []byte("same"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, err := s.Put("2", "gif", []byte("same"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key1 != key2 {
+		t.Errorf("keys for the same content differ: %q, %q", key1, key2)
+	}
+	if want := sha256Hex([]byte("same")) + ".gif"; !strings.HasSuffix(key1, want) {
+		t.Errorf("key = %q; want suffix %q", key1, want)
+	}
+}
+
+// fakeS3 は、署名付きのPUT/GET/DELETEだけを受け付けるS3互換ストレージの代わりです。
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	if r.Header.Get("X-Amz-Content-Sha256") != sha256Hex(body) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		f.objects[r.URL.Path] = body
+	case http.MethodGet:
+		data, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestS3ImageStore(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{}}
+	ts := httptest.NewServer(fake)
+	t.Cleanup(ts.Close)
+
+	s := &s3ImageStore{
+		Endpoint:        ts.URL,
+		Bucket:          "images",
+		Region:          "us-east-1",
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "secret",
+		Client:          ts.Client(),
+	}
+	testImageStore(t, s)
+
+	if _, err := s.Put("7", "png", []byte("png")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.objects["/images/7.png"]; !ok {
+		t.Errorf("object is not stored at the path-style URL: %v", fake.objects)
+	}
+}
+
+func TestS3SigningKey(t *testing.T) {
+	// AWSのドキュメントにある署名鍵の導出例
+	got := hex.EncodeToString(s3SigningKey("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20120215", "us-east-1", "iam"))
+	want := "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d"
+	if got != want {
+		t.Errorf("s3SigningKey = %s; want %s", got, want)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/HugoSmits86/nativewebp"
+)
+
+// encodeTestImage は、指定した形式(jpg, png, gif, webp)の小さな画像を生成します。
+func encodeTestImage(t *testing.T, ext string) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	img.Set(1, 1, color.RGBA{R: 255, A: 255})
+
+	buf := &bytes.Buffer{}
+	var err error
+	switch ext {
+	case "jpg":
+		err = jpeg.Encode(buf, img, nil)
+	case "png":
+		err = png.Encode(buf, img)
+	case "gif":
+		err = gif.Encode(buf, img, nil)
+	case "webp":
+		err = nativewebp.Encode(buf, img, nil)
+	default:
+		t.Fatalf("unknown ext %q", ext)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestInspectImage(t *testing.T) {
+	jpg := encodeTestImage(t, "jpg")
+	pngData := encodeTestImage(t, "png")
+	gifData := encodeTestImage(t, "gif")
+	webpData := encodeTestImage(t, "webp")
+
+	testCases := []struct {
+		name        string
+		data        []byte
+		contentType string
+		wantMime    string
+		wantErr     error
+	}{
+		{"jpeg", jpg, "image/jpeg", "image/jpeg", nil},
+		{"png without content type", pngData, "", "image/png", nil},
+		{"gif with generic content type", gifData, "application/octet-stream", "image/gif", nil},
+		{"webp", webpData, "image/webp", "image/webp", nil},
+		{"png declared as jpeg", pngData, "image/jpeg", "", errImageTypeMismatch},
+		{"webp declared as png", webpData, "image/png", "", errImageTypeMismatch},
+		{"avif", []byte("\x00\x00\x00\x1cftypavif"), "image/avif", "", errUnsupportedImage},
+		{"text", []byte("hello"), "image/png", "", errUnsupportedImage},
+		{"truncated png", pngData[:len(pngData)/2], "image/png", "", errCorruptedImage},
+		{"jpeg header only", []byte("\xff\xd8\xff\xe0"), "", "", errCorruptedImage},
+	}
+
+	for _, tc := range testCases {
+		mime, err := inspectImage(tc.data, tc.contentType)
+		if mime != tc.wantMime || err != tc.wantErr {
+			t.Errorf("%s: inspectImage = %q, %v; want %q, %v", tc.name, mime, err, tc.wantMime, tc.wantErr)
+		}
+		if err != nil && imageUploadNotices[err] == "" {
+			t.Errorf("%s: no notice for %v", tc.name, err)
+		}
+	}
+}
+
+func TestImageFormatMapping(t *testing.T) {
+	for _, f := range imageFormats {
+		if imageExt(f.Mime) != f.Ext || mimeFromExt(f.Ext) != f.Mime || mimeFromFormatName(f.Name) != f.Mime {
+			t.Errorf("%s: mapping between mime, ext and format name is inconsistent", f.Mime)
+		}
+		if mimeFromContentType(f.Mime+"; charset=binary") != f.Mime {
+			t.Errorf("%s: mimeFromContentType does not recognize the mime", f.Mime)
+		}
+	}
+	if imageExt("image/avif") != "" || mimeFromExt("avif") != "" {
+		t.Error("avif should not be supported")
+	}
+}
+
+func TestNegotiateImageMime(t *testing.T) {
+	testCases := []struct {
+		mime   string
+		accept string
+		want   string
+	}{
+		{"image/jpeg", "image/webp,*/*", "image/jpeg"},
+		{"image/png", "", "image/png"},
+		{"image/png", "*/*", "image/png"},
+		{"image/png", "image/avif,image/webp,image/apng,image/*,*/*;q=0.8", "image/webp"},
+		{"image/png", "image/webp;q=0,*/*", "image/png"},
+		{"image/webp", "", "image/webp"},
+		{"image/webp", "*/*", "image/webp"},
+		{"image/webp", "image/png,image/*;q=0.8", "image/webp"},
+		{"image/webp", "image/png,image/jpeg", "image/png"},
+		{"image/webp", "image/webp;q=0,*/*", "image/png"},
+	}
+
+	for _, tc := range testCases {
+		if got := negotiateImageMime(tc.mime, tc.accept); got != tc.want {
+			t.Errorf("negotiateImageMime(%q, %q) = %q; want %q", tc.mime, tc.accept, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package imgsanitize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/HugoSmits86/nativewebp"
+	"golang.org/x/image/webp"
+)
+
+var (
+	red  = color.RGBA{R: 255, A: 255}
+	blue = color.RGBA{B: 255, A: 255}
+)
+
+// testImage は、左半分が赤で右半分が青の画像を返します。
+func testImage(w, h int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if x < w/2 {
+				img.Set(x, y, red)
+			} else {
+				img.Set(x, y, blue)
+			}
+		}
+	}
+	return img
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	err := jpeg.Encode(buf, img, &jpeg.Options{Quality: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// exifSegment は、GPSの代わりにOrientationを持つEXIFのAPP1セグメントを返します。
+func exifSegment(order binary.ByteOrder, orientation uint16) []byte {
+	tiff := &bytes.Buffer{}
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	binary.Write(tiff, order, uint16(42))
+	binary.Write(tiff, order, uint32(8))
+	// IFD0: エントリー2件(Make, Orientation)
+	binary.Write(tiff, order, uint16(2))
+	binary.Write(tiff, order, []uint16{0x010f, 2})
+	binary.Write(tiff, order, uint32(4))
+	tiff.WriteString("ACME")
+	binary.Write(tiff, order, []uint16{0x0112, 3})
+	binary.Write(tiff, order, uint32(1))
+	binary.Write(tiff, order, []uint16{orientation, 0})
+	binary.Write(tiff, order, uint32(0))
+
+	payload := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	return jpegSegment(markerAPP1, payload)
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	seg := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(payload)+2))
+	return append(seg, payload...)
+}
+
+// insertAfterSOI は、JPEGのSOIの直後にセグメントを挿入します。
+func insertAfterSOI(data []byte, segments ...[]byte) []byte {
+	out := append([]byte{}, data[:2]...)
+	for _, seg := range segments {
+		out = append(out, seg...)
+	}
+	return append(out, data[2:]...)
+}
+
+func TestSanitizeJPEG(t *testing.T) {
+	plain := encodeJPEG(t, testImage(16, 8))
+	xmpWithGPS := jpegSegment(markerAPP1, append([]byte("http://ns.adobe.com/xap/1.0/\x00"), `<x:xmpmeta exif:GPSLatitude="35,40.5N"/>`...))
+	withMetadata := insertAfterSOI(plain, exifSegment(binary.BigEndian, 1), xmpWithGPS)
+
+	got, err := Sanitize(withMetadata, "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Error("EXIF and XMP with GPS should be removed")
+	}
+
+	// 位置情報を持たないメタデータは残し、画像を変更しない
+	for name, data := range map[string][]byte{
+		"plain": plain,
+		"with comment and XMP without GPS": insertAfterSOI(plain,
+			jpegSegment(markerAPP1, append([]byte("http://ns.adobe.com/xap/1.0/\x00"), "<x:xmpmeta/>"...)),
+			jpegSegment(markerCOM, []byte("comment")),
+		),
+	} {
+		got, err = Sanitize(data, "image/jpeg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: JPEG without EXIF or GPS should be returned as is", name)
+		}
+	}
+}
+
+func TestSanitizeJPEGAppliesOrientation(t *testing.T) {
+	plain := encodeJPEG(t, testImage(16, 8))
+
+	for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		got, err := Sanitize(insertAfterSOI(plain, exifSegment(order, 6)), "image/jpeg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(got, []byte("Exif\x00\x00")) {
+			t.Errorf("%v: EXIF should be removed", order)
+		}
+
+		img, err := jpeg.Decode(bytes.NewReader(got))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := img.Bounds(); b.Dx() != 8 || b.Dy() != 16 {
+			t.Fatalf("%v: size = %dx%d; want 8x16", order, b.Dx(), b.Dy())
+		}
+		// 時計回りに90度回転するので、左半分の赤が上半分になる
+		if r, _, b, _ := img.At(4, 2).RGBA(); r < b {
+			t.Errorf("%v: top should be red", order)
+		}
+		if r, _, b, _ := img.At(4, 13).RGBA(); r > b {
+			t.Errorf("%v: bottom should be blue", order)
+		}
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// 3x2の画像の左上(0, 0)の画素が移動する先
+	testCases := []struct {
+		orientation int
+		x, y        int
+	}{
+		{1, 0, 0},
+		{2, 2, 0},
+		{3, 2, 1},
+		{4, 0, 1},
+		{5, 0, 0},
+		{6, 1, 0},
+		{7, 1, 2},
+		{8, 0, 2},
+	}
+
+	for _, tc := range testCases {
+		src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+		src.Set(0, 0, red)
+
+		dst := orient(src, tc.orientation)
+		if got := color.RGBAModel.Convert(dst.At(tc.x, tc.y)); got != red {
+			t.Errorf("orientation %d: pixel (%d, %d) = %v; want red", tc.orientation, tc.x, tc.y, got)
+		}
+	}
+}
+
+func pngChunk(chunkType string, data []byte) []byte {
+	chunk := make([]byte, 4, 12+len(data))
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	chunk = append(chunk, chunkType...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+func TestSanitizePNG(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := png.Encode(buf, testImage(4, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := buf.Bytes()
+
+	// insertAfterIHDR は、IHDRの後ろにチャンクを挿入します。
+	ihdrEnd := len(pngSignature) + 12 + 13
+	insertAfterIHDR := func(chunks ...[]byte) []byte {
+		data := append([]byte{}, plain[:ihdrEnd]...)
+		for _, c := range chunks {
+			data = append(data, c...)
+		}
+		return append(data, plain[ihdrEnd:]...)
+	}
+
+	withMetadata := insertAfterIHDR(
+		pngChunk("eXIf", []byte("MM\x00\x2a")),
+		pngChunk("tEXt", []byte("Raw profile type exif\x00exif data")),
+		pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<x exif:GPSLatitude=\"35\"/>")),
+	)
+	got, err := Sanitize(withMetadata, "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Error("EXIF and XMP with GPS should be removed")
+	}
+	if _, err := png.Decode(bytes.NewReader(got)); err != nil {
+		t.Error(err)
+	}
+
+	// ImageMagickが付ける作成日時などのテキストチャンクと、IENDより後ろのデータは残す
+	for name, data := range map[string][]byte{
+		"plain": plain,
+		"with text chunks": append(insertAfterIHDR(
+			pngChunk("tEXt", []byte("date:create\x002016-01-01T00:00:00+09:00")),
+			pngChunk("tIME", []byte{7, 224, 1, 1, 0, 0, 0}),
+		), "trailing"...),
+	} {
+		got, err = Sanitize(data, "image/png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: PNG without EXIF or GPS should be returned as is", name)
+		}
+	}
+}
+
+func TestSanitizeMalformed(t *testing.T) {
+	jpg := encodeJPEG(t, testImage(4, 4))
+
+	testCases := []struct {
+		name string
+		data []byte
+		mime string
+	}{
+		{"not jpeg", []byte("hello"), "image/jpeg"},
+		{"truncated jpeg segment", jpg[:5], "image/jpeg"},
+		{"not png", []byte("hello"), "image/png"},
+		{"truncated png chunk", append(append([]byte{}, pngSignature...), 0, 0, 1, 0, 'I', 'D'), "image/png"},
+	}
+
+	for _, tc := range testCases {
+		_, err := Sanitize(tc.data, tc.mime)
+		if !errors.Is(err, ErrMalformed) {
+			t.Errorf("%s: err = %v; want ErrMalformed", tc.name, err)
+		}
+	}
+}
+
+func TestSanitizeWebP(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := nativewebp.Encode(buf, testImage(4, 4), &nativewebp.Options{UseExtendedFormat: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := buf.Bytes()
+
+	// appendChunks は、チャンクを追加し、VP8Xのフラグとファイルの長さを書き換えます。
+	appendChunks := func(flags byte, chunks ...string) []byte {
+		data := append([]byte{}, plain...)
+		for _, c := range chunks {
+			data = append(data, c...)
+		}
+		data[20] |= flags
+		binary.LittleEndian.PutUint32(data[4:], uint32(len(data)-8))
+		return data
+	}
+
+	got, err := Sanitize(appendChunks(webpFlagEXIF|webpFlagXMP, "EXIF\x05\x00\x00\x00GPS!!\x00", "XMP \x06\x00\x00\x00<GPS/>"), "image/webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Error("EXIF and XMP with GPS should be removed")
+	}
+
+	// 位置情報を含まないXMPは残す
+	withXMP := appendChunks(webpFlagXMP, "XMP \x04\x00\x00\x00<x/>")
+	got, err = Sanitize(withXMP, "image/webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, withXMP) {
+		t.Error("XMP without GPS should be kept")
+	}
+	if _, err := webp.Decode(bytes.NewReader(got)); err != nil {
+		t.Error(err)
+	}
+
+	got, err = Sanitize(plain, "image/webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Error("WebP without metadata should be returned as is")
+	}
+
+	_, err = Sanitize(plain[:len(plain)-3], "image/webp")
+	if !errors.Is(err, ErrMalformed) {
+		t.Errorf("truncated webp: err = %v; want ErrMalformed", err)
+	}
+}
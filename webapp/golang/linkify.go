@@ -0,0 +1,48 @@
+package main
+
+import (
+	"html/template"
+	"sort"
+	"strings"
+)
+
+// linkMatchは、本文中のリンクにする範囲です。startからendまでが#や@を含むテキストです。
+type linkMatch struct {
+	start, end int
+	href       string
+}
+
+// linkifyBody は、本文やコメントをHTMLエスケープし、#タグをタグのページへ、@アカウント名をユーザーのページへのリンクにします。
+func linkifyBody(text string) template.HTML {
+	matches := []linkMatch{}
+	// 各パターンのサブマッチ(m[2]:m[3])は記号を除いた部分なので、記号はその1バイト前から始まる
+	for _, m := range hashtagPattern.FindAllStringSubmatchIndex(text, -1) {
+		if normalizeHashtag(text[m[2]:m[3]]) == "" {
+			continue
+		}
+		matches = append(matches, linkMatch{start: m[2] - 1, end: m[3], href: hashtagURL(text[m[2]:m[3]])})
+	}
+	for _, m := range mentionPattern.FindAllStringSubmatchIndex(text, -1) {
+		matches = append(matches, linkMatch{start: m[2] - 1, end: m[3], href: "/@" + text[m[2]:m[3]]})
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].start < matches[j].start
+	})
+
+	var sb strings.Builder
+	last := 0
+	for _, m := range matches {
+		if m.start < last {
+			continue
+		}
+		class := "isu-hashtag"
+		if text[m.start] == '@' {
+			class = "isu-mention"
+		}
+		sb.WriteString(template.HTMLEscapeString(text[last:m.start]))
+		sb.WriteString(`<a href="` + template.HTMLEscapeString(m.href) + `" class="` + class + `">` + template.HTMLEscapeString(text[m.start:m.end]) + `</a>`)
+		last = m.end
+	}
+	sb.WriteString(template.HTMLEscapeString(text[last:]))
+	return template.HTML(sb.String())
+}
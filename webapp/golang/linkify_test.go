@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestLinkifyBody(t *testing.T) {
+	testCases := []struct {
+		text string
+		want string
+	}{
+		{
+			`<b>"hi"</b> #Go #日本`,
+			`&lt;b&gt;&#34;hi&#34;&lt;/b&gt; <a href="/tags/go" class="isu-hashtag">#Go</a> <a href="/tags/%E6%97%A5%E6%9C%AC" class="isu-hashtag">#日本</a>`,
+		},
+		{
+			`@alice さん #isucon を見て @bob`,
+			`<a href="/@alice" class="isu-mention">@alice</a> さん <a href="/tags/isucon" class="isu-hashtag">#isucon</a> を見て <a href="/@bob" class="isu-mention">@bob</a>`,
+		},
+		{
+			`mail@example.com`,
+			`mail@example.com`,
+		},
+	}
+
+	for _, tc := range testCases {
+		if got := string(linkifyBody(tc.text)); got != tc.want {
+			t.Errorf("linkifyBody(%q) = %s; want %s", tc.text, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import "regexp"
+
+// mentionPatternは、本文やコメント中の@アカウント名に一致します。
+// アカウント名の文字種は/@{accountName}のルーティングと合わせています。
+// メールアドレスのように英数字などの直後にある@はメンションとみなしません。
+var mentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_.@])@([a-zA-Z]+)`)
+
+// extractMentions は、本文に含まれるメンションのアカウント名を出現順に重複なく返します。
+func extractMentions(text string) []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for _, m := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		if seen[m[1]] {
+			continue
+		}
+		seen[m[1]] = true
+		names = append(names, m[1])
+	}
+	return names
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// isuconp-migrate は、webappのバイナリに含まれるオフライン用のサブコマンドです。
+// `app migrate schema`、`app migrate images` のほか、バイナリをisuconp-migrateという名前で呼び出した場合は
+// `isuconp-migrate schema`、`isuconp-migrate images` として実行できます。
+// サーバーはスキーマを変更しないので、デプロイ時にサーバーを起動する前に`app migrate schema`を実行します。
+
+const migrateCommandName = "isuconp-migrate"
+
+// migrateArgs は、コマンドライン引数がマイグレーションの呼び出しであればサブコマンド以降の引数を返します。
+func migrateArgs(args []string) ([]string, bool) {
+	if len(args) == 0 {
+		return nil, false
+	}
+	if filepath.Base(args[0]) == migrateCommandName {
+		return args[1:], true
+	}
+	if len(args) > 1 && args[1] == "migrate" {
+		return args[2:], true
+	}
+	return nil, false
+}
+
+func runMigrate(args []string, stderr io.Writer) int {
+	usage := func() {
+		fmt.Fprintf(stderr, "Usage: %s schema [options]\n", migrateCommandName)
+		fmt.Fprintf(stderr, "       %s images [options]\n", migrateCommandName)
+	}
+
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+
+	switch args[0] {
+	case "schema":
+		return runMigrateSchema(args[1:], stderr)
+	case "images":
+		return runMigrateImages(args[1:], stderr)
+	default:
+		fmt.Fprintf(stderr, "unknown subcommand %q\n", args[0])
+		usage()
+		return 2
+	}
+}
+
+func runMigrateSchema(args []string, stderr io.Writer) int {
+	flags := flag.NewFlagSet(migrateCommandName+" schema", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+
+	markApplied := flags.Int("mark-applied", 0, "record migrations up to this version as applied without running them")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+
+	db, err := openMySQL()
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to connect to DB: %s.\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	logger := log.New(stderr, "", log.LstdFlags)
+	err = newMySQLStore(db).Migrate(*markApplied, logger.Printf)
+	if err != nil {
+		logger.Printf("Failed to migrate DB schema: %s.", err)
+		return 1
+	}
+
+	logger.Printf("done: schema version %d", len(mysqlMigrations))
+	return 0
+}
+
+func runMigrateImages(args []string, stderr io.Writer) int {
+	flags := flag.NewFlagSet(migrateCommandName+" images", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+
+	opts := migrateImagesOptions{}
+	flags.IntVar(&opts.BatchSize, "batch-size", 100, "number of posts read from MySQL at once")
+	flags.IntVar(&opts.AfterID, "after-id", 0, "skip posts whose id is less than or equal to this value")
+	flags.BoolVar(&opts.NullBlob, "null-blob", false, "set posts.imgdata to NULL after the image is verified in the image store")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if opts.BatchSize <= 0 {
+		fmt.Fprintln(stderr, "-batch-size must be positive")
+		return 2
+	}
+
+	dst, err := newImageStoreFromEnv()
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to configure image store: %s.\n", err)
+		return 1
+	}
+
+	db, err := openMySQL()
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to connect to DB: %s.\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	src := newMySQLStore(db)
+	err = src.CheckSchema()
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to check DB schema: %s.\n", err)
+		return 1
+	}
+
+	logger := log.New(stderr, "", log.LstdFlags)
+	result, err := migrateImages(src, dst, opts, logger)
+	if err != nil {
+		logger.Printf("migration stopped: %s", err)
+		logger.Printf("rerun the same command to resume (last migrated post id: %d)", result.LastID)
+		return 1
+	}
+
+	logger.Printf("done: %d images migrated, %d skipped (last post id: %d)", result.Migrated, result.Skipped, result.LastID)
+	return 0
+}
+
+// legacyImageSourceは、posts.imgdataに画像が残っている投稿を読み出す先です。
+// mysqlStoreが実装します。
+type legacyImageSource interface {
+	// ListLegacyImages は、afterIDより大きいIDで画像の移行が必要な投稿をIDの昇順に最大limit件返します。
+	// includeMigratedがtrueの場合、image_keyが設定済みでもimgdataが残っている投稿を含みます。
+	ListLegacyImages(afterID, limit int, includeMigrated bool) ([]Post, error)
+	// FinishImageMigration は、投稿にImageStoreのキーを記録し、nullBlobがtrueの場合はimgdataをNULLにします。
+	FinishImageMigration(id int, key string, nullBlob bool) error
+}
+
+type migrateImagesOptions struct {
+	BatchSize int
+	AfterID   int
+	NullBlob  bool
+}
+
+type migrateImagesResult struct {
+	Migrated int
+	Skipped  int
+	// LastID は、移行を完了した最後の投稿IDです。
+	LastID int
+}
+
+// migrateImages は、posts.imgdataの画像をImageStoreにバッチ単位で移行します。
+// ImageStoreに書き込んだ画像を読み戻してSHA-256を照合し、一致した投稿だけimage_keyを記録します。
+// image_keyが記録された投稿は次回以降の対象にならないので、途中で止まっても再実行すれば続きから移行できます。
+func migrateImages(src legacyImageSource, dst ImageStore, opts migrateImagesOptions, logger *log.Logger) (migrateImagesResult, error) {
+	result := migrateImagesResult{LastID: opts.AfterID}
+
+	for {
+		posts, err := src.ListLegacyImages(result.LastID, opts.BatchSize, opts.NullBlob)
+		if err != nil {
+			return result, err
+		}
+		if len(posts) == 0 {
+			return result, nil
+		}
+
+		for _, p := range posts {
+			migrated, err := migrateImage(src, dst, p, opts.NullBlob)
+			if err != nil {
+				return result, fmt.Errorf("post %d: %w", p.ID, err)
+			}
+			if migrated {
+				result.Migrated++
+			} else {
+				logger.Printf("post %d: skipped (no image data or unknown mime %q)", p.ID, p.Mime)
+				result.Skipped++
+			}
+			result.LastID = p.ID
+		}
+
+		logger.Printf("%d images migrated, %d skipped (last post id: %d)", result.Migrated, result.Skipped, result.LastID)
+	}
+}
+
+var errChecksumMismatch = errors.New("checksum mismatch between MySQL and image store")
+
+func migrateImage(src legacyImageSource, dst ImageStore, p Post, nullBlob bool) (bool, error) {
+	ext := imageExt(p.Mime)
+	if len(p.Imgdata) == 0 || ext == "" {
+		return false, nil
+	}
+
+	key := p.ImageKey
+	if key == "" {
+		var err error
+		key, err = dst.Put(strconv.Itoa(p.ID), ext, p.Imgdata)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	stored, err := dst.Get(key)
+	if err != nil {
+		return false, err
+	}
+	want := sha256.Sum256(p.Imgdata)
+	got := sha256.Sum256(stored)
+	if !bytes.Equal(want[:], got[:]) {
+		return false, errChecksumMismatch
+	}
+
+	err = src.FinishImageMigration(p.ID, key, nullBlob)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// exitIfMigrate は、コマンドライン引数がマイグレーションの呼び出しであれば実行して終了します。
+func exitIfMigrate() {
+	args, ok := migrateArgs(os.Args)
+	if !ok {
+		return
+	}
+	os.Exit(runMigrate(args, os.Stderr))
+}
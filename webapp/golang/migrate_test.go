@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// fakeLegacySource は、posts.imgdataに画像が残っているMySQLの代わりです。
+type fakeLegacySource struct {
+	posts map[int]*Post
+}
+
+func (s *fakeLegacySource) ListLegacyImages(afterID, limit int, includeMigrated bool) ([]Post, error) {
+	ids := []int{}
+	for id, p := range s.posts {
+		if id > afterID && (p.ImageKey == "" || includeMigrated && len(p.Imgdata) > 0) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	posts := []Post{}
+	for _, id := range ids {
+		posts = append(posts, *s.posts[id])
+	}
+	return posts, nil
+}
+
+func (s *fakeLegacySource) FinishImageMigration(id int, key string, nullBlob bool) error {
+	s.posts[id].ImageKey = key
+	if nullBlob {
+		s.posts[id].Imgdata = nil
+	}
+	return nil
+}
+
+func newFakeLegacySource(n int) *fakeLegacySource {
+	s := &fakeLegacySource{posts: map[int]*Post{}}
+	for id := 1; id <= n; id++ {
+		s.posts[id] = &Post{ID: id, Mime: "image/jpeg", Imgdata: []byte{byte(id)}}
+	}
+	return s
+}
+
+// failingImageStore は、指定した投稿IDのPutで失敗します。
+type failingImageStore struct {
+	ImageStore
+	failPID int
+}
+
+func (s *failingImageStore) Put(name string, ext string, data []byte) (string, error) {
+	if name == strconv.Itoa(s.failPID) {
+		return "", errors.New("disk full")
+	}
+	return s.ImageStore.Put(name, ext, data)
+}
+
+// corruptImageStore は、保存した内容と異なる画像を返します。
+type corruptImageStore struct {
+	ImageStore
+}
+
+func (s *corruptImageStore) Get(key string) ([]byte, error) {
+	return []byte("corrupted"), nil
+}
+
+var discardLogger = log.New(io.Discard, "", 0)
+
+func TestMigrateImagesResumes(t *testing.T) {
+	src := newFakeLegacySource(5)
+	dst := newLocalImageStore(t.TempDir())
+	opts := migrateImagesOptions{BatchSize: 2}
+
+	result, err := migrateImages(src, &failingImageStore{ImageStore: dst, failPID: 4}, opts, discardLogger)
+	if err == nil {
+		t.Fatal("migrateImages succeeded; want error")
+	}
+	if result.LastID != 3 || result.Migrated != 3 {
+		t.Errorf("result = %+v; want LastID 3 and Migrated 3", result)
+	}
+
+	result, err = migrateImages(src, dst, opts, discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Migrated != 2 || result.LastID != 5 {
+		t.Errorf("resumed result = %+v; want Migrated 2 and LastID 5", result)
+	}
+
+	for id, p := range src.posts {
+		data, err := dst.Get(p.ImageKey)
+		if err != nil {
+			t.Fatalf("post %d: %v", id, err)
+		}
+		if !reflect.DeepEqual(data, p.Imgdata) {
+			t.Errorf("post %d: stored image = %v; want %v", id, data, p.Imgdata)
+		}
+	}
+}
+
+func TestMigrateImagesNullBlob(t *testing.T) {
+	src := newFakeLegacySource(3)
+	dst := newLocalImageStore(t.TempDir())
+
+	// 1回目はBLOBを残し、2回目で移行済みの投稿のBLOBを照合してからNULLにする
+	if _, err := migrateImages(src, dst, migrateImagesOptions{BatchSize: 10}, discardLogger); err != nil {
+		t.Fatal(err)
+	}
+	result, err := migrateImages(src, dst, migrateImagesOptions{BatchSize: 10, NullBlob: true}, discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Migrated != 3 {
+		t.Errorf("Migrated = %d; want 3", result.Migrated)
+	}
+	for id, p := range src.posts {
+		if p.Imgdata != nil || p.ImageKey != strconv.Itoa(id)+".jpg" {
+			t.Errorf("post %d = %+v; want imgdata to be NULL", id, p)
+		}
+	}
+}
+
+func TestMigrateImagesChecksumMismatch(t *testing.T) {
+	src := newFakeLegacySource(1)
+	dst := &corruptImageStore{ImageStore: newLocalImageStore(t.TempDir())}
+
+	_, err := migrateImages(src, dst, migrateImagesOptions{BatchSize: 10, NullBlob: true}, discardLogger)
+	if !errors.Is(err, errChecksumMismatch) {
+		t.Fatalf("error = %v; want errChecksumMismatch", err)
+	}
+	if src.posts[1].ImageKey != "" || src.posts[1].Imgdata == nil {
+		t.Errorf("post was marked as migrated despite the checksum mismatch: %+v", src.posts[1])
+	}
+}
+
+func TestMigrateArgs(t *testing.T) {
+	testCases := []struct {
+		args []string
+		want []string
+		ok   bool
+	}{
+		{[]string{"/usr/local/bin/isuconp-migrate", "images"}, []string{"images"}, true},
+		{[]string{"./app", "migrate", "images", "-null-blob"}, []string{"images", "-null-blob"}, true},
+		{[]string{"./app", "migrate", "schema"}, []string{"schema"}, true},
+		{[]string{"./app"}, nil, false},
+	}
+
+	for _, tc := range testCases {
+		got, ok := migrateArgs(tc.args)
+		if ok != tc.ok || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("migrateArgs(%q) = %q, %v; want %q, %v", tc.args, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestRunMigrateSchemaInvalidFlag(t *testing.T) {
+	// フラグが正しくない場合は、DBに接続する前に終了する
+	if code := runMigrate([]string{"schema", "-mark-applied", "x"}, io.Discard); code != 2 {
+		t.Errorf("exit code = %d; want 2", code)
+	}
+}
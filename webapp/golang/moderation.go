@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ModerationLog.Actionの値
+const (
+	moderationBan   = "ban"
+	moderationUnban = "unban"
+	moderationRole  = "role"
+	// 通報への対応で投稿・コメントを削除した操作
+	moderationDeletePost    = "delete_post"
+	moderationDeleteComment = "delete_comment"
+	// ログインの失敗が続いてロックされたアカウントのロックを解除した操作
+	moderationUnlock = "unlock"
+)
+
+// /admin/auditの1ページに表示する監査ログの数
+const moderationLogsPerPage = 100
+
+// ModerationLogは、管理者によるモデレーション操作の監査ログです。追記のみで、更新や削除はしません。
+// アカウント名は操作した時点のものを記録します。
+type ModerationLog struct {
+	ID                int    `db:"id"`
+	ActorID           int    `db:"actor_id"`
+	ActorAccountName  string `db:"actor_account_name"`
+	TargetID          int    `db:"target_id"`
+	TargetAccountName string `db:"target_account_name"`
+	Action            string `db:"action"`
+	// Detail は、操作の内容です。役割の変更では変更前と変更後の役割の名前を記録します。
+	Detail    string    `db:"detail"`
+	Reason    string    `db:"reason"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// ModerationLogFilterは、監査ログの絞り込み条件です。ゼロ値のフィールドでは絞り込みません。
+type ModerationLogFilter struct {
+	Action string
+	// AccountName は、操作したユーザーまたは操作されたユーザーのアカウント名です。
+	AccountName string
+	// BeforeID は、ページングのためにこのIDより前の監査ログだけを返す条件です。
+	BeforeID int
+}
+
+// Match は、監査ログが条件に一致するかを返します。
+func (f ModerationLogFilter) Match(l ModerationLog) bool {
+	if f.Action != "" && l.Action != f.Action {
+		return false
+	}
+	if f.AccountName != "" && l.ActorAccountName != f.AccountName && l.TargetAccountName != f.AccountName {
+		return false
+	}
+	if f.BeforeID > 0 && l.ID >= f.BeforeID {
+		return false
+	}
+	return true
+}
+
+var (
+	errModerationReasonRequired = errors.New("moderation reason is required")
+	errModerationInvalidTarget  = errors.New("invalid moderation target")
+	errModerationSelfTarget     = errors.New("cannot moderate yourself")
+)
+
+// legacyBanReason は、理由の欄がない旧来のフォームで/admin/bannedにBANを送信した場合に記録する理由です。
+// ベンチマーカーは理由を送らないので、その場合だけ理由なしのBANを受け付けます。
+const legacyBanReason = "理由の指定なし"
+
+// moderationNotices は、モデレーション操作のエラーごとに管理者に表示するメッセージです。
+var moderationNotices = map[error]string{
+	errModerationReasonRequired: "理由を入力してください",
+	errModerationInvalidTarget:  "対象のユーザーが正しくありません",
+	errModerationSelfTarget:     "自分自身は操作できません",
+}
+
+// moderateUsers は、uidsのユーザーをactionに従ってBANまたはBAN解除し、監査ログに記録します。
+// すべての対象を確認してから操作するので、対象に誤りがある場合は誰も操作しません。
+// 一般ユーザー以外はBANできません。すでに同じ状態のユーザーは操作も記録もしません。
+func moderateUsers(me User, uids []string, action, reason string) error {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return errModerationReasonRequired
+	}
+
+	targets := make([]User, 0, len(uids))
+	for _, id := range uids {
+		uid, err := strconv.Atoi(id)
+		if err != nil {
+			return errModerationInvalidTarget
+		}
+		u, err := repo.GetUser(uid)
+		if err == ErrNotFound {
+			return errModerationInvalidTarget
+		}
+		if err != nil {
+			return err
+		}
+		if u.Role() != roleUser {
+			return errModerationInvalidTarget
+		}
+		targets = append(targets, u)
+	}
+
+	for _, u := range targets {
+		var err error
+		switch {
+		case action == moderationBan && u.DelFlg == userActive:
+			err = repo.BanUser(u.ID)
+		case action == moderationUnban && u.DelFlg == userBanned:
+			err = repo.UnbanUser(u.ID)
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		err = repo.AppendModerationLog(ModerationLog{
+			ActorID:           me.ID,
+			ActorAccountName:  me.AccountName,
+			TargetID:          u.ID,
+			TargetAccountName: u.AccountName,
+			Action:            action,
+			Reason:            reason,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// changeUserRole は、accountNameのユーザーの役割をroleNameの役割に変更し、監査ログに記録します。
+// 自分自身の役割は変更できません。すでに同じ役割の場合は変更も記録もしません。
+func changeUserRole(me User, accountName, roleName, reason string) error {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return errModerationReasonRequired
+	}
+
+	role, ok := roleByName(roleName)
+	if !ok {
+		return errModerationInvalidTarget
+	}
+
+	u, err := repo.GetActiveUserByAccountName(strings.TrimSpace(accountName))
+	if err == ErrNotFound {
+		return errModerationInvalidTarget
+	}
+	if err != nil {
+		return err
+	}
+	if u.ID == me.ID {
+		return errModerationSelfTarget
+	}
+	if u.Role() == role {
+		return nil
+	}
+
+	err = repo.SetUserAuthority(u.ID, int(role))
+	if err != nil {
+		return err
+	}
+	err = invalidateUserCache(u.ID)
+	if err != nil {
+		return err
+	}
+
+	return repo.AppendModerationLog(ModerationLog{
+		ActorID:           me.ID,
+		ActorAccountName:  me.AccountName,
+		TargetID:          u.ID,
+		TargetAccountName: u.AccountName,
+		Action:            moderationRole,
+		Detail:            u.Role().Name() + " -> " + role.Name(),
+		Reason:            reason,
+	})
+}
+
+// unlockAccount は、ログインの失敗が続いてロックされたアカウントのロックを解除し、監査ログに記録します。
+func unlockAccount(me User, accountName, reason string) error {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return errModerationReasonRequired
+	}
+
+	u, err := repo.GetActiveUserByAccountName(accountName)
+	if err == ErrNotFound {
+		return errModerationInvalidTarget
+	}
+	if err != nil {
+		return err
+	}
+
+	err = loginThrottle.Unlock(u.AccountName)
+	if err != nil {
+		return err
+	}
+	err = repo.DeleteLoginLockout(u.AccountName)
+	if err != nil {
+		return err
+	}
+
+	return repo.AppendModerationLog(ModerationLog{
+		ActorID:           me.ID,
+		ActorAccountName:  me.AccountName,
+		TargetID:          u.ID,
+		TargetAccountName: u.AccountName,
+		Action:            moderationUnlock,
+		Reason:            reason,
+	})
+}
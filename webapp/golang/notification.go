@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// Notification.Kindの値
+const (
+	// notificationMention は、投稿の本文かコメントでメンションされたことを表します。
+	notificationMention = "mention"
+	// notificationComment は、自分の投稿にコメントされたことを表します。
+	notificationComment = "comment"
+	// notificationLike は、自分の投稿にいいねされたことを表します。
+	notificationLike = "like"
+)
+
+// /notificationsに表示する通知の数
+const notificationsPerPage = 50
+
+// notify は、userIDのユーザーに通知を作成し、未読数のキャッシュを削除します。自分自身の操作は通知しません。
+func notify(userID, actorID int, kind string, postID int) error {
+	if userID == actorID {
+		return nil
+	}
+	err := repo.CreateNotification(Notification{UserID: userID, ActorID: actorID, Kind: kind, PostID: postID})
+	if err != nil {
+		return err
+	}
+	return invalidateUnreadNotificationCount(userID)
+}
+
+// notifyMentions は、textでメンションされたユーザーに通知します。
+// notifiedに含まれるユーザーには通知せず、通知したユーザーをnotifiedに追加します。
+func notifyMentions(actor User, postID int, text string, notified map[int]bool) error {
+	for _, name := range extractMentions(text) {
+		u, err := repo.GetActiveUserByAccountName(name)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if notified[u.ID] {
+			continue
+		}
+		notified[u.ID] = true
+
+		err = notify(u.ID, actor.ID, notificationMention, postID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyComment は、コメントでメンションされたユーザーと投稿者に通知します。
+// 投稿者がメンションされている場合はメンションの通知だけを送ります。
+func notifyComment(actor User, postID int, comment string) error {
+	notified := map[int]bool{actor.ID: true}
+	err := notifyMentions(actor, postID, comment, notified)
+	if err != nil {
+		return err
+	}
+
+	post, err := repo.GetPost(postID)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if notified[post.UserID] {
+		return nil
+	}
+	return notify(post.UserID, actor.ID, notificationComment, postID)
+}
+
+func unreadNotificationCountKey(userID int) string {
+	return fmt.Sprintf("notification_unread_%d", userID)
+}
+
+// unreadNotificationCount は、layout.htmlのヘッダーに表示する未読の通知の数を返します。
+// ページの表示を妨げないよう、取得できない場合はログに記録して0を返します。
+func unreadNotificationCount(me User) int {
+	if !isLogin(me) {
+		return 0
+	}
+
+	key := unreadNotificationCountKey(me.ID)
+	item, err := memcacheClient.Get(key)
+	if err == nil {
+		count, err := strconv.Atoi(string(item.Value))
+		if err == nil {
+			return count
+		}
+	}
+
+	count, err := repo.CountUnreadNotifications(me.ID)
+	if err != nil {
+		log.Print(err)
+		return 0
+	}
+	memcacheClient.Set(&memcache.Item{
+		Key:        key,
+		Value:      []byte(strconv.Itoa(count)),
+		Expiration: 10,
+	})
+	return count
+}
+
+// invalidateUnreadNotificationCount は、unreadNotificationCountがキャッシュした未読数を削除します。
+func invalidateUnreadNotificationCount(userID int) error {
+	err := memcacheClient.Delete(unreadNotificationCountKey(userID))
+	if err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// users.passhashには、次のいずれかの形式でパスワードのハッシュを保存します。
+//
+//   - $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<hash>: argon2idのハッシュ(PHC文字列形式)
+//   - 接頭辞なし: 初期データと同じcalculatePasshashのSHA-512のハッシュ(旧形式)
+//
+// 旧形式のハッシュは、ログインに成功したときにargon2idのハッシュに置き換えます。
+const passhashArgon2idPrefix = "$argon2id$"
+
+// argon2Paramsは、argon2idでハッシュを計算するときのコストです。
+type argon2Params struct {
+	// Time は、反復回数です。
+	Time uint32
+	// Memory は、使用するメモリ(KiB)です。
+	Memory uint32
+	// Threads は、並列度です。
+	Threads uint8
+}
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// passwordHashParamsは、新しくハッシュを計算するときのコストです。
+// OWASPの推奨値(m=19MiB, t=2, p=1)をデフォルトとし、環境変数で変更できます。
+// デフォルトでは1回の計算にCPUを約30ms、メモリを約19MiB使い、argon2idのハッシュを持つユーザーのログインごとに1回計算します。
+// ログインの多い負荷でCPUが足りない場合は、安全性と引き換えに小さくしてください(t=1で約17ms、m=7MiB, t=1で約7ms)。
+// テストでは計算を速くするために小さな値にします。
+var passwordHashParams = argon2Params{Time: 2, Memory: 19 * 1024, Threads: 1}
+
+var errInvalidPasshash = errors.New("invalid passhash")
+
+// loadPasswordHashParamsFromEnv は、環境変数ISUCONP_PASSWORD_HASH_*でpasswordHashParamsを変更します。
+//
+//   - ISUCONP_PASSWORD_HASH_TIME: 反復回数
+//   - ISUCONP_PASSWORD_HASH_MEMORY: 使用するメモリ(KiB)
+//   - ISUCONP_PASSWORD_HASH_THREADS: 並列度
+func loadPasswordHashParamsFromEnv() error {
+	envs := []struct {
+		name    string
+		bitSize int
+		set     func(uint64)
+	}{
+		{"ISUCONP_PASSWORD_HASH_TIME", 32, func(v uint64) { passwordHashParams.Time = uint32(v) }},
+		{"ISUCONP_PASSWORD_HASH_MEMORY", 32, func(v uint64) { passwordHashParams.Memory = uint32(v) }},
+		{"ISUCONP_PASSWORD_HASH_THREADS", 8, func(v uint64) { passwordHashParams.Threads = uint8(v) }},
+	}
+	for _, env := range envs {
+		s := os.Getenv(env.name)
+		if s == "" {
+			continue
+		}
+		v, err := strconv.ParseUint(s, 10, env.bitSize)
+		if err != nil || v == 0 {
+			return fmt.Errorf("invalid %s=%q", env.name, s)
+		}
+		env.set(v)
+	}
+	return nil
+}
+
+// hashPassword は、passwordHashParamsのコストでパスワードのargon2idのハッシュを計算します。
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	p := passwordHashParams
+	key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, argon2KeyLength)
+	return formatArgon2idPasshash(p, salt, key), nil
+}
+
+func formatArgon2idPasshash(p argon2Params, salt, key []byte) string {
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		passhashArgon2idPrefix, argon2.Version, p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// parseArgon2idPasshash は、argon2idのハッシュからコスト、ソルト、ハッシュ値を取り出します。
+func parseArgon2idPasshash(passhash string) (argon2Params, []byte, []byte, error) {
+	p := argon2Params{}
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, hash
+	parts := strings.Split(passhash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, nil, nil, errInvalidPasshash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return p, nil, nil, errInvalidPasshash
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads)
+	if err != nil {
+		return p, nil, nil, errInvalidPasshash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, errInvalidPasshash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, errInvalidPasshash
+	}
+	return p, salt, key, nil
+}
+
+// verifyPassword は、パスワードがユーザーのハッシュと一致するかを返します。
+// 一致した場合、ハッシュが旧形式またはpasswordHashParamsと異なるコストのときはneedsRehashをtrueにします。
+func verifyPassword(u User, password string) (ok bool, needsRehash bool) {
+	if !strings.HasPrefix(u.Passhash, passhashArgon2idPrefix) {
+		ok = subtle.ConstantTimeCompare([]byte(calculatePasshash(u.AccountName, password)), []byte(u.Passhash)) == 1
+		return ok, ok
+	}
+
+	p, salt, key, err := parseArgon2idPasshash(u.Passhash)
+	if err != nil {
+		return false, false
+	}
+	actual := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, uint32(len(key)))
+	ok = subtle.ConstantTimeCompare(actual, key) == 1
+	return ok, ok && p != passwordHashParams
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	params := passwordHashParams
+	passwordHashParams = argon2Params{Time: 1, Memory: 64, Threads: 1}
+	t.Cleanup(func() { passwordHashParams = params })
+
+	passhash, err := hashPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(passhash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("hashPassword() = %q", passhash)
+	}
+	if other, _ := hashPassword("password"); other == passhash {
+		t.Error("hashPassword should use a random salt")
+	}
+
+	testCases := []struct {
+		name        string
+		passhash    string
+		password    string
+		ok          bool
+		needsRehash bool
+	}{
+		{"argon2id", passhash, "password", true, false},
+		{"argon2id wrong password", passhash, "wrong", false, false},
+		{"legacy", calculatePasshash("alice", "password"), "password", true, true},
+		{"legacy wrong password", calculatePasshash("alice", "password"), "wrong", false, false},
+		{"broken", passhashArgon2idPrefix + "v=19$m=64", "password", false, false},
+	}
+	for _, tc := range testCases {
+		ok, needsRehash := verifyPassword(User{AccountName: "alice", Passhash: tc.passhash}, tc.password)
+		if ok != tc.ok || needsRehash != tc.needsRehash {
+			t.Errorf("%s: verifyPassword() = %v, %v; want %v, %v", tc.name, ok, needsRehash, tc.ok, tc.needsRehash)
+		}
+	}
+
+	// コストを上げた後は、古いコストのハッシュを計算し直す
+	passwordHashParams.Time = 2
+	if ok, needsRehash := verifyPassword(User{Passhash: passhash}, "password"); !ok || !needsRehash {
+		t.Errorf("verifyPassword() with old cost = %v, %v; want true, true", ok, needsRehash)
+	}
+}
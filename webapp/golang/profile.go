@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/catatsuy/private-isu/webapp/golang/imgsanitize"
+)
+
+const (
+	// 表示名と自己紹介の最大文字数。users.display_nameとusers.bioの長さと合わせる
+	maxDisplayNameLength = 64
+	maxBioLength         = 1000
+	// avatarWidthは、保存するアバター画像の幅です。これより大きな画像は縮小します。
+	avatarWidth = 160
+)
+
+var (
+	errProfileDisplayNameTooLong = errors.New("display name is too long")
+	errProfileBioTooLong         = errors.New("bio is too long")
+)
+
+// profileNotices は、プロフィールの編集のエラーごとにユーザーに表示するメッセージです。
+// アバター画像の検査エラーはimageUploadNoticesのメッセージを表示します。
+var profileNotices = map[error]string{
+	errProfileDisplayNameTooLong: fmt.Sprintf("表示名は%d文字以内である必要があります", maxDisplayNameLength),
+	errProfileBioTooLong:         fmt.Sprintf("自己紹介は%d文字以内である必要があります", maxBioLength),
+}
+
+// normalizeProfile は、表示名と自己紹介の前後の空白を取り除いて長さを確認します。
+// 表示名は1行で表示するので、改行などの空白は1つの空白にまとめます。
+func normalizeProfile(displayName, bio string) (string, string, error) {
+	displayName = strings.Join(strings.Fields(displayName), " ")
+	if utf8.RuneCountInString(displayName) > maxDisplayNameLength {
+		return "", "", errProfileDisplayNameTooLong
+	}
+	bio = strings.TrimSpace(strings.ReplaceAll(bio, "\r\n", "\n"))
+	if utf8.RuneCountInString(bio) > maxBioLength {
+		return "", "", errProfileBioTooLong
+	}
+	return displayName, bio, nil
+}
+
+// avatarImageName は、アバター画像をImageStoreに保存するときの名前を返します。
+// 投稿画像の{id}.{ext}と重ならないようにディレクトリを分け、変更するたびに別の名前にしてURLを変えます。
+func avatarImageName(userID int) string {
+	return "avatar/" + strconv.Itoa(userID) + "_" + secureRandomStr(8)
+}
+
+// saveAvatar は、投稿画像と同じくメタデータを取り除いたアバター画像を、avatarWidthに縮小してImageStoreに保存します。
+// mimeはinspectImageで確認済みの形式です。
+func saveAvatar(u User, mime string, filedata []byte) (string, error) {
+	filedata, err := imgsanitize.Sanitize(filedata, mime)
+	if err != nil {
+		return "", err
+	}
+	avatar, err := makeThumbnail(filedata, mime, avatarWidth)
+	if err != nil {
+		return "", err
+	}
+	return imageStore.Put(avatarImageName(u.ID), imageExt(thumbnailMime(mime)), avatar)
+}
+
+// updateProfile は、表示名と自己紹介を変更します。avatarがnilでない場合はアバター画像も置き換えます。
+// 投稿とコメントのキャッシュに含まれるユーザーは、キャッシュの有効期限が切れるまで変更前のままです。
+func updateProfile(u User, displayName, bio string, avatarMime string, avatar []byte) error {
+	displayName, bio, err := normalizeProfile(displayName, bio)
+	if err != nil {
+		return err
+	}
+
+	avatarKey := u.AvatarKey
+	if avatar != nil {
+		avatarKey, err = saveAvatar(u, avatarMime, avatar)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = repo.UpdateProfile(u.ID, displayName, bio, avatarKey)
+	if err != nil {
+		return err
+	}
+	err = invalidateUserCache(u.ID)
+	if err != nil {
+		return err
+	}
+
+	if u.AvatarKey != "" && u.AvatarKey != avatarKey {
+		return deleteUnusedImage(u.AvatarKey)
+	}
+	return nil
+}
+
+// avatarURL は、ユーザーのアバター画像のURLを返します。設定していない場合は空文字列です。
+// 画像を変更するとキーが変わるので、キーから作ったvで別のURLにしてブラウザのキャッシュを使い分けます。
+func avatarURL(u User) string {
+	if u.AvatarKey == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(u.AvatarKey))
+	return "/avatar/" + strconv.Itoa(u.ID) + path.Ext(u.AvatarKey) + "?v=" + hex.EncodeToString(sum[:4])
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Report.Statusの値
+const (
+	reportOpen      = "open"
+	reportDismissed = "dismissed"
+	reportResolved  = "resolved"
+)
+
+// /admin/reportsで選べる対応
+const (
+	reportActionDismiss = "dismiss"
+	reportActionDelete  = "delete"
+	reportActionBan     = "ban"
+)
+
+// /admin/reportsに表示する通報の数
+const reportsPerPage = 100
+
+// 通報の理由の最大文字数。reports.reasonの長さと合わせる
+const maxReportReasonLength = 255
+
+// Reportは、ユーザーによる投稿またはコメントの通報です。
+// CommentIDが0の場合は投稿への通報です。
+type Report struct {
+	ID         int       `db:"id"`
+	ReporterID int       `db:"reporter_id"`
+	PostID     int       `db:"post_id"`
+	CommentID  int       `db:"comment_id"`
+	Reason     string    `db:"reason"`
+	Status     string    `db:"status"`
+	ResolvedBy int       `db:"resolved_by"`
+	CreatedAt  time.Time `db:"created_at"`
+	Reporter   User      `db:"Reporter"`
+}
+
+// reportEntryは、/admin/reportsに表示する通報と、通報された投稿またはコメントです。
+type reportEntry struct {
+	Report
+	Post    Post
+	Comment *Comment
+	// Author は、通報された投稿またはコメントを書いたユーザーです。
+	Author User
+	// Deleted は、通報された投稿またはコメントがすでに削除されていることを表します。
+	Deleted bool
+}
+
+var errReportReasonTooLong = errors.New("report reason is too long")
+
+// normalizeReportReason は、通報の理由の前後の空白を取り除きます。
+func normalizeReportReason(reason string) (string, error) {
+	reason = strings.TrimSpace(reason)
+	if utf8.RuneCountInString(reason) > maxReportReasonLength {
+		return "", errReportReasonTooLong
+	}
+	return reason, nil
+}
+
+// loadReportEntry は、通報された投稿またはコメントを読み込みます。
+func loadReportEntry(rp Report) (reportEntry, error) {
+	e := reportEntry{Report: rp}
+	if rp.CommentID != 0 {
+		c, err := repo.GetComment(rp.CommentID)
+		if err == ErrNotFound {
+			e.Deleted = true
+			return e, nil
+		}
+		if err != nil {
+			return e, err
+		}
+		e.Comment = &c
+		e.Author = c.User
+		return e, nil
+	}
+
+	p, err := repo.GetPost(rp.PostID)
+	if err == ErrNotFound {
+		e.Deleted = true
+		return e, nil
+	}
+	if err != nil {
+		return e, err
+	}
+	e.Post = p
+	e.Author = p.User
+	return e, nil
+}
+
+// resolveReport は、通報にactionで対応し、同じ投稿またはコメントへの未対応の通報をすべて閉じます。
+// 削除とBANは理由が必要で、監査ログに記録します。BANはmoderateUsersで/admin/bannedと同じように行います。
+func resolveReport(me User, e reportEntry, action, reason string) error {
+	status := reportResolved
+	switch action {
+	case reportActionDismiss:
+		status = reportDismissed
+	case reportActionDelete:
+		reason = strings.TrimSpace(reason)
+		if reason == "" {
+			return errModerationReasonRequired
+		}
+		if !e.Deleted {
+			err := deleteReportedContent(me, e, reason)
+			if err != nil {
+				return err
+			}
+		}
+	case reportActionBan:
+		if e.Deleted {
+			return errModerationInvalidTarget
+		}
+		err := moderateUsers(me, []string{strconv.Itoa(e.Author.ID)}, moderationBan, reason)
+		if err != nil {
+			return err
+		}
+	default:
+		return errModerationInvalidTarget
+	}
+
+	return repo.ResolveReports(e.PostID, e.CommentID, status, me.ID)
+}
+
+// deleteReportedContent は、通報された投稿またはコメントを削除して監査ログに記録します。
+func deleteReportedContent(me User, e reportEntry, reason string) error {
+	l := ModerationLog{
+		ActorID:           me.ID,
+		ActorAccountName:  me.AccountName,
+		TargetID:          e.Author.ID,
+		TargetAccountName: e.Author.AccountName,
+		Reason:            reason,
+	}
+	if e.Comment != nil {
+		err := deleteComment(*e.Comment)
+		if err != nil {
+			return err
+		}
+		l.Action = moderationDeleteComment
+		l.Detail = "comment " + strconv.Itoa(e.Comment.ID)
+	} else {
+		err := deletePost(e.Post)
+		if err != nil {
+			return err
+		}
+		l.Action = moderationDeletePost
+		l.Detail = "post " + strconv.Itoa(e.Post.ID)
+	}
+	return repo.AppendModerationLog(l)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// Roleは、ユーザーの役割です。users.authorityの値をそのまま使います。
+// 初期データの管理者はauthority = 1なので、管理者を1としています。
+type Role int
+
+const (
+	roleUser      Role = 0
+	roleAdmin     Role = 1
+	roleModerator Role = 2
+)
+
+// rolesは、役割の一覧です。権限の少ない順に並べています。
+var roles = []Role{roleUser, roleModerator, roleAdmin}
+
+// Name は、フォームやURLで使う役割の名前を返します。
+func (r Role) Name() string {
+	switch r {
+	case roleUser:
+		return "user"
+	case roleModerator:
+		return "moderator"
+	case roleAdmin:
+		return "admin"
+	}
+	return fmt.Sprintf("role(%d)", int(r))
+}
+
+// Label は、画面に表示する役割の名前を返します。
+func (r Role) Label() string {
+	switch r {
+	case roleUser:
+		return "一般ユーザー"
+	case roleModerator:
+		return "モデレーター"
+	case roleAdmin:
+		return "管理者"
+	}
+	return r.Name()
+}
+
+// roleByName は、Nameが返す名前から役割を返します。
+func roleByName(name string) (Role, bool) {
+	for _, r := range roles {
+		if r.Name() == name {
+			return r, true
+		}
+	}
+	return 0, false
+}
+
+// Role は、ユーザーの役割を返します。
+func (u User) Role() Role {
+	return Role(u.Authority)
+}
+
+// Permissionは、役割に与える権限です。
+type Permission string
+
+const (
+	// permBanUsers は、ユーザーのBANとBAN解除、監査ログの閲覧ができる権限です。
+	permBanUsers Permission = "ban_users"
+	// permDeletePosts は、他のユーザーの投稿とコメントを削除できる権限です。コメントの編集も含みます。
+	permDeletePosts Permission = "delete_posts"
+	// permManageRoles は、他のユーザーの役割を変更できる権限です。
+	permManageRoles Permission = "manage_roles"
+)
+
+// rolePermissionsは、役割ごとの権限の一覧です。一般ユーザーは自分の投稿とコメントだけを操作できます。
+var rolePermissions = map[Role][]Permission{
+	roleModerator: {permBanUsers, permDeletePosts},
+	roleAdmin:     {permBanUsers, permDeletePosts, permManageRoles},
+}
+
+// hasPermission は、ログインユーザーがpermissionを持っているかを返します。
+func hasPermission(u User, permission Permission) bool {
+	if !isLogin(u) {
+		return false
+	}
+	for _, p := range rolePermissions[u.Role()] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+type permittedUserKey struct{}
+
+// requirePermission は、permissionを持つユーザーだけにハンドラーを実行させるミドルウェアを返します。
+// ログインしていない場合はトップページにリダイレクトし、権限がない場合は403を返します。
+// ハンドラーはpermittedUserで確認済みのユーザーを取得できます。
+func requirePermission(permission Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			me := getSessionUser(r)
+			if !isLogin(me) {
+				http.Redirect(w, r, "/", http.StatusFound)
+				return
+			}
+
+			if !hasPermission(me, permission) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), permittedUserKey{}, me)))
+		})
+	}
+}
+
+// permittedUser は、requirePermissionで権限を確認したログインユーザーを返します。
+func permittedUser(r *http.Request) User {
+	u, _ := r.Context().Value(permittedUserKey{}).(User)
+	return u
+}
+
+// invalidateUserCache は、getSessionUserがキャッシュしたユーザーを削除します。
+// 役割を変更したときに、変更前の権限が使われ続けないようにします。
+func invalidateUserCache(userID int) error {
+	err := memcacheClient.Delete(fmt.Sprintf("user_%d", userID))
+	if err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
+	return nil
+}
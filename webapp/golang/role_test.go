@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestHasPermission(t *testing.T) {
+	testCases := []struct {
+		role Role
+		want map[Permission]bool
+	}{
+		{roleUser, map[Permission]bool{}},
+		{roleModerator, map[Permission]bool{permBanUsers: true, permDeletePosts: true}},
+		{roleAdmin, map[Permission]bool{permBanUsers: true, permDeletePosts: true, permManageRoles: true}},
+	}
+
+	for _, tc := range testCases {
+		u := User{ID: 1, Authority: int(tc.role)}
+		for _, p := range []Permission{permBanUsers, permDeletePosts, permManageRoles} {
+			if got := hasPermission(u, p); got != tc.want[p] {
+				t.Errorf("hasPermission(%s, %s) = %v; want %v", tc.role.Name(), p, got, tc.want[p])
+			}
+		}
+		if r, ok := roleByName(tc.role.Name()); !ok || r != tc.role {
+			t.Errorf("roleByName(%q) = %v, %v", tc.role.Name(), r, ok)
+		}
+	}
+
+	// ログインしていないユーザーはどの権限も持たない
+	if hasPermission(User{Authority: int(roleAdmin)}, permBanUsers) {
+		t.Error("anonymous user should not have any permission")
+	}
+}
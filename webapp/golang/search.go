@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// SearchIndexは、投稿の全文検索を抽象化したインターフェースです。
+// MySQLのFULLTEXTインデックス(ngramパーサー)を使う実装(mysqlSearchIndex)と、
+// プロセス内の転置インデックスを使う実装(memorySearchIndex)があります。
+//
+// 本文または1つのコメントが検索語(minSearchTermLength文字以上の語)をすべて含む投稿と、クエリが投稿者のアカウント名と一致する投稿を検索します。
+// BANされたユーザーの投稿・コメントと、削除された投稿・コメントには一致しません。
+type SearchIndex interface {
+	// Initialize は、ベンチマーカーの/initializeで呼ばれ、索引を初期データの状態に戻します。
+	Initialize() error
+	// IndexPost は、作成した投稿を索引に追加します。
+	IndexPost(p Post) error
+	// IndexComment は、作成・編集したコメントを索引に追加します。編集した場合は編集前の内容を置き換えます。
+	IndexComment(c Comment) error
+	// RemoveComment は、削除したコメントを索引から取り除きます。
+	RemoveComment(id int) error
+	// SearchPosts は、queryに一致する投稿のうち、cursorより後ろ(古い側)の投稿を最大limit件返します。
+	// 並び順と返すPostの内容はStoreの一覧系メソッドと同じです。
+	SearchPosts(query string, cursor PostCursor, limit int) ([]Post, error)
+}
+
+// minSearchTermLength は、検索できる語の最小の文字数です。
+// MySQLのngramパーサー(ngram_token_size=2)はこれより短い語を索引に含めないので、どちらの実装でも短い語は無視します。
+const minSearchTermLength = 2
+
+// searchTerms は、クエリを空白や記号で区切った検索語のうち、minSearchTermLength文字以上のものを小文字にして返します。
+func searchTerms(query string) []string {
+	terms := []string{}
+	for _, term := range strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '_'
+	}) {
+		if utf8.RuneCountInString(term) >= minSearchTermLength {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// searchTokens は、文字列をMySQLのngramパーサー(ngram_token_size=2)と同じように2文字ずつに区切ったトークンを返します。
+// 検索語を含む文書は、その検索語のトークンをすべて持ちます。
+func searchTokens(text string) []string {
+	tokens := []string{}
+	for _, term := range searchTerms(text) {
+		runes := []rune(term)
+		for i := 0; i+1 < len(runes); i++ {
+			tokens = append(tokens, string(runes[i:i+2]))
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// memorySearchIndexは、投稿の本文とコメントをトークンごとの転置インデックスで検索します。
+// 索引に追加した投稿とコメントだけを検索するので、Storeの既存のデータは含みません。
+// 投稿の削除やBANは、検索時にStoreから投稿とユーザーを読み直して反映します。
+type memorySearchIndex struct {
+	mu       sync.RWMutex
+	store    Store
+	postings map[string]map[searchDocKey]bool
+	docs     map[searchDocKey]searchDoc
+}
+
+// searchDocKeyは、索引に追加した文書(投稿の本文またはコメント)を表します。
+type searchDocKey struct {
+	Comment bool
+	ID      int
+}
+
+type searchDoc struct {
+	PostID int
+	UserID int
+	Tokens []string
+}
+
+func newMemorySearchIndex(store Store) *memorySearchIndex {
+	return &memorySearchIndex{
+		store:    store,
+		postings: map[string]map[searchDocKey]bool{},
+		docs:     map[searchDocKey]searchDoc{},
+	}
+}
+
+func (s *memorySearchIndex) Initialize() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.postings = map[string]map[searchDocKey]bool{}
+	s.docs = map[searchDocKey]searchDoc{}
+	return nil
+}
+
+// add は、文書を索引に追加します。同じ文書がすでにある場合は置き換えます。
+func (s *memorySearchIndex) add(key searchDocKey, doc searchDoc) {
+	s.remove(key)
+	for _, token := range doc.Tokens {
+		if s.postings[token] == nil {
+			s.postings[token] = map[searchDocKey]bool{}
+		}
+		s.postings[token][key] = true
+	}
+	s.docs[key] = doc
+}
+
+func (s *memorySearchIndex) remove(key searchDocKey) {
+	doc, ok := s.docs[key]
+	if !ok {
+		return
+	}
+	for _, token := range doc.Tokens {
+		delete(s.postings[token], key)
+		if len(s.postings[token]) == 0 {
+			delete(s.postings, token)
+		}
+	}
+	delete(s.docs, key)
+}
+
+func (s *memorySearchIndex) IndexPost(p Post) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.add(searchDocKey{ID: p.ID}, searchDoc{PostID: p.ID, UserID: p.UserID, Tokens: searchTokens(p.Body)})
+	return nil
+}
+
+func (s *memorySearchIndex) IndexComment(c Comment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.add(searchDocKey{Comment: true, ID: c.ID}, searchDoc{PostID: c.PostID, UserID: c.UserID, Tokens: searchTokens(c.Comment)})
+	return nil
+}
+
+func (s *memorySearchIndex) RemoveComment(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.remove(searchDocKey{Comment: true, ID: id})
+	return nil
+}
+
+// matchPostIDs は、queryのトークンをすべて含む文書を書いたユーザーと、その文書が属する投稿のIDを返します。
+func (s *memorySearchIndex) matchPostIDs(query string) map[int][]int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tokens := searchTokens(query)
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	// 文書の少ないトークンから絞り込む
+	sort.Slice(tokens, func(i, j int) bool {
+		return len(s.postings[tokens[i]]) < len(s.postings[tokens[j]])
+	})
+	matched := map[int][]int{}
+	for key := range s.postings[tokens[0]] {
+		ok := true
+		for _, token := range tokens[1:] {
+			if !s.postings[token][key] {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			doc := s.docs[key]
+			matched[doc.PostID] = append(matched[doc.PostID], doc.UserID)
+		}
+	}
+	return matched
+}
+
+func (s *memorySearchIndex) SearchPosts(query string, cursor PostCursor, limit int) ([]Post, error) {
+	results := []Post{}
+	activeUsers := map[int]bool{}
+	isActive := func(userID int) (bool, error) {
+		active, ok := activeUsers[userID]
+		if ok {
+			return active, nil
+		}
+		u, err := s.store.GetUser(userID)
+		if err != nil && err != ErrNotFound {
+			return false, err
+		}
+		activeUsers[userID] = err == nil && u.DelFlg == 0
+		return activeUsers[userID], nil
+	}
+
+	candidates := s.matchPostIDs(query)
+	// クエリがアカウント名と一致する場合は、そのユーザーの投稿も含める
+	if name := strings.TrimSpace(query); name != "" {
+		u, err := s.store.GetActiveUserByAccountName(name)
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+		if err == nil {
+			posts, err := s.store.ListPostsByUser(u.ID, 0)
+			if err != nil {
+				return nil, err
+			}
+			if candidates == nil {
+				candidates = map[int][]int{}
+			}
+			for _, p := range posts {
+				candidates[p.ID] = append(candidates[p.ID], p.UserID)
+			}
+		}
+	}
+
+	for postID, userIDs := range candidates {
+		// BANされたユーザーが書いたコメントだけに一致した投稿は含めない
+		found := false
+		for _, userID := range userIDs {
+			active, err := isActive(userID)
+			if err != nil {
+				return nil, err
+			}
+			if active {
+				found = true
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+
+		p, err := s.store.GetPost(postID)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if cursor.Before(p) {
+			results = append(results, p)
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].CreatedAt.Equal(results[j].CreatedAt) {
+			return results[i].ID > results[j].ID
+		}
+		return results[i].CreatedAt.After(results[j].CreatedAt)
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// mysqlSearchIndexは、posts.bodyとcomments.commentのFULLTEXTインデックス(ngramパーサー)で検索します。
+// 索引はMySQLが更新するので、IndexPostなどでは何もしません。
+type mysqlSearchIndex struct {
+	db *sqlx.DB
+}
+
+func newMySQLSearchIndex(db *sqlx.DB) *mysqlSearchIndex {
+	return &mysqlSearchIndex{db: db}
+}
+
+func (s *mysqlSearchIndex) Initialize() error            { return nil }
+func (s *mysqlSearchIndex) IndexPost(p Post) error       { return nil }
+func (s *mysqlSearchIndex) IndexComment(c Comment) error { return nil }
+func (s *mysqlSearchIndex) RemoveComment(id int) error   { return nil }
+
+// booleanModeQuery は、検索語をすべて含む文書に一致するBOOLEAN MODEのクエリを返します。
+// 検索語はngramで区切ったフレーズとして扱うため、それぞれ+"..."で囲みます。
+func booleanModeQuery(query string) string {
+	terms := searchTerms(query)
+	for i, term := range terms {
+		terms[i] = `+"` + term + `"`
+	}
+	return strings.Join(terms, " ")
+}
+
+func (s *mysqlSearchIndex) SearchPosts(query string, cursor PostCursor, limit int) ([]Post, error) {
+	results := []Post{}
+	against := booleanModeQuery(query)
+	if against == "" {
+		return results, nil
+	}
+
+	q := `SELECT ` + postWithUserColumns + `
+	FROM posts
+	JOIN users ON posts.user_id = users.id
+	WHERE users.del_flg = 0 AND posts.del_flg = 0 AND (
+		MATCH (posts.body) AGAINST (? IN BOOLEAN MODE) OR
+		posts.id IN (
+			SELECT comments.post_id FROM comments
+			JOIN users AS commenters ON comments.user_id = commenters.id
+			WHERE comments.del_flg = 0 AND commenters.del_flg = 0 AND
+			MATCH (comments.comment) AGAINST (? IN BOOLEAN MODE)
+		) OR
+		users.account_name = ?
+	)`
+	args := []interface{}{against, against, strings.TrimSpace(query)}
+	if !cursor.IsZero() {
+		q += ` AND (posts.created_at < ? OR (posts.created_at = ? AND posts.id < ?))`
+		args = append(args, cursor.CreatedAt, cursor.CreatedAt, cursor.ID)
+	}
+	q += `
+	ORDER BY posts.created_at DESC, posts.id DESC
+	LIMIT ?`
+	args = append(args, limit)
+
+	err := s.db.Select(&results, q, args...)
+	return results, err
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSearchTokens(t *testing.T) {
+	testCases := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{}},
+		{"猫", []string{}},
+		{"猫の写真", []string{"猫の", "の写", "写真"}},
+		{"猫 の写真", []string{"の写", "写真"}},
+		{"Go ISUCON!", []string{"go", "is", "su", "uc", "co", "on"}},
+	}
+
+	for _, tc := range testCases {
+		if got := searchTokens(tc.query); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("searchTokens(%q) = %q; want %q", tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestBooleanModeQuery(t *testing.T) {
+	if got, want := booleanModeQuery(`猫の写真 "Go" -xy`), `+"猫の写真" +"go" +"xy"`; got != want {
+		t.Errorf("booleanModeQuery = %s; want %s", got, want)
+	}
+	if got := booleanModeQuery(" !? "); got != "" {
+		t.Errorf("booleanModeQuery for symbols = %q; want empty", got)
+	}
+	if got, want := booleanModeQuery("猫 写真"), `+"写真"`; got != want {
+		t.Errorf("booleanModeQuery with a short term = %s; want %s", got, want)
+	}
+}
+
+// searchBackend は、SearchIndexの実装と、その実装が検索するStoreを作ります。
+type searchBackend struct {
+	name string
+	open func(t *testing.T) (Store, SearchIndex)
+}
+
+// searchBackends は、SearchIndexの実装ごとのsearchBackendを返します。
+// MySQLの実装は、ISUCONP_TEST_MYSQL=1でISUCONP_DB_*のテスト用データベースを指定した場合だけテストします。
+func searchBackends() []searchBackend {
+	return []searchBackend{
+		{"memory", func(t *testing.T) (Store, SearchIndex) {
+			s := newMemoryStore()
+			return s, newMemorySearchIndex(s)
+		}},
+		{"mysql", func(t *testing.T) (Store, SearchIndex) {
+			if os.Getenv("ISUCONP_TEST_MYSQL") != "1" {
+				t.Skip("ISUCONP_TEST_MYSQL=1 is not set")
+			}
+			db, err := openMySQL()
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { db.Close() })
+			s := newMySQLStore(db)
+			if err := s.Migrate(0, t.Logf); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Initialize(); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Initialize() })
+			return s, newMySQLSearchIndex(db)
+		}},
+	}
+}
+
+// TestSearchShortTerms は、どちらの実装でもminSearchTermLengthより短い語を無視することを確かめます。
+func TestSearchShortTerms(t *testing.T) {
+	for _, b := range searchBackends() {
+		t.Run(b.name, func(t *testing.T) {
+			s, index := b.open(t)
+
+			uid, err := s.CreateUser("search_short_terms", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body := "ゐゑの写真"
+			pid, err := s.CreatePost(uid, "image/png", body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := index.IndexPost(Post{ID: pid, UserID: uid, Body: body}); err != nil {
+				t.Fatal(err)
+			}
+
+			testCases := []struct {
+				query string
+				want  bool
+			}{
+				{"ゐ", false},
+				{"ゐ ゑ", false},
+				{"ゐゑ", true},
+				{"ゑの写真", true},
+				// 1文字の語は無視し、残りの語だけで検索する
+				{"猫 ゐゑ", true},
+			}
+			for _, tc := range testCases {
+				posts, err := index.SearchPosts(tc.query, PostCursor{}, postsPerPage)
+				if err != nil {
+					t.Fatal(err)
+				}
+				found := false
+				for _, p := range posts {
+					if p.ID == pid {
+						found = true
+					}
+				}
+				if found != tc.want {
+					t.Errorf("search %q: found = %v; want %v", tc.query, found, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMemorySearchIndex(t *testing.T) {
+	repo = newMemoryStore()
+	index := newMemorySearchIndex(repo)
+
+	alice := createTestUser(t, "alice")
+	bob := createTestUser(t, "bob")
+
+	createIndexedPost := func(u User, body string) int {
+		t.Helper()
+		pid, err := repo.CreatePost(u.ID, "image/png", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := index.IndexPost(Post{ID: pid, UserID: u.ID, Body: body}); err != nil {
+			t.Fatal(err)
+		}
+		return pid
+	}
+	search := func(query string) []int {
+		t.Helper()
+		posts, err := index.SearchPosts(query, PostCursor{}, postsPerPage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []int{}
+		for _, p := range posts {
+			ids = append(ids, p.ID)
+		}
+		return ids
+	}
+
+	cat := createIndexedPost(alice, "今日の猫の写真")
+	dog := createIndexedPost(alice, "犬の写真です")
+	commented := createIndexedPost(alice, "景色")
+	cid, err := repo.CreateComment(commented, bob.ID, "すてきな写真")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := index.IndexComment(Comment{ID: cid, PostID: commented, UserID: bob.ID, Comment: "すてきな写真"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := search("写真"), []int{commented, dog, cat}; !reflect.DeepEqual(got, want) {
+		t.Errorf("search 写真 = %v; want %v", got, want)
+	}
+	if got, want := search("猫の 写真"), []int{cat}; !reflect.DeepEqual(got, want) {
+		t.Errorf("search 猫の 写真 = %v; want %v", got, want)
+	}
+	if got, want := search("alice"), []int{commented, dog, cat}; !reflect.DeepEqual(got, want) {
+		t.Errorf("search alice = %v; want %v", got, want)
+	}
+
+	// BANされたユーザーのコメントには一致しない
+	if err := repo.BanUser(bob.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := search("すてき"); len(got) != 0 {
+		t.Errorf("comment of banned user should not match: %v", got)
+	}
+
+	if err := index.RemoveComment(cid); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.DeletePost(dog); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := search("写真"), []int{cat}; !reflect.DeepEqual(got, want) {
+		t.Errorf("search 写真 after deletion = %v; want %v", got, want)
+	}
+}
+
+func TestGetSearch(t *testing.T) {
+	ts, client := setupTestServer(t)
+
+	alice := createTestUser(t, "alice")
+	for i := 0; i < postsPerPage+1; i++ {
+		if _, err := createPost(alice, "image/png", encodeTestImage(t, "png"), "花火の写真"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pid, err := createPost(alice, "image/png", encodeTestImage(t, "png"), "unrelated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createComment(alice, pid, "コメントで花火の話"); err != nil {
+		t.Fatal(err)
+	}
+
+	body := getBody(t, client, ts.URL+"/search?q="+url.QueryEscape("花火"))
+	if !strings.Contains(body, "unrelated") {
+		t.Error("post should match its comment")
+	}
+	if n := strings.Count(body, `class="isu-post"`); n != postsPerPage {
+		t.Errorf("search page shows %d posts; want %d", n, postsPerPage)
+	}
+	if !strings.Contains(body, `data-q="花火"`) {
+		t.Error("search page should load more results of the same query")
+	}
+
+	res, err := client.Get(ts.URL + "/posts?q=" + url.QueryEscape("花火") + "&cursor=" + url.QueryEscape(nextCursorOfPage(t, "花火")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("next page of search results: status = %d; want %d", res.StatusCode, http.StatusOK)
+	}
+
+	if body := getBody(t, client, ts.URL+"/search?q=nothing"); !strings.Contains(body, "isu-search-empty") {
+		t.Error("search page should tell that nothing matched")
+	}
+}
+
+// nextCursorOfPage は、検索結果の最初のページの次のページのカーソルを返します。
+func nextCursorOfPage(t *testing.T, q string) string {
+	t.Helper()
+
+	posts, err := searchIndex.SearchPosts(q, PostCursor{}, postsPerPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nextCursor(posts)
+}
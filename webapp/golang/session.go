@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	gsm "github.com/bradleypeabody/gorilla-sessions-memcache"
+	"github.com/gorilla/sessions"
+)
+
+const sessionName = "isuconp-go.session"
+
+// 環境変数ISUCONP_SESSION_SECRETSがない場合に使う、開発用の秘密鍵
+const defaultSessionSecret = "sendagaya"
+
+// loadSessionSecrets は、環境変数ISUCONP_SESSION_SECRETSからセッションの秘密鍵を読み込みます。
+// カンマ区切りで複数指定でき、先頭の鍵で新しいセッションを保存し、残りの鍵は検証だけに使います。
+// 鍵を入れ替えるときは、新しい鍵を先頭に追加し、古いセッションが期限切れになってから古い鍵を削除します。
+func loadSessionSecrets() []string {
+	secrets := []string{}
+	for _, s := range strings.Split(os.Getenv("ISUCONP_SESSION_SECRETS"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			secrets = append(secrets, s)
+		}
+	}
+	if len(secrets) == 0 {
+		log.Print("ISUCONP_SESSION_SECRETS is not set; using the development session secret")
+		secrets = append(secrets, defaultSessionSecret)
+	}
+	return secrets
+}
+
+// sessionKeyPairs は、秘密鍵ごとに署名用と暗号化用(AES-256)の鍵を導出して、securecookieの鍵の組にします。
+func sessionKeyPairs(secrets []string) [][]byte {
+	pairs := make([][]byte, 0, len(secrets)*2)
+	for _, secret := range secrets {
+		hashKey := sha256.Sum256([]byte("hash:" + secret))
+		blockKey := sha256.Sum256([]byte("block:" + secret))
+		pairs = append(pairs, hashKey[:], blockKey[:])
+	}
+	return pairs
+}
+
+// newSessionStore は、backendのセッションストアを返します。
+//
+//   - memcache: セッションの値をmemcachedに保存し、CookieにはセッションIDを署名・暗号化して保存する
+//   - cookie: セッションの値を署名・暗号化してCookieに保存する。サーバー側に状態を持たない
+//   - memory: プロセス内のメモリに保存する。再起動するとすべてのセッションが消える
+//
+// どのストアでも、revokeAllSessionsでユーザーのすべてのセッションを無効にできます。
+func newSessionStore(backend string, secrets []string) (sessions.Store, error) {
+	keyPairs := sessionKeyPairs(secrets)
+	switch backend {
+	case "memcache":
+		client, ok := memcacheClient.(*memcache.Client)
+		if !ok {
+			return nil, fmt.Errorf("session store %q requires memcached", backend)
+		}
+		return gsm.NewMemcacheStore(client, "iscogram_", keyPairs...), nil
+	case "cookie":
+		s := sessions.NewCookieStore(keyPairs...)
+		s.Options.HttpOnly = true
+		return s, nil
+	case "memory":
+		return gsm.NewDumbMemorySessionStore(), nil
+	}
+	return nil, fmt.Errorf("unknown session store %q", backend)
+}
+
+// newSessionStoreFromEnv は、環境変数ISUCONP_SESSION_STOREで指定したセッションストアを返します。
+// 指定がない場合はdefaultBackendを使います。
+func newSessionStoreFromEnv(defaultBackend string) (sessions.Store, error) {
+	backend := os.Getenv("ISUCONP_SESSION_STORE")
+	if backend == "" {
+		backend = defaultBackend
+	}
+	return newSessionStore(backend, loadSessionSecrets())
+}
+
+// sessionInt は、セッションに保存された数値をintに変換します。
+// 過去のセッションにはLastInsertIdのint64がそのまま保存されていることがあります。
+func sessionInt(session *sessions.Session, key string) (int, bool) {
+	switch v := session.Values[key].(type) {
+	case int:
+		return v, true
+	case int64:
+		return int(v), true
+	default:
+		return 0, false
+	}
+}
+
+// revokeAllSessions は、ユーザーのすべての端末のセッションを無効にします。
+// セッションにはログインした時点のusers.session_versionを保存しているので、それを進めると
+// Cookieに値を保存するストアでも、以前のセッションはgetSessionUserでログインしていないものとして扱われます。
+func revokeAllSessions(userID int) error {
+	err := repo.IncrementSessionVersion(userID)
+	if err != nil {
+		return err
+	}
+	return invalidateUserCache(userID)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestCookieSessionStoreKeyRotation(t *testing.T) {
+	oldStore, err := newSessionStore("cookie", []string{"old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	session, _ := oldStore.Get(r, sessionName)
+	session.Values["user_id"] = 1
+	if err := session.Save(r, rec); err != nil {
+		t.Fatal(err)
+	}
+	cookie := rec.Result().Cookies()[0]
+
+	load := func(s sessions.Store) (int, bool) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(cookie)
+		session, _ := s.Get(r, sessionName)
+		return sessionUserID(session)
+	}
+
+	// 新しい鍵を先頭に追加しても、古い鍵で保存したセッションを読める
+	rotated, err := newSessionStore("cookie", []string{"new", "old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid, ok := load(rotated); !ok || uid != 1 {
+		t.Errorf("session saved with the old secret: user_id = %d, %v", uid, ok)
+	}
+
+	// 古い鍵を削除すると読めない
+	removed, err := newSessionStore("cookie", []string{"new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := load(removed); ok {
+		t.Error("session saved with a removed secret should be rejected")
+	}
+
+	if _, err := newSessionStore("unknown", []string{"secret"}); err == nil {
+		t.Error("unknown session store should be an error")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// 退会するときに一度に取得して削除する投稿の数
+const deleteAccountPostsPerBatch = 100
+
+var (
+	errSettingsWrongPassword   = errors.New("wrong password")
+	errSettingsInvalidPassword = errors.New("invalid password")
+	errSettingsInvalidName     = errors.New("invalid account name")
+	errSettingsNameTaken       = errors.New("account name is already taken")
+	errSettingsSameName        = errors.New("account name is unchanged")
+)
+
+// settingsNotices は、/settingsの操作のエラーごとにユーザーに表示するメッセージです。
+// パスワードの確認の失敗が続いた場合は、ログインと同じくloginThrottleのメッセージを表示します。
+var settingsNotices = map[error]string{
+	errSettingsWrongPassword:   "現在のパスワードが間違っています",
+	errSettingsInvalidPassword: "パスワードは6文字以上である必要があります",
+	errSettingsInvalidName:     "アカウント名は3文字以上である必要があります",
+	errSettingsNameTaken:       "アカウント名がすでに使われています",
+	errSettingsSameName:        "現在と同じアカウント名です",
+}
+
+// settingsThrottledError は、パスワードの確認をloginThrottleで制限していることを表します。
+type settingsThrottledError struct {
+	notice string
+}
+
+func (e settingsThrottledError) Error() string { return e.notice }
+
+// settingsNotice は、/settingsの操作のエラーに対応するメッセージを返します。
+func settingsNotice(err error) (string, bool) {
+	var throttled settingsThrottledError
+	if errors.As(err, &throttled) {
+		return throttled.notice, true
+	}
+	notice, ok := settingsNotices[err]
+	return notice, ok
+}
+
+// reauthenticate は、ログインユーザーに現在のパスワードを入力し直させて確認します。
+// セッションを乗っ取られた場合に、パスワードを知らない相手がアカウントを操作できないようにします。
+// ログインと同じくloginThrottleで試行を数えるので、ここでパスワードを総当たりすることもできません。
+func reauthenticate(r *http.Request, me User, password string) (User, error) {
+	ip := clientIP(r)
+	b, blocked, err := loginThrottle.Check(me.AccountName, ip)
+	if err != nil {
+		return User{}, err
+	}
+	if blocked {
+		return User{}, settingsThrottledError{b.Notice(loginThrottle.now())}
+	}
+
+	// キャッシュしたユーザーにはパスワードのハッシュが入っていないことがあるので、Storeから読み込み直す
+	u, err := repo.GetUser(me.ID)
+	if err != nil {
+		return User{}, err
+	}
+	ok, _ := verifyPassword(u, password)
+	if !ok {
+		notice, locked := failLogin(u.AccountName, ip)
+		if locked {
+			return User{}, settingsThrottledError{notice}
+		}
+		return User{}, errSettingsWrongPassword
+	}
+
+	err = loginThrottle.Succeed(u.AccountName)
+	if err != nil {
+		return User{}, err
+	}
+	return u, nil
+}
+
+// changePassword は、パスワードを変更し、ユーザーのすべてのセッションを無効にします。
+func changePassword(u User, newPassword string) error {
+	if !validatePassword(newPassword) {
+		return errSettingsInvalidPassword
+	}
+
+	passhash, err := hashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	err = repo.UpdatePasshash(u.ID, passhash)
+	if err != nil {
+		return err
+	}
+	return revokeAllSessions(u.ID)
+}
+
+// changeAccountName は、アカウント名を変更し、ユーザーのすべてのセッションを無効にします。
+// 旧形式のハッシュはアカウント名をソルトに使っているので、入力されたパスワードでargon2idのハッシュを計算し直します。
+func changeAccountName(u User, accountName, password string) error {
+	if !validateAccountName(accountName) {
+		return errSettingsInvalidName
+	}
+	if accountName == u.AccountName {
+		return errSettingsSameName
+	}
+
+	// 退会・BANされたユーザーのアカウント名も、なりすましを防ぐために使えないままにする
+	exists, err := repo.AccountNameExists(accountName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errSettingsNameTaken
+	}
+
+	passhash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	// 確認した後に他のユーザーが同じアカウント名にした場合は、パスワードのハッシュも変更しない
+	err = repo.UpdateAccountName(u.ID, accountName, passhash)
+	if err == ErrAccountNameTaken {
+		return errSettingsNameTaken
+	}
+	if err != nil {
+		return err
+	}
+	return revokeAllSessions(u.ID)
+}
+
+// deleteAccount は、ユーザーを退会させます。ユーザーの投稿とコメントを論理削除し、すべてのセッションを無効にします。
+// 投稿の一覧は退会していないユーザーの投稿だけを返すので、投稿とコメントを先に削除してからユーザーを削除します。
+func deleteAccount(u User) error {
+	for {
+		posts, err := repo.ListPostsByUser(u.ID, deleteAccountPostsPerBatch)
+		if err != nil {
+			return err
+		}
+		if len(posts) == 0 {
+			break
+		}
+		for _, p := range posts {
+			err = deletePost(p)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	comments, err := repo.ListCommentsByUser(u.ID)
+	if err != nil {
+		return err
+	}
+	for _, c := range comments {
+		err = deleteComment(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = repo.DeleteUser(u.ID)
+	if err != nil {
+		return err
+	}
+	return revokeAllSessions(u.ID)
+}
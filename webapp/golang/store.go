@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotFound は、Storeに該当するレコードが存在しないことを表します。
+var ErrNotFound = errors.New("store: not found")
+
+// ErrAccountNameTaken は、アカウント名が他のユーザーに使われていて変更できないことを表します。
+var ErrAccountNameTaken = errors.New("store: account name is already taken")
+
+// 初期データのIDの範囲です。Initializeはこれより大きいIDのレコードを削除して初期状態に戻します。
+const (
+	seedUserMaxID    = 1000
+	seedPostMaxID    = 10000
+	seedCommentMaxID = 100000
+)
+
+// Storeは、ハンドラーが扱うユーザー・投稿・コメント・BANの永続化を抽象化したインターフェースです。
+// MySQLを使う実装(mysqlStore)と、DBなしで動くインメモリ実装(memoryStore)があります。
+//
+// 投稿の一覧系メソッドは、BANされたユーザー(del_flg = 1)の投稿と削除された投稿(posts.del_flg = 1)を含まず、
+// 作成日時の降順(同じ作成日時の場合はIDの降順)で返します。返すPostにはUserが埋め込まれていますが、Imgdataは含みません。
+type Store interface {
+	// Initialize は、ベンチマーカーの/initializeで呼ばれ、データを初期状態に戻します。
+	Initialize() error
+
+	// GetUser は、IDに一致するユーザーをBANの有無に関わらず返します。
+	GetUser(id int) (User, error)
+	// GetActiveUserByAccountName は、BANされていないユーザーをアカウント名で検索します。
+	GetActiveUserByAccountName(accountName string) (User, error)
+	// AccountNameExists は、アカウント名がすでに使われているかを返します。
+	AccountNameExists(accountName string) (bool, error)
+	// CreateUser は、ユーザーを作成して採番されたIDを返します。
+	CreateUser(accountName, passhash string) (int, error)
+	// UpdatePasshash は、ユーザーのパスワードのハッシュを置き換えます。
+	UpdatePasshash(id int, passhash string) error
+	// UpdateAccountName は、ユーザーのアカウント名とパスワードのハッシュを同時に変更します。
+	// 旧形式のハッシュはアカウント名をソルトに使っているので、どちらか一方だけが変わることはありません。
+	// アカウント名が他のユーザーに使われている場合はErrAccountNameTakenを返します。
+	UpdateAccountName(id int, accountName, passhash string) error
+	// DeleteUser は、退会したユーザーを論理削除(del_flg = 2)します。投稿とコメントは別に削除してください。
+	DeleteUser(id int) error
+	// UpdateProfile は、ユーザーの表示名、自己紹介、アバター画像のキーを変更します。
+	UpdateProfile(id int, displayName, bio, avatarKey string) error
+	// CountUsersWithAvatarKey は、アバター画像のキーが一致するユーザーの数を返します。
+	CountUsersWithAvatarKey(key string) (int, error)
+	// ListAvatarKeys は、ユーザーに設定されているアバター画像のキーを重複なく返します。
+	ListAvatarKeys() ([]string, error)
+	// IncrementSessionVersion は、ユーザーのsession_versionを1つ進めます。
+	IncrementSessionVersion(id int) error
+	// ListBannableUsers は、管理者画面でBAN対象として表示するユーザーを作成日時の降順で返します。
+	ListBannableUsers() ([]User, error)
+	// BanUser は、ユーザーをBAN(del_flg = 1)します。
+	BanUser(id int) error
+	// UnbanUser は、ユーザーのBANを解除(del_flg = 0)します。
+	UnbanUser(id int) error
+	// ListBannedUsers は、管理者画面でBAN解除の対象として表示するBANされたユーザーを作成日時の降順で返します。
+	ListBannedUsers() ([]User, error)
+	// SetUserAuthority は、ユーザーの役割(users.authority)を変更します。
+	SetUserAuthority(id, authority int) error
+	// ListStaffUsers は、一般ユーザー以外の役割を持つユーザーを作成日時の降順で返します。BANされたユーザーも含みます。
+	ListStaffUsers() ([]User, error)
+	// AppendModerationLog は、モデレーション操作の監査ログを追記します。
+	AppendModerationLog(l ModerationLog) error
+	// ListModerationLogs は、filterに一致する監査ログを新しい順に最大limit件返します。
+	ListModerationLogs(filter ModerationLogFilter, limit int) ([]ModerationLog, error)
+
+	// CreateReport は、未対応の通報を作成して採番されたIDを返します。
+	CreateReport(reporterID, postID, commentID int, reason string) (int, error)
+	// GetReport は、通報をIDで取得します。返すReportにはReporterが埋め込まれています。
+	GetReport(id int) (Report, error)
+	// ListOpenReports は、未対応の通報を古い順に最大limit件返します。返すReportにはReporterが埋め込まれています。
+	ListOpenReports(limit int) ([]Report, error)
+	// CountOpenReports は、未対応の通報の数を返します。
+	CountOpenReports() (int, error)
+	// ResolveReports は、投稿(commentIDが0の場合)またはコメントへの未対応の通報をすべてstatusにします。
+	ResolveReports(postID, commentID int, status string, resolvedBy int) error
+
+	// RecordLoginLockout は、アカウントをuntilまでロックしたことを記録します。すでに記録がある場合は期限を更新します。
+	RecordLoginLockout(accountName string, until time.Time) error
+	// ListLoginLockouts は、nowの時点でロックされているアカウントを期限の遅い順に返します。
+	ListLoginLockouts(now time.Time) ([]LoginLockout, error)
+	// DeleteLoginLockout は、アカウントのロックの記録を削除します。
+	DeleteLoginLockout(accountName string) error
+
+	// ListPosts は、cursorより後ろ(古い側)の投稿を最大limit件返します。
+	// cursorがゼロ値の場合は最新の投稿から返します。
+	ListPosts(cursor PostCursor, limit int) ([]Post, error)
+	// ListPostsByUser は、指定したユーザーの投稿を最大limit件返します。
+	// limitが0以下の場合はすべての投稿を返します。
+	ListPostsByUser(userID int, limit int) ([]Post, error)
+	// ListFollowingPosts は、ユーザーがフォローしているユーザーの投稿のうち、cursorより後ろ(古い側)の投稿を最大limit件返します。
+	// cursorがゼロ値の場合は最新の投稿から返します。
+	ListFollowingPosts(userID int, cursor PostCursor, limit int) ([]Post, error)
+	// ListPostsByTag は、タグが付いた投稿のうち、cursorより後ろ(古い側)の投稿を最大limit件返します。
+	// cursorがゼロ値の場合は最新の投稿から返します。
+	ListPostsByTag(tag string, cursor PostCursor, limit int) ([]Post, error)
+	// GetPost は、BANされていないユーザーの削除されていない投稿をIDで取得します。
+	GetPost(id int) (Post, error)
+	// GetPostImage は、画像の配信に必要なMimeとImageKeyを含む投稿をIDで取得します。
+	// ImageStoreに移行していない(ImageKeyが空の)投稿の場合のみ、Imgdataに画像データを含みます。
+	// 削除された投稿はErrNotFoundになります。
+	GetPostImage(id int) (Post, error)
+	// CreatePost は、画像のない投稿を作成して採番されたIDを返します。
+	// 画像はImageStoreに保存し、SetPostImageKeyでキーを記録します。
+	CreatePost(userID int, mime string, body string) (int, error)
+	// SetPostImageKey は、投稿の画像のImageStoreでのキーを記録します。
+	SetPostImageKey(id int, key string) error
+	// AddPostTags は、投稿に付いたタグを記録します。タグはnormalizeHashtagで正規化したものを渡します。
+	AddPostTags(postID int, tags []string) error
+	// DeletePost は、投稿を論理削除(del_flg = 1)します。
+	// 削除された投稿に付いたコメントは、一覧とコメント数の集計に含まれなくなります。
+	DeletePost(id int) error
+	// CountPostsWithImageKey は、画像のキーを使っている削除されていない投稿の数を返します。
+	// 内容が同じ画像を共有するImageStoreで、画像を削除してよいかの判断に使います。
+	CountPostsWithImageKey(key string) (int, error)
+	// CountPostsByUser は、ユーザーの削除されていない投稿数を返します。
+	CountPostsByUser(userID int) (int, error)
+
+	// コメントの一覧系メソッドと集計系メソッドは、削除されたコメント(comments.del_flg = 1)を含みません。
+
+	// ListComments は、投稿に付いたコメントを作成日時の降順で返します。
+	// limitが0以下の場合はすべてのコメントを返します。
+	ListComments(postID int, limit int) ([]Comment, error)
+	// CountComments は、投稿に付いたコメント数を返します。
+	CountComments(postID int) (int, error)
+	// ListCommentsByUser は、ユーザーが書いた削除されていないコメントを古い順に返します。
+	ListCommentsByUser(userID int) ([]Comment, error)
+	// CountCommentsByUser は、ユーザーが削除されていない投稿に書いたコメント数を返します。
+	CountCommentsByUser(userID int) (int, error)
+	// CountCommentsOnUserPosts は、ユーザーの削除されていない投稿に付いたコメント数を返します。
+	CountCommentsOnUserPosts(userID int) (int, error)
+	// CreateComment は、コメントを作成して採番されたIDを返します。
+	CreateComment(postID, userID int, comment string) (int, error)
+	// GetComment は、削除されていない投稿に付いた削除されていないコメントをIDで取得します。
+	GetComment(id int) (Comment, error)
+	// UpdateComment は、コメントの本文を書き換え、編集日時(edited_at)を記録します。
+	UpdateComment(id int, comment string) error
+	// DeleteComment は、コメントを論理削除(del_flg = 1)します。
+	DeleteComment(id int) error
+
+	// LikePost は、ユーザーが投稿にいいねしたことを記録し、新しく記録したかを返します。
+	// すでにいいねしている場合は何もせずにfalseを返します。
+	LikePost(postID, userID int) (bool, error)
+	// UnlikePost は、ユーザーの投稿へのいいねを取り消します。いいねしていない場合は何もしません。
+	UnlikePost(postID, userID int) error
+	// CountLikes は、投稿のいいね数を返します。
+	CountLikes(postID int) (int, error)
+	// ListLikedPostIDs は、postIDsのうちユーザーがいいねしている投稿のIDを返します。
+	ListLikedPostIDs(userID int, postIDs []int) ([]int, error)
+
+	// Follow は、followerIDのユーザーがfolloweeIDのユーザーをフォローしたことを記録します。すでにフォローしている場合は何もしません。
+	Follow(followerID, followeeID int) error
+	// Unfollow は、フォローを解除します。フォローしていない場合は何もしません。
+	Unfollow(followerID, followeeID int) error
+	// IsFollowing は、followerIDのユーザーがfolloweeIDのユーザーをフォローしているかを返します。
+	IsFollowing(followerID, followeeID int) (bool, error)
+	// CountFollows は、ユーザーがフォローしているユーザーの数とフォロワーの数を返します。BANされたユーザーは数えません。
+	CountFollows(userID int) (following int, followers int, err error)
+
+	// 通知の一覧系メソッドと集計系メソッドは、BANされたユーザーからの通知と削除された投稿の通知を含みません。
+
+	// CreateNotification は、通知を未読として作成します。
+	CreateNotification(n Notification) error
+	// ListNotifications は、ユーザーへの通知を新しい順に最大limit件返します。返すNotificationにはActorが埋め込まれています。
+	ListNotifications(userID int, limit int) ([]Notification, error)
+	// CountUnreadNotifications は、ユーザーへの未読の通知の数を返します。
+	CountUnreadNotifications(userID int) (int, error)
+	// MarkNotificationsRead は、ユーザーへの通知をすべて既読にします。
+	MarkNotificationsRead(userID int) error
+}
@@ -0,0 +1,909 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStoreは、DBを使わずにプロセス内のメモリだけで動くStoreの実装です。
+// ハンドラーのテストや、MySQLを用意せずに手元で動かすときに使います。
+type memoryStore struct {
+	mu       sync.RWMutex
+	users    []User
+	posts    []Post
+	comments []Comment
+	likes    map[memoryLike]bool
+	follows  map[memoryFollow]bool
+	postTags map[memoryPostTag]bool
+
+	notifications  []Notification
+	moderationLogs []ModerationLog
+	reports        []Report
+	loginLockouts  map[string]time.Time
+}
+
+type memoryLike struct {
+	PostID int
+	UserID int
+}
+
+type memoryPostTag struct {
+	PostID int
+	Tag    string
+}
+
+type memoryFollow struct {
+	FollowerID int
+	FolloweeID int
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{}
+}
+
+// now は、MySQLのtimestamp型に合わせて秒単位に丸めた現在時刻を返します。
+func (s *memoryStore) now() time.Time {
+	return time.Now().Truncate(time.Second)
+}
+
+func (s *memoryStore) Initialize() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.users = nil
+	s.posts = nil
+	s.comments = nil
+	s.likes = nil
+	s.follows = nil
+	s.postTags = nil
+	s.notifications = nil
+	s.moderationLogs = nil
+	s.reports = nil
+	s.loginLockouts = nil
+	return nil
+}
+
+func (s *memoryStore) userByID(id int) (User, bool) {
+	if id <= 0 || id > len(s.users) {
+		return User{}, false
+	}
+	return s.users[id-1], true
+}
+
+func (s *memoryStore) GetUser(id int) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.userByID(id)
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return u, nil
+}
+
+func (s *memoryStore) GetActiveUserByAccountName(accountName string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, u := range s.users {
+		if u.AccountName == accountName && u.DelFlg == 0 {
+			return u, nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+func (s *memoryStore) AccountNameExists(accountName string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, u := range s.users {
+		if u.AccountName == accountName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStore) CreateUser(accountName, passhash string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u := User{
+		ID:          len(s.users) + 1,
+		AccountName: accountName,
+		Passhash:    passhash,
+		CreatedAt:   s.now(),
+	}
+	s.users = append(s.users, u)
+	return u.ID, nil
+}
+
+func (s *memoryStore) UpdatePasshash(id int, passhash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.userByID(id); !ok {
+		return nil
+	}
+	s.users[id-1].Passhash = passhash
+	return nil
+}
+
+func (s *memoryStore) UpdateAccountName(id int, accountName, passhash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.userByID(id); !ok {
+		return nil
+	}
+	for _, u := range s.users {
+		if u.ID != id && u.AccountName == accountName {
+			return ErrAccountNameTaken
+		}
+	}
+	s.users[id-1].AccountName = accountName
+	s.users[id-1].Passhash = passhash
+	return nil
+}
+
+func (s *memoryStore) DeleteUser(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.userByID(id); !ok {
+		return nil
+	}
+	s.users[id-1].DelFlg = userDeleted
+	return nil
+}
+
+func (s *memoryStore) UpdateProfile(id int, displayName, bio, avatarKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.userByID(id); !ok {
+		return nil
+	}
+	s.users[id-1].DisplayName = displayName
+	s.users[id-1].Bio = bio
+	s.users[id-1].AvatarKey = avatarKey
+	return nil
+}
+
+func (s *memoryStore) CountUsersWithAvatarKey(key string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, u := range s.users {
+		if u.AvatarKey == key {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryStore) ListAvatarKeys() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := []string{}
+	seen := map[string]bool{}
+	for _, u := range s.users {
+		if u.AvatarKey == "" || seen[u.AvatarKey] {
+			continue
+		}
+		seen[u.AvatarKey] = true
+		keys = append(keys, u.AvatarKey)
+	}
+	return keys, nil
+}
+
+func (s *memoryStore) IncrementSessionVersion(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.userByID(id); !ok {
+		return nil
+	}
+	s.users[id-1].SessionVersion++
+	return nil
+}
+
+func (s *memoryStore) ListBannableUsers() ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := []User{}
+	for i := len(s.users) - 1; i >= 0; i-- {
+		u := s.users[i]
+		if u.Authority == 0 && u.DelFlg == 0 {
+			users = append(users, u)
+		}
+	}
+	sort.SliceStable(users, func(i, j int) bool {
+		return users[i].CreatedAt.After(users[j].CreatedAt)
+	})
+	return users, nil
+}
+
+func (s *memoryStore) BanUser(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.userByID(id); !ok {
+		return nil
+	}
+	s.users[id-1].DelFlg = userBanned
+	return nil
+}
+
+func (s *memoryStore) UnbanUser(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.userByID(id); !ok {
+		return nil
+	}
+	s.users[id-1].DelFlg = userActive
+	return nil
+}
+
+func (s *memoryStore) ListBannedUsers() ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := []User{}
+	for i := len(s.users) - 1; i >= 0; i-- {
+		u := s.users[i]
+		if u.Authority == 0 && u.DelFlg == userBanned {
+			users = append(users, u)
+		}
+	}
+	sort.SliceStable(users, func(i, j int) bool {
+		return users[i].CreatedAt.After(users[j].CreatedAt)
+	})
+	return users, nil
+}
+
+func (s *memoryStore) SetUserAuthority(id, authority int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.userByID(id); !ok {
+		return nil
+	}
+	s.users[id-1].Authority = authority
+	return nil
+}
+
+func (s *memoryStore) ListStaffUsers() ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := []User{}
+	for i := len(s.users) - 1; i >= 0; i-- {
+		if s.users[i].Authority != 0 {
+			users = append(users, s.users[i])
+		}
+	}
+	sort.SliceStable(users, func(i, j int) bool {
+		return users[i].CreatedAt.After(users[j].CreatedAt)
+	})
+	return users, nil
+}
+
+// postByID は、削除されていない投稿を返します。
+func (s *memoryStore) postByID(id int) (Post, bool) {
+	if id <= 0 || id > len(s.posts) || s.posts[id-1].DelFlg != 0 {
+		return Post{}, false
+	}
+	return s.posts[id-1], true
+}
+
+// withUser は、投稿にユーザーを埋め込み、画像データを取り除いたコピーを返します。
+// 削除された投稿とBANされたユーザーの投稿の場合はfalseを返します。
+func (s *memoryStore) withUser(p Post) (Post, bool) {
+	if p.DelFlg != 0 {
+		return Post{}, false
+	}
+	u, ok := s.userByID(p.UserID)
+	if !ok || u.DelFlg != 0 {
+		return Post{}, false
+	}
+	p.User = u
+	p.Imgdata = nil
+	return p, true
+}
+
+// selectPosts は、条件に一致する投稿を作成日時の降順で最大limit件返します。
+func (s *memoryStore) selectPosts(limit int, match func(p Post) bool) []Post {
+	results := []Post{}
+	for i := len(s.posts) - 1; i >= 0; i-- {
+		if !match(s.posts[i]) {
+			continue
+		}
+		p, ok := s.withUser(s.posts[i])
+		if !ok {
+			continue
+		}
+		results = append(results, p)
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].CreatedAt.Equal(results[j].CreatedAt) {
+			return results[i].ID > results[j].ID
+		}
+		return results[i].CreatedAt.After(results[j].CreatedAt)
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+func (s *memoryStore) ListPosts(cursor PostCursor, limit int) ([]Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.selectPosts(limit, cursor.Before), nil
+}
+
+func (s *memoryStore) ListPostsByUser(userID int, limit int) ([]Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.selectPosts(limit, func(p Post) bool {
+		return p.UserID == userID
+	}), nil
+}
+
+func (s *memoryStore) ListFollowingPosts(userID int, cursor PostCursor, limit int) ([]Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.selectPosts(limit, func(p Post) bool {
+		return s.follows[memoryFollow{FollowerID: userID, FolloweeID: p.UserID}] && cursor.Before(p)
+	}), nil
+}
+
+func (s *memoryStore) ListPostsByTag(tag string, cursor PostCursor, limit int) ([]Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.selectPosts(limit, func(p Post) bool {
+		return s.postTags[memoryPostTag{PostID: p.ID, Tag: tag}] && cursor.Before(p)
+	}), nil
+}
+
+func (s *memoryStore) GetPost(id int) (Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if id <= 0 || id > len(s.posts) {
+		return Post{}, ErrNotFound
+	}
+	p, ok := s.withUser(s.posts[id-1])
+	if !ok {
+		return Post{}, ErrNotFound
+	}
+	return p, nil
+}
+
+func (s *memoryStore) GetPostImage(id int) (Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := s.postByID(id)
+	if !ok {
+		return Post{}, ErrNotFound
+	}
+	return p, nil
+}
+
+func (s *memoryStore) CreatePost(userID int, mime string, body string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := Post{
+		ID:        len(s.posts) + 1,
+		UserID:    userID,
+		Body:      body,
+		Mime:      mime,
+		CreatedAt: s.now(),
+	}
+	s.posts = append(s.posts, p)
+	return p.ID, nil
+}
+
+func (s *memoryStore) SetPostImageKey(id int, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id <= 0 || id > len(s.posts) {
+		return ErrNotFound
+	}
+	s.posts[id-1].ImageKey = key
+	return nil
+}
+
+func (s *memoryStore) AddPostTags(postID int, tags []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.postTags == nil {
+		s.postTags = map[memoryPostTag]bool{}
+	}
+	for _, tag := range tags {
+		s.postTags[memoryPostTag{PostID: postID, Tag: tag}] = true
+	}
+	return nil
+}
+
+func (s *memoryStore) DeletePost(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id <= 0 || id > len(s.posts) {
+		return nil
+	}
+	s.posts[id-1].DelFlg = 1
+	return nil
+}
+
+func (s *memoryStore) CountPostsWithImageKey(key string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, p := range s.posts {
+		if p.ImageKey == key && p.DelFlg == 0 {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryStore) CountPostsByUser(userID int) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, p := range s.posts {
+		if p.UserID == userID && p.DelFlg == 0 {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryStore) ListComments(postID int, limit int) ([]Comment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	comments := []Comment{}
+	for i := len(s.comments) - 1; i >= 0; i-- {
+		c := s.comments[i]
+		if c.PostID != postID || c.DelFlg != 0 {
+			continue
+		}
+		c.User, _ = s.userByID(c.UserID)
+		comments = append(comments, c)
+	}
+	sort.SliceStable(comments, func(i, j int) bool {
+		return comments[i].CreatedAt.After(comments[j].CreatedAt)
+	})
+	if limit > 0 && len(comments) > limit {
+		comments = comments[:limit]
+	}
+	return comments, nil
+}
+
+func (s *memoryStore) CountComments(postID int) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, c := range s.comments {
+		if c.PostID == postID && c.DelFlg == 0 {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryStore) ListCommentsByUser(userID int) ([]Comment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	comments := []Comment{}
+	for _, c := range s.comments {
+		if c.UserID == userID && c.DelFlg == 0 {
+			c.User, _ = s.userByID(c.UserID)
+			comments = append(comments, c)
+		}
+	}
+	return comments, nil
+}
+
+func (s *memoryStore) CountCommentsByUser(userID int) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, c := range s.comments {
+		if _, ok := s.postByID(c.PostID); ok && c.UserID == userID && c.DelFlg == 0 {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryStore) CountCommentsOnUserPosts(userID int) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, c := range s.comments {
+		if p, ok := s.postByID(c.PostID); ok && p.UserID == userID && c.DelFlg == 0 {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryStore) CreateComment(postID, userID int, comment string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := Comment{
+		ID:        len(s.comments) + 1,
+		PostID:    postID,
+		UserID:    userID,
+		Comment:   comment,
+		CreatedAt: s.now(),
+	}
+	s.comments = append(s.comments, c)
+	return c.ID, nil
+}
+
+func (s *memoryStore) GetComment(id int) (Comment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if id <= 0 || id > len(s.comments) || s.comments[id-1].DelFlg != 0 {
+		return Comment{}, ErrNotFound
+	}
+	c := s.comments[id-1]
+	if _, ok := s.postByID(c.PostID); !ok {
+		return Comment{}, ErrNotFound
+	}
+	c.User, _ = s.userByID(c.UserID)
+	return c, nil
+}
+
+func (s *memoryStore) UpdateComment(id int, comment string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id <= 0 || id > len(s.comments) {
+		return nil
+	}
+	now := s.now()
+	s.comments[id-1].Comment = comment
+	s.comments[id-1].EditedAt = &now
+	return nil
+}
+
+func (s *memoryStore) DeleteComment(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id <= 0 || id > len(s.comments) {
+		return nil
+	}
+	s.comments[id-1].DelFlg = 1
+	return nil
+}
+
+func (s *memoryStore) LikePost(postID, userID int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.likes == nil {
+		s.likes = map[memoryLike]bool{}
+	}
+	like := memoryLike{PostID: postID, UserID: userID}
+	if s.likes[like] {
+		return false, nil
+	}
+	s.likes[like] = true
+	return true, nil
+}
+
+func (s *memoryStore) UnlikePost(postID, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.likes, memoryLike{PostID: postID, UserID: userID})
+	return nil
+}
+
+func (s *memoryStore) CountLikes(postID int) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for l := range s.likes {
+		if l.PostID == postID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryStore) ListLikedPostIDs(userID int, postIDs []int) ([]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := []int{}
+	for _, id := range postIDs {
+		if s.likes[memoryLike{PostID: id, UserID: userID}] {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (s *memoryStore) Follow(followerID, followeeID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.follows == nil {
+		s.follows = map[memoryFollow]bool{}
+	}
+	s.follows[memoryFollow{FollowerID: followerID, FolloweeID: followeeID}] = true
+	return nil
+}
+
+func (s *memoryStore) Unfollow(followerID, followeeID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.follows, memoryFollow{FollowerID: followerID, FolloweeID: followeeID})
+	return nil
+}
+
+func (s *memoryStore) IsFollowing(followerID, followeeID int) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.follows[memoryFollow{FollowerID: followerID, FolloweeID: followeeID}], nil
+}
+
+func (s *memoryStore) CountFollows(userID int) (int, int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	following, followers := 0, 0
+	for f := range s.follows {
+		if f.FollowerID == userID {
+			if u, ok := s.userByID(f.FolloweeID); ok && u.DelFlg == 0 {
+				following++
+			}
+		}
+		if f.FolloweeID == userID {
+			if u, ok := s.userByID(f.FollowerID); ok && u.DelFlg == 0 {
+				followers++
+			}
+		}
+	}
+	return following, followers, nil
+}
+
+// visibleNotification は、通知をした操作のユーザーと投稿が表示できる場合にActorを埋め込んだ通知を返します。
+func (s *memoryStore) visibleNotification(n Notification) (Notification, bool) {
+	actor, ok := s.userByID(n.ActorID)
+	if !ok || actor.DelFlg != 0 {
+		return Notification{}, false
+	}
+	if id := n.PostID; id <= 0 || id > len(s.posts) || s.posts[id-1].DelFlg != 0 {
+		return Notification{}, false
+	}
+	n.Actor = actor
+	return n, true
+}
+
+func (s *memoryStore) CreateNotification(n Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n.ID = len(s.notifications) + 1
+	n.ReadFlg = 0
+	n.CreatedAt = s.now()
+	s.notifications = append(s.notifications, n)
+	return nil
+}
+
+func (s *memoryStore) ListNotifications(userID int, limit int) ([]Notification, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	notifications := []Notification{}
+	for i := len(s.notifications) - 1; i >= 0 && len(notifications) < limit; i-- {
+		if s.notifications[i].UserID != userID {
+			continue
+		}
+		n, ok := s.visibleNotification(s.notifications[i])
+		if !ok {
+			continue
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, nil
+}
+
+func (s *memoryStore) CountUnreadNotifications(userID int) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, n := range s.notifications {
+		if n.UserID != userID || n.ReadFlg != 0 {
+			continue
+		}
+		if _, ok := s.visibleNotification(n); ok {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryStore) MarkNotificationsRead(userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.notifications {
+		if s.notifications[i].UserID == userID {
+			s.notifications[i].ReadFlg = 1
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) AppendModerationLog(l ModerationLog) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l.ID = len(s.moderationLogs) + 1
+	l.CreatedAt = s.now()
+	s.moderationLogs = append(s.moderationLogs, l)
+	return nil
+}
+
+func (s *memoryStore) ListModerationLogs(filter ModerationLogFilter, limit int) ([]ModerationLog, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	logs := []ModerationLog{}
+	for i := len(s.moderationLogs) - 1; i >= 0 && len(logs) < limit; i-- {
+		if filter.Match(s.moderationLogs[i]) {
+			logs = append(logs, s.moderationLogs[i])
+		}
+	}
+	return logs, nil
+}
+
+func (s *memoryStore) CreateReport(reporterID, postID, commentID int, reason string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rp := Report{
+		ID:         len(s.reports) + 1,
+		ReporterID: reporterID,
+		PostID:     postID,
+		CommentID:  commentID,
+		Reason:     reason,
+		Status:     reportOpen,
+		CreatedAt:  s.now(),
+	}
+	s.reports = append(s.reports, rp)
+	return rp.ID, nil
+}
+
+// withReporter は、通報にReporterを埋め込んで返します。
+func (s *memoryStore) withReporter(rp Report) Report {
+	rp.Reporter, _ = s.userByID(rp.ReporterID)
+	return rp
+}
+
+func (s *memoryStore) GetReport(id int) (Report, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if id <= 0 || id > len(s.reports) {
+		return Report{}, ErrNotFound
+	}
+	return s.withReporter(s.reports[id-1]), nil
+}
+
+func (s *memoryStore) ListOpenReports(limit int) ([]Report, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	reports := []Report{}
+	for _, rp := range s.reports {
+		if len(reports) >= limit {
+			break
+		}
+		if rp.Status == reportOpen {
+			reports = append(reports, s.withReporter(rp))
+		}
+	}
+	return reports, nil
+}
+
+func (s *memoryStore) CountOpenReports() (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, rp := range s.reports {
+		if rp.Status == reportOpen {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryStore) ResolveReports(postID, commentID int, status string, resolvedBy int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, rp := range s.reports {
+		if rp.PostID == postID && rp.CommentID == commentID && rp.Status == reportOpen {
+			s.reports[i].Status = status
+			s.reports[i].ResolvedBy = resolvedBy
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) RecordLoginLockout(accountName string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.loginLockouts == nil {
+		s.loginLockouts = map[string]time.Time{}
+	}
+	s.loginLockouts[accountName] = until
+	return nil
+}
+
+func (s *memoryStore) ListLoginLockouts(now time.Time) ([]LoginLockout, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	lockouts := []LoginLockout{}
+	for accountName, until := range s.loginLockouts {
+		if until.After(now) {
+			lockouts = append(lockouts, LoginLockout{AccountName: accountName, LockedUntil: until})
+		}
+	}
+	sort.Slice(lockouts, func(i, j int) bool {
+		if lockouts[i].LockedUntil.Equal(lockouts[j].LockedUntil) {
+			return lockouts[i].AccountName < lockouts[j].AccountName
+		}
+		return lockouts[i].LockedUntil.After(lockouts[j].LockedUntil)
+	})
+	return lockouts, nil
+}
+
+func (s *memoryStore) DeleteLoginLockout(accountName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.loginLockouts, accountName)
+	return nil
+}
@@ -0,0 +1,745 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// mysqlErrDuplicateEntryは、UNIQUE制約に違反したときのMySQLのエラー番号(ER_DUP_ENTRY)です。
+const mysqlErrDuplicateEntry = 1062
+
+const (
+	userColumns = "`id`, `account_name`, `passhash`, `authority`, `del_flg`, `created_at`, `session_version`, `display_name`, `bio`, `avatar_key`"
+
+	postWithUserColumns = `posts.id as id, posts.user_id as user_id, posts.body as body, posts.mime as mime, posts.image_key as image_key, posts.created_at,
+	users.id as "User.id", users.account_name as "User.account_name", users.authority as "User.authority", users.del_flg as "User.del_flg", users.created_at as "User.created_at",
+	users.display_name as "User.display_name", users.avatar_key as "User.avatar_key"`
+
+	commentWithUserColumns = `comments.id, comments.post_id, comments.user_id, comments.comment, comments.created_at, comments.edited_at,
+	users.id as "User.id", users.account_name as "User.account_name", users.authority as "User.authority", users.del_flg as "User.del_flg", users.created_at as "User.created_at",
+	users.display_name as "User.display_name", users.avatar_key as "User.avatar_key"`
+
+	moderationLogColumns = "`id`, `actor_id`, `actor_account_name`, `target_id`, `target_account_name`, `action`, `detail`, `reason`, `created_at`"
+
+	reportWithReporterColumns = `reports.id, reports.reporter_id, reports.post_id, reports.comment_id, reports.reason, reports.status, reports.resolved_by, reports.created_at,
+	users.id as "Reporter.id", users.account_name as "Reporter.account_name", users.authority as "Reporter.authority", users.del_flg as "Reporter.del_flg", users.created_at as "Reporter.created_at"`
+
+	notificationWithActorColumns = `notifications.id, notifications.user_id, notifications.actor_id, notifications.kind, notifications.post_id, notifications.read_flg, notifications.created_at,
+	users.id as "Actor.id", users.account_name as "Actor.account_name", users.authority as "Actor.authority", users.del_flg as "Actor.del_flg", users.created_at as "Actor.created_at"`
+)
+
+// mysqlStoreは、MySQLを使うStoreの実装です。
+type mysqlStore struct {
+	db *sqlx.DB
+}
+
+func newMySQLStore(db *sqlx.DB) *mysqlStore {
+	return &mysqlStore{db: db}
+}
+
+// notFound は、sql.ErrNoRowsをErrNotFoundに変換します。
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// mysqlMigrationsは、初期データ(dump.sql)のスキーマに対して順に適用するDDLです。
+// 適用済みの件数はschema_migrationsテーブルに記録するので、末尾に追記してください。
+var mysqlMigrations = []string{
+	"ALTER TABLE `posts` ADD COLUMN `image_key` varchar(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE `posts` MODIFY `imgdata` mediumblob NULL",
+	"ALTER TABLE `posts` ADD COLUMN `del_flg` tinyint(1) NOT NULL DEFAULT 0",
+	"ALTER TABLE `comments` ADD COLUMN `edited_at` timestamp NULL DEFAULT NULL, ADD COLUMN `del_flg` tinyint(1) NOT NULL DEFAULT 0",
+	"CREATE TABLE `likes` (`post_id` int NOT NULL, `user_id` int NOT NULL, `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, PRIMARY KEY (`post_id`, `user_id`), KEY `idx_user_id` (`user_id`, `post_id`)) DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE `follows` (`follower_id` int NOT NULL, `followee_id` int NOT NULL, `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, PRIMARY KEY (`follower_id`, `followee_id`), KEY `idx_followee_id` (`followee_id`, `follower_id`)) DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE `post_tags` (`post_id` int NOT NULL, `tag` varchar(64) NOT NULL, PRIMARY KEY (`post_id`, `tag`), KEY `idx_tag` (`tag`, `post_id`)) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin",
+	"ALTER TABLE `posts` ADD FULLTEXT INDEX `ft_body` (`body`) WITH PARSER ngram",
+	"ALTER TABLE `comments` ADD FULLTEXT INDEX `ft_comment` (`comment`) WITH PARSER ngram",
+	"CREATE TABLE `notifications` (`id` int NOT NULL AUTO_INCREMENT PRIMARY KEY, `user_id` int NOT NULL, `actor_id` int NOT NULL, `kind` varchar(16) NOT NULL, `post_id` int NOT NULL, `read_flg` tinyint(1) NOT NULL DEFAULT 0, `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, KEY `idx_user_id` (`user_id`, `read_flg`, `id`)) DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE `moderation_logs` (`id` int NOT NULL AUTO_INCREMENT PRIMARY KEY, `actor_id` int NOT NULL, `actor_account_name` varchar(64) NOT NULL, `target_id` int NOT NULL, `target_account_name` varchar(64) NOT NULL, `action` varchar(16) NOT NULL, `reason` text NOT NULL, `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, KEY `idx_actor_account_name` (`actor_account_name`), KEY `idx_target_account_name` (`target_account_name`)) DEFAULT CHARSET=utf8mb4",
+	"ALTER TABLE `moderation_logs` ADD COLUMN `detail` varchar(64) NOT NULL DEFAULT '' AFTER `action`",
+	"CREATE TABLE `reports` (`id` int NOT NULL AUTO_INCREMENT PRIMARY KEY, `reporter_id` int NOT NULL, `post_id` int NOT NULL, `comment_id` int NOT NULL DEFAULT 0, `reason` varchar(255) NOT NULL DEFAULT '', `status` varchar(16) NOT NULL DEFAULT 'open', `resolved_by` int NOT NULL DEFAULT 0, `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, KEY `idx_status` (`status`, `id`), KEY `idx_target` (`post_id`, `comment_id`, `status`)) DEFAULT CHARSET=utf8mb4",
+	"ALTER TABLE `users` MODIFY `passhash` varchar(255) NOT NULL",
+	"CREATE TABLE `login_lockouts` (`account_name` varchar(64) NOT NULL PRIMARY KEY, `locked_until` datetime NOT NULL, KEY `idx_locked_until` (`locked_until`)) DEFAULT CHARSET=utf8mb4",
+	"ALTER TABLE `users` ADD COLUMN `session_version` int NOT NULL DEFAULT 0",
+	"ALTER TABLE `users` ADD COLUMN `display_name` varchar(64) NOT NULL DEFAULT '', ADD COLUMN `bio` varchar(1000) NOT NULL DEFAULT '', ADD COLUMN `avatar_key` varchar(255) NOT NULL DEFAULT ''",
+	// Initializeで初期データのユーザーのアカウント名とパスワードを戻すために、適用した時点の値を保存する
+	"CREATE TABLE `seed_users` (`id` int NOT NULL PRIMARY KEY, `account_name` varchar(64) NOT NULL, `passhash` varchar(255) NOT NULL) DEFAULT CHARSET=utf8mb4",
+	fmt.Sprintf("INSERT INTO `seed_users` (`id`, `account_name`, `passhash`) SELECT `id`, `account_name`, `passhash` FROM `users` WHERE `id` <= %d", seedUserMaxID),
+}
+
+// schemaMigrationsLockは、複数のプロセスが同時にmysqlMigrationsを適用しないようにするGET_LOCKの名前です。
+const schemaMigrationsLock = "isuconp_schema_migrations"
+
+// schemaMigrationsLockTimeoutは、他のプロセスの適用が終わるのを待つ秒数です。
+// 初期データのpostsテーブルの変更には数分かかることがあります。
+const schemaMigrationsLockTimeout = 30 * 60
+
+func createSchemaMigrationsTable(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS `schema_migrations` (`version` int NOT NULL PRIMARY KEY, `applied_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP)")
+	return err
+}
+
+// Migrate は、未適用のmysqlMigrationsを適用します。`app migrate schema`から呼び出します。
+// 適用中はGET_LOCKで他のプロセスの適用を待たせます。markAppliedが0より大きい場合は、
+// DDLを実行せずにその番号までを適用済みとして記録します。DDLの実行後に記録できずに止まった場合に、
+// 手動で確認してから使います。
+func (s *mysqlStore) Migrate(markApplied int, logf func(format string, args ...any)) error {
+	ctx := context.Background()
+	// GET_LOCKは接続ごとのロックなので、同じ接続で適用する
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	locked := 0
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", schemaMigrationsLock, schemaMigrationsLockTimeout).Scan(&locked)
+	if err != nil {
+		return err
+	}
+	if locked != 1 {
+		return errors.New("timed out waiting for another migration to finish")
+	}
+	defer conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", schemaMigrationsLock)
+
+	err = createSchemaMigrationsTable(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	applied := 0
+	err = conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM `schema_migrations`").Scan(&applied)
+	if err != nil {
+		return err
+	}
+	if markApplied > len(mysqlMigrations) {
+		return fmt.Errorf("migration %d does not exist", markApplied)
+	}
+
+	for i := applied; i < len(mysqlMigrations); i++ {
+		if i < markApplied {
+			logf("marking migration %d as applied", i+1)
+		} else {
+			logf("applying migration %d", i+1)
+			// DDLは暗黙にコミットされるので、記録に失敗した場合は-mark-appliedで記録し直す
+			_, err := conn.ExecContext(ctx, mysqlMigrations[i])
+			if err != nil {
+				return fmt.Errorf("migration %d: %w", i+1, err)
+			}
+		}
+		_, err = conn.ExecContext(ctx, "INSERT INTO `schema_migrations` (`version`) VALUES (?)", i+1)
+		if err != nil {
+			return fmt.Errorf("migration %d was applied but could not be recorded (rerun with -mark-applied %d after checking the schema): %w", i+1, i+1, err)
+		}
+	}
+	return nil
+}
+
+// CheckSchema は、mysqlMigrationsがすべて適用済みかを確認します。サーバーの起動時に呼び出します。
+// サーバーはDDLを実行しないので、未適用の場合は`app migrate schema`を実行してから起動し直します。
+func (s *mysqlStore) CheckSchema() error {
+	applied := 0
+	err := s.db.Get(&applied, "SELECT COUNT(*) FROM `schema_migrations`")
+	if err != nil {
+		return fmt.Errorf("schema version is unknown (run `app migrate schema`): %w", err)
+	}
+	if applied != len(mysqlMigrations) {
+		return fmt.Errorf("schema version is %d, want %d (run `app migrate schema`)", applied, len(mysqlMigrations))
+	}
+	return nil
+}
+
+func (s *mysqlStore) Initialize() error {
+	sqls := []string{
+		fmt.Sprintf("DELETE FROM users WHERE id > %d", seedUserMaxID),
+		fmt.Sprintf("DELETE FROM posts WHERE id > %d", seedPostMaxID),
+		fmt.Sprintf("DELETE FROM comments WHERE id > %d", seedCommentMaxID),
+		"DELETE FROM likes",
+		"DELETE FROM follows",
+		fmt.Sprintf("DELETE FROM post_tags WHERE post_id > %d", seedPostMaxID),
+		"DELETE FROM notifications",
+		"DELETE FROM reports",
+		"DELETE FROM login_lockouts",
+		"UPDATE users SET del_flg = 0, display_name = '', bio = '', avatar_key = ''",
+		"UPDATE users SET del_flg = 1 WHERE id % 50 = 0",
+		// 初期データでは、IDが10未満のユーザーだけが管理者
+		"UPDATE users SET authority = IF(id < 10, 1, 0)",
+		// revokeAllSessionsで無効にしたセッションも再び有効になるが、/initializeはベンチマークの前にだけ呼ばれる前提とする
+		"UPDATE users SET session_version = 0 WHERE session_version <> 0",
+		// /settingsで変更されたアカウント名とパスワードを戻す。アカウント名を入れ替えた場合にUNIQUE制約に違反しないよう、
+		// 変更されたアカウント名を一度ほかと重ならない名前にしてから戻す
+		"UPDATE users JOIN seed_users ON users.id = seed_users.id SET users.account_name = CONCAT('#', users.id) WHERE users.account_name <> seed_users.account_name",
+		"UPDATE users JOIN seed_users ON users.id = seed_users.id SET users.account_name = seed_users.account_name, users.passhash = seed_users.passhash WHERE users.account_name <> seed_users.account_name OR users.passhash <> seed_users.passhash",
+		"UPDATE posts SET del_flg = 0 WHERE del_flg <> 0",
+		// 編集されたコメントの本文は元に戻せないので、編集済みの表示だけを取り消す
+		fmt.Sprintf("UPDATE comments SET del_flg = 0, edited_at = NULL WHERE id <= %d AND (del_flg <> 0 OR edited_at IS NOT NULL)", seedCommentMaxID),
+	}
+
+	// 途中で失敗しても残りの初期化は行い、失敗したものをまとめて返す
+	var errs []error
+	for _, sql := range sqls {
+		if _, err := s.db.Exec(sql); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *mysqlStore) GetUser(id int) (User, error) {
+	u := User{}
+	err := s.db.Get(&u, "SELECT "+userColumns+" FROM `users` WHERE `id` = ?", id)
+	return u, notFound(err)
+}
+
+func (s *mysqlStore) GetActiveUserByAccountName(accountName string) (User, error) {
+	u := User{}
+	err := s.db.Get(&u, "SELECT "+userColumns+" FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", accountName)
+	return u, notFound(err)
+}
+
+func (s *mysqlStore) AccountNameExists(accountName string) (bool, error) {
+	exists := 0
+	err := s.db.Get(&exists, "SELECT 1 FROM `users` WHERE `account_name` = ?", accountName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return exists == 1, nil
+}
+
+func (s *mysqlStore) CreateUser(accountName, passhash string) (int, error) {
+	query := "INSERT INTO `users` (`account_name`, `passhash`) VALUES (?,?)"
+	result, err := s.db.Exec(query, accountName, passhash)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func (s *mysqlStore) UpdatePasshash(id int, passhash string) error {
+	_, err := s.db.Exec("UPDATE `users` SET `passhash` = ? WHERE `id` = ?", passhash, id)
+	return err
+}
+
+func (s *mysqlStore) UpdateAccountName(id int, accountName, passhash string) error {
+	_, err := s.db.Exec("UPDATE `users` SET `account_name` = ?, `passhash` = ? WHERE `id` = ?", accountName, passhash, id)
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDuplicateEntry {
+		return ErrAccountNameTaken
+	}
+	return err
+}
+
+func (s *mysqlStore) DeleteUser(id int) error {
+	_, err := s.db.Exec("UPDATE `users` SET `del_flg` = ? WHERE `id` = ?", userDeleted, id)
+	return err
+}
+
+func (s *mysqlStore) UpdateProfile(id int, displayName, bio, avatarKey string) error {
+	_, err := s.db.Exec("UPDATE `users` SET `display_name` = ?, `bio` = ?, `avatar_key` = ? WHERE `id` = ?", displayName, bio, avatarKey, id)
+	return err
+}
+
+func (s *mysqlStore) CountUsersWithAvatarKey(key string) (int, error) {
+	count := 0
+	err := s.db.Get(&count, "SELECT COUNT(*) AS count FROM `users` WHERE `avatar_key` = ?", key)
+	return count, err
+}
+
+func (s *mysqlStore) ListAvatarKeys() ([]string, error) {
+	keys := []string{}
+	err := s.db.Select(&keys, "SELECT DISTINCT `avatar_key` FROM `users` WHERE `avatar_key` <> ''")
+	return keys, err
+}
+
+func (s *mysqlStore) IncrementSessionVersion(id int) error {
+	_, err := s.db.Exec("UPDATE `users` SET `session_version` = `session_version` + 1 WHERE `id` = ?", id)
+	return err
+}
+
+func (s *mysqlStore) ListBannableUsers() ([]User, error) {
+	users := []User{}
+	err := s.db.Select(&users, "SELECT "+userColumns+" FROM `users` WHERE `authority` = 0 AND `del_flg` = 0 ORDER BY `created_at` DESC")
+	return users, err
+}
+
+func (s *mysqlStore) BanUser(id int) error {
+	_, err := s.db.Exec("UPDATE `users` SET `del_flg` = ? WHERE `id` = ?", userBanned, id)
+	return err
+}
+
+func (s *mysqlStore) UnbanUser(id int) error {
+	_, err := s.db.Exec("UPDATE `users` SET `del_flg` = ? WHERE `id` = ?", userActive, id)
+	return err
+}
+
+func (s *mysqlStore) ListBannedUsers() ([]User, error) {
+	users := []User{}
+	err := s.db.Select(&users, "SELECT "+userColumns+" FROM `users` WHERE `authority` = 0 AND `del_flg` = 1 ORDER BY `created_at` DESC")
+	return users, err
+}
+
+func (s *mysqlStore) SetUserAuthority(id, authority int) error {
+	_, err := s.db.Exec("UPDATE `users` SET `authority` = ? WHERE `id` = ?", authority, id)
+	return err
+}
+
+func (s *mysqlStore) ListStaffUsers() ([]User, error) {
+	users := []User{}
+	err := s.db.Select(&users, "SELECT "+userColumns+" FROM `users` WHERE `authority` != 0 ORDER BY `created_at` DESC")
+	return users, err
+}
+
+func (s *mysqlStore) ListPosts(cursor PostCursor, limit int) ([]Post, error) {
+	results := []Post{}
+	if cursor.IsZero() {
+		query := `SELECT ` + postWithUserColumns + `
+		FROM posts
+		JOIN users ON posts.user_id = users.id
+		WHERE users.del_flg = 0 AND posts.del_flg = 0
+		ORDER BY posts.created_at DESC, posts.id DESC
+		LIMIT ?`
+		err := s.db.Select(&results, query, limit)
+		return results, err
+	}
+
+	query := `SELECT ` + postWithUserColumns + `
+	FROM posts
+	JOIN users ON posts.user_id = users.id
+	WHERE users.del_flg = 0 AND posts.del_flg = 0 AND
+	(posts.created_at < ? OR (posts.created_at = ? AND posts.id < ?))
+	ORDER BY posts.created_at DESC, posts.id DESC
+	LIMIT ?`
+	err := s.db.Select(&results, query, cursor.CreatedAt, cursor.CreatedAt, cursor.ID, limit)
+	return results, err
+}
+
+func (s *mysqlStore) ListPostsByUser(userID int, limit int) ([]Post, error) {
+	results := []Post{}
+	query := `SELECT ` + postWithUserColumns + `
+	FROM posts
+	JOIN users ON posts.user_id = users.id
+	WHERE users.del_flg = 0 AND posts.del_flg = 0 AND users.id = ?
+	ORDER BY posts.created_at DESC, posts.id DESC`
+	if limit > 0 {
+		query += " LIMIT ?"
+		err := s.db.Select(&results, query, userID, limit)
+		return results, err
+	}
+	err := s.db.Select(&results, query, userID)
+	return results, err
+}
+
+func (s *mysqlStore) ListFollowingPosts(userID int, cursor PostCursor, limit int) ([]Post, error) {
+	results := []Post{}
+	if cursor.IsZero() {
+		query := `SELECT ` + postWithUserColumns + `
+		FROM posts
+		JOIN users ON posts.user_id = users.id
+		JOIN follows ON follows.followee_id = posts.user_id AND follows.follower_id = ?
+		WHERE users.del_flg = 0 AND posts.del_flg = 0
+		ORDER BY posts.created_at DESC, posts.id DESC
+		LIMIT ?`
+		err := s.db.Select(&results, query, userID, limit)
+		return results, err
+	}
+
+	query := `SELECT ` + postWithUserColumns + `
+	FROM posts
+	JOIN users ON posts.user_id = users.id
+	JOIN follows ON follows.followee_id = posts.user_id AND follows.follower_id = ?
+	WHERE users.del_flg = 0 AND posts.del_flg = 0 AND
+	(posts.created_at < ? OR (posts.created_at = ? AND posts.id < ?))
+	ORDER BY posts.created_at DESC, posts.id DESC
+	LIMIT ?`
+	err := s.db.Select(&results, query, userID, cursor.CreatedAt, cursor.CreatedAt, cursor.ID, limit)
+	return results, err
+}
+
+func (s *mysqlStore) ListPostsByTag(tag string, cursor PostCursor, limit int) ([]Post, error) {
+	results := []Post{}
+	if cursor.IsZero() {
+		query := `SELECT ` + postWithUserColumns + `
+		FROM posts
+		JOIN users ON posts.user_id = users.id
+		JOIN post_tags ON post_tags.post_id = posts.id AND post_tags.tag = ?
+		WHERE users.del_flg = 0 AND posts.del_flg = 0
+		ORDER BY posts.created_at DESC, posts.id DESC
+		LIMIT ?`
+		err := s.db.Select(&results, query, tag, limit)
+		return results, err
+	}
+
+	query := `SELECT ` + postWithUserColumns + `
+	FROM posts
+	JOIN users ON posts.user_id = users.id
+	JOIN post_tags ON post_tags.post_id = posts.id AND post_tags.tag = ?
+	WHERE users.del_flg = 0 AND posts.del_flg = 0 AND
+	(posts.created_at < ? OR (posts.created_at = ? AND posts.id < ?))
+	ORDER BY posts.created_at DESC, posts.id DESC
+	LIMIT ?`
+	err := s.db.Select(&results, query, tag, cursor.CreatedAt, cursor.CreatedAt, cursor.ID, limit)
+	return results, err
+}
+
+func (s *mysqlStore) GetPost(id int) (Post, error) {
+	p := Post{}
+	query := `SELECT ` + postWithUserColumns + `
+	FROM posts
+	JOIN users ON posts.user_id = users.id
+	WHERE users.del_flg = 0 AND posts.del_flg = 0 AND posts.id = ?`
+	err := s.db.Get(&p, query, id)
+	return p, notFound(err)
+}
+
+func (s *mysqlStore) GetPostImage(id int) (Post, error) {
+	p := Post{}
+	// 移行済みの投稿ではBLOBを読み込まない
+	query := "SELECT `id`, `user_id`, `mime`, `image_key`, IF(`image_key` = '', `imgdata`, '') AS `imgdata`, `created_at` FROM `posts` WHERE `id` = ? AND `del_flg` = 0"
+	err := s.db.Get(&p, query, id)
+	return p, notFound(err)
+}
+
+func (s *mysqlStore) CreatePost(userID int, mime string, body string) (int, error) {
+	query := "INSERT INTO `posts` (`user_id`, `mime`, `imgdata`, `body`) VALUES (?,?,NULL,?)"
+	result, err := s.db.Exec(query, userID, mime, body)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func (s *mysqlStore) SetPostImageKey(id int, key string) error {
+	_, err := s.db.Exec("UPDATE `posts` SET `image_key` = ? WHERE `id` = ?", key, id)
+	return err
+}
+
+func (s *mysqlStore) ListLegacyImages(afterID, limit int, includeMigrated bool) ([]Post, error) {
+	posts := []Post{}
+	query := "SELECT `id`, `user_id`, `mime`, `image_key`, `imgdata`, `created_at` FROM `posts` WHERE `id` > ? AND `image_key` = '' ORDER BY `id` LIMIT ?"
+	if includeMigrated {
+		query = "SELECT `id`, `user_id`, `mime`, `image_key`, `imgdata`, `created_at` FROM `posts` WHERE `id` > ? AND (`image_key` = '' OR LENGTH(`imgdata`) > 0) ORDER BY `id` LIMIT ?"
+	}
+	err := s.db.Select(&posts, query, afterID, limit)
+	return posts, err
+}
+
+func (s *mysqlStore) FinishImageMigration(id int, key string, nullBlob bool) error {
+	if nullBlob {
+		_, err := s.db.Exec("UPDATE `posts` SET `image_key` = ?, `imgdata` = NULL WHERE `id` = ?", key, id)
+		return err
+	}
+	return s.SetPostImageKey(id, key)
+}
+
+func (s *mysqlStore) AddPostTags(postID int, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	placeholders := make([]string, 0, len(tags))
+	args := make([]interface{}, 0, len(tags)*2)
+	for _, tag := range tags {
+		placeholders = append(placeholders, "(?,?)")
+		args = append(args, postID, tag)
+	}
+	query := "INSERT IGNORE INTO `post_tags` (`post_id`, `tag`) VALUES " + strings.Join(placeholders, ",")
+	_, err := s.db.Exec(query, args...)
+	return err
+}
+
+func (s *mysqlStore) DeletePost(id int) error {
+	_, err := s.db.Exec("UPDATE `posts` SET `del_flg` = ? WHERE `id` = ?", 1, id)
+	return err
+}
+
+func (s *mysqlStore) CountPostsWithImageKey(key string) (int, error) {
+	count := 0
+	err := s.db.Get(&count, "SELECT COUNT(*) AS count FROM `posts` WHERE `image_key` = ? AND `del_flg` = 0", key)
+	return count, err
+}
+
+func (s *mysqlStore) CountPostsByUser(userID int) (int, error) {
+	count := 0
+	err := s.db.Get(&count, "SELECT COUNT(*) AS count FROM `posts` WHERE `user_id` = ? AND `del_flg` = 0", userID)
+	return count, err
+}
+
+func (s *mysqlStore) ListComments(postID int, limit int) ([]Comment, error) {
+	comments := []Comment{}
+	query := `SELECT ` + commentWithUserColumns + `
+	FROM comments
+	JOIN users ON comments.user_id = users.id
+	WHERE comments.post_id = ? AND comments.del_flg = 0
+	ORDER BY comments.created_at DESC`
+	if limit > 0 {
+		query += " LIMIT ?"
+		err := s.db.Select(&comments, query, postID, limit)
+		return comments, err
+	}
+	err := s.db.Select(&comments, query, postID)
+	return comments, err
+}
+
+func (s *mysqlStore) CountComments(postID int) (int, error) {
+	count := 0
+	err := s.db.Get(&count, "SELECT COUNT(*) AS `count` FROM `comments` WHERE `post_id` = ? AND `del_flg` = 0", postID)
+	return count, err
+}
+
+func (s *mysqlStore) ListCommentsByUser(userID int) ([]Comment, error) {
+	comments := []Comment{}
+	query := `SELECT ` + commentWithUserColumns + `
+	FROM comments
+	JOIN users ON comments.user_id = users.id
+	WHERE comments.user_id = ? AND comments.del_flg = 0
+	ORDER BY comments.id`
+	err := s.db.Select(&comments, query, userID)
+	return comments, err
+}
+
+func (s *mysqlStore) CountCommentsByUser(userID int) (int, error) {
+	count := 0
+	query := "SELECT COUNT(*) AS count FROM `comments` JOIN `posts` ON comments.post_id = posts.id WHERE comments.user_id = ? AND comments.del_flg = 0 AND posts.del_flg = 0"
+	err := s.db.Get(&count, query, userID)
+	return count, err
+}
+
+func (s *mysqlStore) CountCommentsOnUserPosts(userID int) (int, error) {
+	count := 0
+	query := "SELECT COUNT(*) AS count FROM `comments` JOIN `posts` ON comments.post_id = posts.id WHERE posts.user_id = ? AND comments.del_flg = 0 AND posts.del_flg = 0"
+	err := s.db.Get(&count, query, userID)
+	return count, err
+}
+
+func (s *mysqlStore) CreateComment(postID, userID int, comment string) (int, error) {
+	query := "INSERT INTO `comments` (`post_id`, `user_id`, `comment`) VALUES (?,?,?)"
+	result, err := s.db.Exec(query, postID, userID, comment)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func (s *mysqlStore) GetComment(id int) (Comment, error) {
+	c := Comment{}
+	query := `SELECT ` + commentWithUserColumns + `
+	FROM comments
+	JOIN users ON comments.user_id = users.id
+	JOIN posts ON comments.post_id = posts.id
+	WHERE comments.id = ? AND comments.del_flg = 0 AND posts.del_flg = 0`
+	err := s.db.Get(&c, query, id)
+	return c, notFound(err)
+}
+
+func (s *mysqlStore) UpdateComment(id int, comment string) error {
+	_, err := s.db.Exec("UPDATE `comments` SET `comment` = ?, `edited_at` = NOW() WHERE `id` = ?", comment, id)
+	return err
+}
+
+func (s *mysqlStore) DeleteComment(id int) error {
+	_, err := s.db.Exec("UPDATE `comments` SET `del_flg` = ? WHERE `id` = ?", 1, id)
+	return err
+}
+
+func (s *mysqlStore) LikePost(postID, userID int) (bool, error) {
+	result, err := s.db.Exec("INSERT IGNORE INTO `likes` (`post_id`, `user_id`) VALUES (?,?)", postID, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *mysqlStore) UnlikePost(postID, userID int) error {
+	_, err := s.db.Exec("DELETE FROM `likes` WHERE `post_id` = ? AND `user_id` = ?", postID, userID)
+	return err
+}
+
+func (s *mysqlStore) CountLikes(postID int) (int, error) {
+	count := 0
+	err := s.db.Get(&count, "SELECT COUNT(*) AS `count` FROM `likes` WHERE `post_id` = ?", postID)
+	return count, err
+}
+
+func (s *mysqlStore) ListLikedPostIDs(userID int, postIDs []int) ([]int, error) {
+	ids := []int{}
+	if len(postIDs) == 0 {
+		return ids, nil
+	}
+	query, args, err := sqlx.In("SELECT `post_id` FROM `likes` WHERE `user_id` = ? AND `post_id` IN (?)", userID, postIDs)
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.Select(&ids, query, args...)
+	return ids, err
+}
+
+func (s *mysqlStore) Follow(followerID, followeeID int) error {
+	_, err := s.db.Exec("INSERT IGNORE INTO `follows` (`follower_id`, `followee_id`) VALUES (?,?)", followerID, followeeID)
+	return err
+}
+
+func (s *mysqlStore) Unfollow(followerID, followeeID int) error {
+	_, err := s.db.Exec("DELETE FROM `follows` WHERE `follower_id` = ? AND `followee_id` = ?", followerID, followeeID)
+	return err
+}
+
+func (s *mysqlStore) IsFollowing(followerID, followeeID int) (bool, error) {
+	count := 0
+	err := s.db.Get(&count, "SELECT COUNT(*) AS `count` FROM `follows` WHERE `follower_id` = ? AND `followee_id` = ?", followerID, followeeID)
+	return count > 0, err
+}
+
+func (s *mysqlStore) CountFollows(userID int) (int, int, error) {
+	following := 0
+	query := "SELECT COUNT(*) AS `count` FROM `follows` JOIN `users` ON `follows`.`followee_id` = `users`.`id` WHERE `follows`.`follower_id` = ? AND `users`.`del_flg` = 0"
+	err := s.db.Get(&following, query, userID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	followers := 0
+	query = "SELECT COUNT(*) AS `count` FROM `follows` JOIN `users` ON `follows`.`follower_id` = `users`.`id` WHERE `follows`.`followee_id` = ? AND `users`.`del_flg` = 0"
+	err = s.db.Get(&followers, query, userID)
+	return following, followers, err
+}
+
+func (s *mysqlStore) CreateNotification(n Notification) error {
+	query := "INSERT INTO `notifications` (`user_id`, `actor_id`, `kind`, `post_id`) VALUES (?,?,?,?)"
+	_, err := s.db.Exec(query, n.UserID, n.ActorID, n.Kind, n.PostID)
+	return err
+}
+
+func (s *mysqlStore) ListNotifications(userID int, limit int) ([]Notification, error) {
+	notifications := []Notification{}
+	query := `SELECT ` + notificationWithActorColumns + `
+	FROM notifications
+	JOIN users ON notifications.actor_id = users.id
+	JOIN posts ON notifications.post_id = posts.id
+	WHERE notifications.user_id = ? AND users.del_flg = 0 AND posts.del_flg = 0
+	ORDER BY notifications.id DESC
+	LIMIT ?`
+	err := s.db.Select(&notifications, query, userID, limit)
+	return notifications, err
+}
+
+func (s *mysqlStore) CountUnreadNotifications(userID int) (int, error) {
+	count := 0
+	query := `SELECT COUNT(*) AS count
+	FROM notifications
+	JOIN users ON notifications.actor_id = users.id
+	JOIN posts ON notifications.post_id = posts.id
+	WHERE notifications.user_id = ? AND notifications.read_flg = 0 AND users.del_flg = 0 AND posts.del_flg = 0`
+	err := s.db.Get(&count, query, userID)
+	return count, err
+}
+
+func (s *mysqlStore) MarkNotificationsRead(userID int) error {
+	_, err := s.db.Exec("UPDATE `notifications` SET `read_flg` = 1 WHERE `user_id` = ? AND `read_flg` = 0", userID)
+	return err
+}
+
+func (s *mysqlStore) AppendModerationLog(l ModerationLog) error {
+	query := "INSERT INTO `moderation_logs` (`actor_id`, `actor_account_name`, `target_id`, `target_account_name`, `action`, `detail`, `reason`) VALUES (?,?,?,?,?,?,?)"
+	_, err := s.db.Exec(query, l.ActorID, l.ActorAccountName, l.TargetID, l.TargetAccountName, l.Action, l.Detail, l.Reason)
+	return err
+}
+
+func (s *mysqlStore) ListModerationLogs(filter ModerationLogFilter, limit int) ([]ModerationLog, error) {
+	conds := []string{"1 = 1"}
+	args := []interface{}{}
+	if filter.Action != "" {
+		conds = append(conds, "`action` = ?")
+		args = append(args, filter.Action)
+	}
+	if filter.AccountName != "" {
+		conds = append(conds, "(`actor_account_name` = ? OR `target_account_name` = ?)")
+		args = append(args, filter.AccountName, filter.AccountName)
+	}
+	if filter.BeforeID > 0 {
+		conds = append(conds, "`id` < ?")
+		args = append(args, filter.BeforeID)
+	}
+	args = append(args, limit)
+
+	logs := []ModerationLog{}
+	query := "SELECT " + moderationLogColumns + " FROM `moderation_logs` WHERE " + strings.Join(conds, " AND ") + " ORDER BY `id` DESC LIMIT ?"
+	err := s.db.Select(&logs, query, args...)
+	return logs, err
+}
+
+func (s *mysqlStore) CreateReport(reporterID, postID, commentID int, reason string) (int, error) {
+	query := "INSERT INTO `reports` (`reporter_id`, `post_id`, `comment_id`, `reason`, `status`) VALUES (?,?,?,?,?)"
+	result, err := s.db.Exec(query, reporterID, postID, commentID, reason, reportOpen)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func (s *mysqlStore) GetReport(id int) (Report, error) {
+	rp := Report{}
+	query := `SELECT ` + reportWithReporterColumns + `
+	FROM reports
+	JOIN users ON reports.reporter_id = users.id
+	WHERE reports.id = ?`
+	err := s.db.Get(&rp, query, id)
+	return rp, notFound(err)
+}
+
+func (s *mysqlStore) ListOpenReports(limit int) ([]Report, error) {
+	reports := []Report{}
+	query := `SELECT ` + reportWithReporterColumns + `
+	FROM reports
+	JOIN users ON reports.reporter_id = users.id
+	WHERE reports.status = ?
+	ORDER BY reports.id
+	LIMIT ?`
+	err := s.db.Select(&reports, query, reportOpen, limit)
+	return reports, err
+}
+
+func (s *mysqlStore) CountOpenReports() (int, error) {
+	count := 0
+	err := s.db.Get(&count, "SELECT COUNT(*) AS count FROM `reports` WHERE `status` = ?", reportOpen)
+	return count, err
+}
+
+func (s *mysqlStore) ResolveReports(postID, commentID int, status string, resolvedBy int) error {
+	query := "UPDATE `reports` SET `status` = ?, `resolved_by` = ? WHERE `post_id` = ? AND `comment_id` = ? AND `status` = ?"
+	_, err := s.db.Exec(query, status, resolvedBy, postID, commentID, reportOpen)
+	return err
+}
+
+func (s *mysqlStore) RecordLoginLockout(accountName string, until time.Time) error {
+	query := "INSERT INTO `login_lockouts` (`account_name`, `locked_until`) VALUES (?,?) ON DUPLICATE KEY UPDATE `locked_until` = VALUES(`locked_until`)"
+	_, err := s.db.Exec(query, accountName, until)
+	return err
+}
+
+func (s *mysqlStore) ListLoginLockouts(now time.Time) ([]LoginLockout, error) {
+	lockouts := []LoginLockout{}
+	err := s.db.Select(&lockouts, "SELECT `account_name`, `locked_until` FROM `login_lockouts` WHERE `locked_until` > ? ORDER BY `locked_until` DESC", now)
+	return lockouts, err
+}
+
+func (s *mysqlStore) DeleteLoginLockout(accountName string) error {
+	_, err := s.db.Exec("DELETE FROM `login_lockouts` WHERE `account_name` = ?", accountName)
+	return err
+}
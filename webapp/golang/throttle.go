@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// loginThrottleParamsは、ログインの失敗の数え方と、待ち時間・ロックの条件です。
+type loginThrottleParams struct {
+	// Window は、失敗を数える期間です。最初の失敗からWindowが過ぎると数え直します。
+	Window time.Duration
+	// FreeAttempts は、待ち時間なしで失敗できる回数です。
+	FreeAttempts int
+	// BaseDelay は、FreeAttemptsを超えて最初に失敗したときの待ち時間です。失敗するたびに2倍になります。
+	BaseDelay time.Duration
+	// MaxDelay は、待ち時間の上限です。
+	MaxDelay time.Duration
+	// LockoutThreshold は、ロックする失敗の回数です。
+	LockoutThreshold int
+	// LockoutDuration は、ロックする期間です。
+	LockoutDuration time.Duration
+}
+
+// delay は、failures回目の失敗の後にログインを受け付けない期間と、それがロックかを返します。
+func (p loginThrottleParams) delay(failures int) (time.Duration, bool) {
+	if failures >= p.LockoutThreshold {
+		return p.LockoutDuration, true
+	}
+	if failures <= p.FreeAttempts {
+		return 0, false
+	}
+	d := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < failures && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d, false
+}
+
+var (
+	// accountLoginThrottleParamsは、アカウントごとの制限です。
+	accountLoginThrottleParams = loginThrottleParams{
+		Window:           15 * time.Minute,
+		FreeAttempts:     5,
+		BaseDelay:        time.Second,
+		MaxDelay:         time.Minute,
+		LockoutThreshold: 10,
+		LockoutDuration:  15 * time.Minute,
+	}
+	// ipLoginThrottleParamsは、IPアドレスごとの制限です。
+	// NATの内側などで複数の利用者が同じIPアドレスを使うことがあるので、アカウントごとより緩くしています。
+	ipLoginThrottleParams = loginThrottleParams{
+		Window:           15 * time.Minute,
+		FreeAttempts:     20,
+		BaseDelay:        time.Second,
+		MaxDelay:         time.Minute,
+		LockoutThreshold: 100,
+		LockoutDuration:  15 * time.Minute,
+	}
+)
+
+// loginThrottleIPExemptは、IPアドレスごとの制限をしないネットワークです。
+// ベンチマーカーは1つのIPアドレスから間違ったパスワードでのログインを1分間に数千回送るので、
+// 同じネットワークで動かすベンチマーカーが締め出されないよう、デフォルトではループバックとプライベートアドレスを含めます。
+// アカウントごとの制限は、ここに含まれるIPアドレスからのログインにも適用します。
+var loginThrottleIPExempt = mustParseCIDRs("127.0.0.0/8", "::1/128", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7")
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// loadLoginThrottleIPExemptFromEnv は、環境変数ISUCONP_LOGIN_THROTTLE_IP_EXEMPTでloginThrottleIPExemptを変更します。
+// カンマ区切りのCIDRで指定し、noneを指定するとすべてのIPアドレスを制限します。
+func loadLoginThrottleIPExemptFromEnv() error {
+	s := os.Getenv("ISUCONP_LOGIN_THROTTLE_IP_EXEMPT")
+	switch s {
+	case "":
+		return nil
+	case "none":
+		loginThrottleIPExempt = nil
+		return nil
+	}
+	nets, err := parseCIDRs(strings.Split(s, ","))
+	if err != nil {
+		return fmt.Errorf("invalid ISUCONP_LOGIN_THROTTLE_IP_EXEMPT=%q: %w", s, err)
+	}
+	loginThrottleIPExempt = nets
+	return nil
+}
+
+// ipThrottled は、ipをIPアドレスごとに制限するかを返します。
+func ipThrottled(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return true
+	}
+	for _, n := range loginThrottleIPExempt {
+		if n.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// loginThrottleは、ログインの失敗をアカウントごと・IPアドレスごとに数えて、試行を制限します。
+// 回数と待ち時間はCacheに保存するので、複数のプロセスで共有できます。
+var loginThrottle *loginThrottler
+
+type loginThrottler struct {
+	cache Cache
+	now   func() time.Time
+}
+
+func newLoginThrottler(cache Cache) *loginThrottler {
+	return &loginThrottler{cache: cache, now: time.Now}
+}
+
+// loginBlockは、ログインを受け付けない理由と期限です。
+type loginBlock struct {
+	Lockout bool
+	Until   time.Time
+}
+
+// Notice は、ログイン画面に表示するメッセージを返します。
+func (b loginBlock) Notice(now time.Time) string {
+	if b.Lockout {
+		minutes := int(b.Until.Sub(now).Minutes()) + 1
+		return fmt.Sprintf("ログインの失敗が続いたため、アカウントを一時的にロックしました。%d分後にもう一度お試しください", minutes)
+	}
+	return "ログインの試行が多すぎます。しばらくしてからもう一度お試しください"
+}
+
+// LoginLockoutは、ログインの失敗が続いてロックしたアカウントの記録です。管理者用ページで確認できます。
+type LoginLockout struct {
+	AccountName string    `db:"account_name"`
+	LockedUntil time.Time `db:"locked_until"`
+}
+
+// loginThrottleKey は、アカウント名またはIPアドレスからmemcachedのキーに使える文字列を返します。
+// アカウント名はフォームの入力のままなので、ハッシュにして長さと使える文字を揃えます。
+// genはloginThrottler.generationが返す世代です。
+func loginThrottleKey(gen, kind, subject string) string {
+	sum := sha256.Sum256([]byte(subject))
+	if gen != "" {
+		kind += "_" + gen
+	}
+	return kind + "_" + hex.EncodeToString(sum[:16])
+}
+
+// loginThrottleGenerationKey は、失敗の回数と待ち時間のキーに含める世代を保存するキーです。
+// キーはアカウント名とIPアドレスごとにあってまとめて削除できないので、Resetでは世代を変えて以前のキーを使わないようにします。
+const loginThrottleGenerationKey = "login_throttle_generation"
+
+// generation は、現在の世代を返します。一度もResetしていない場合は空文字列です。
+func (t *loginThrottler) generation() (string, error) {
+	item, err := t.cache.Get(loginThrottleGenerationKey)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(item.Value), nil
+}
+
+// Reset は、すべてのアカウントとIPアドレスの失敗の回数と待ち時間を消します。ベンチマーカーの/initializeで呼ばれます。
+func (t *loginThrottler) Reset() error {
+	return t.cache.Set(&memcache.Item{Key: loginThrottleGenerationKey, Value: []byte(secureRandomStr(8))})
+}
+
+func failuresKey(key string) string { return "login_failures_" + key }
+func blockKey(key string) string    { return "login_block_" + key }
+
+// block は、keyのログインを受け付けない場合にその理由を返します。
+func (t *loginThrottler) block(key string) (loginBlock, bool, error) {
+	item, err := t.cache.Get(blockKey(key))
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return loginBlock{}, false, nil
+	}
+	if err != nil {
+		return loginBlock{}, false, err
+	}
+
+	// 値は"lockout:<UNIX時刻>"または"delay:<UNIX時刻>"
+	kind, until, _ := strings.Cut(string(item.Value), ":")
+	sec, err := strconv.ParseInt(until, 10, 64)
+	if err != nil {
+		return loginBlock{}, false, nil
+	}
+	b := loginBlock{Lockout: kind == "lockout", Until: time.Unix(sec, 0)}
+	if !t.now().Before(b.Until) {
+		return loginBlock{}, false, nil
+	}
+	return b, true, nil
+}
+
+// Check は、アカウントとIPアドレスのどちらかでログインを受け付けない場合にその理由を返します。
+func (t *loginThrottler) Check(accountName, ip string) (loginBlock, bool, error) {
+	gen, err := t.generation()
+	if err != nil {
+		return loginBlock{}, false, err
+	}
+	b, ok, err := t.block(loginThrottleKey(gen, "account", accountName))
+	if err != nil || ok || !ipThrottled(ip) {
+		return b, ok, err
+	}
+	b, ok, err = t.block(loginThrottleKey(gen, "ip", ip))
+	// IPアドレスのロックはアカウントのロックとは別の理由なので、待ち時間として扱う
+	b.Lockout = false
+	return b, ok, err
+}
+
+// fail は、keyの失敗を1回数え、paramsに従って待ち時間またはロックを設定します。
+func (t *loginThrottler) fail(key string, params loginThrottleParams) (loginBlock, bool, error) {
+	failures, err := t.cache.Increment(failuresKey(key), 1)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		failures = 1
+		err = t.cache.Add(&memcache.Item{Key: failuresKey(key), Value: []byte("1"), Expiration: int32(params.Window / time.Second)})
+		// 同時に最初の失敗を数えた場合は、もう一度加える
+		if errors.Is(err, memcache.ErrNotStored) {
+			failures, err = t.cache.Increment(failuresKey(key), 1)
+		}
+	}
+	if err != nil {
+		return loginBlock{}, false, err
+	}
+
+	d, lockout := params.delay(int(failures))
+	if d <= 0 {
+		return loginBlock{}, false, nil
+	}
+	b := loginBlock{Lockout: lockout, Until: t.now().Add(d)}
+	kind := "delay"
+	if lockout {
+		kind = "lockout"
+	}
+	err = t.cache.Set(&memcache.Item{
+		Key:   blockKey(key),
+		Value: []byte(kind + ":" + strconv.FormatInt(b.Until.Unix(), 10)),
+		// memcachedの有効期限は秒単位なので、切り上げる
+		Expiration: int32((d + time.Second - 1) / time.Second),
+	})
+	return b, true, err
+}
+
+// Fail は、ログインの失敗を数えます。アカウントがロックされた場合は、その期限を返します。
+func (t *loginThrottler) Fail(accountName, ip string) (loginBlock, bool, error) {
+	gen, err := t.generation()
+	if err != nil {
+		return loginBlock{}, false, err
+	}
+	if ipThrottled(ip) {
+		_, _, err = t.fail(loginThrottleKey(gen, "ip", ip), ipLoginThrottleParams)
+		if err != nil {
+			return loginBlock{}, false, err
+		}
+	}
+	b, ok, err := t.fail(loginThrottleKey(gen, "account", accountName), accountLoginThrottleParams)
+	return b, ok && b.Lockout, err
+}
+
+// reset は、keyの失敗の回数と待ち時間を消します。
+func (t *loginThrottler) reset(key string) error {
+	for _, k := range []string{failuresKey(key), blockKey(key)} {
+		err := t.cache.Delete(k)
+		if err != nil && !errors.Is(err, memcache.ErrCacheMiss) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Succeed は、ログインに成功したアカウントの失敗の回数を消します。
+// IPアドレスの回数は消さずにWindowが過ぎるのを待ちます。消すと、自分のアカウントへのログインを挟みながら
+// 同じIPアドレスから他のアカウントのパスワードを試し続けられるためです。
+func (t *loginThrottler) Succeed(accountName string) error {
+	gen, err := t.generation()
+	if err != nil {
+		return err
+	}
+	return t.reset(loginThrottleKey(gen, "account", accountName))
+}
+
+// Unlock は、アカウントのロックを解除します。
+func (t *loginThrottler) Unlock(accountName string) error {
+	gen, err := t.generation()
+	if err != nil {
+		return err
+	}
+	return t.reset(loginThrottleKey(gen, "account", accountName))
+}
+
+// clientIP は、リクエスト元のIPアドレスを返します。
+// ループバックまたはプライベートアドレスのリバースプロキシ(nginx)からのリクエストでは、X-Real-IPヘッダーを使います。
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && (ip.IsLoopback() || ip.IsPrivate()) {
+		if realIP := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); realIP != nil {
+			return realIP.String()
+		}
+	}
+	return host
+}
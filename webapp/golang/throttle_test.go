@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+func TestLoginThrottleParamsDelay(t *testing.T) {
+	p := loginThrottleParams{
+		FreeAttempts:     2,
+		BaseDelay:        time.Second,
+		MaxDelay:         5 * time.Second,
+		LockoutThreshold: 8,
+		LockoutDuration:  time.Hour,
+	}
+	testCases := []struct {
+		failures int
+		delay    time.Duration
+		lockout  bool
+	}{
+		{1, 0, false},
+		{2, 0, false},
+		{3, time.Second, false},
+		{4, 2 * time.Second, false},
+		{5, 4 * time.Second, false},
+		{6, 5 * time.Second, false},
+		{7, 5 * time.Second, false},
+		{8, time.Hour, true},
+	}
+	for _, tc := range testCases {
+		if d, lockout := p.delay(tc.failures); d != tc.delay || lockout != tc.lockout {
+			t.Errorf("delay(%d) = %v, %v; want %v, %v", tc.failures, d, lockout, tc.delay, tc.lockout)
+		}
+	}
+}
+
+// unavailableCacheは、memcachedにつながらない状態を再現するCacheです。
+type unavailableCache struct{}
+
+var errUnavailable = errors.New("connection refused")
+
+func (unavailableCache) Get(string) (*memcache.Item, error) { return nil, errUnavailable }
+func (unavailableCache) GetMulti([]string) (map[string]*memcache.Item, error) {
+	return nil, errUnavailable
+}
+func (unavailableCache) Set(*memcache.Item) error                 { return errUnavailable }
+func (unavailableCache) Add(*memcache.Item) error                 { return errUnavailable }
+func (unavailableCache) Increment(string, uint64) (uint64, error) { return 0, errUnavailable }
+func (unavailableCache) Delete(string) error                      { return errUnavailable }
+
+func TestLoginThrottlerFallback(t *testing.T) {
+	params := accountLoginThrottleParams
+	accountLoginThrottleParams = loginThrottleParams{Window: time.Minute, FreeAttempts: 1, BaseDelay: time.Second, MaxDelay: time.Second, LockoutThreshold: 3, LockoutDuration: time.Minute}
+	t.Cleanup(func() { accountLoginThrottleParams = params })
+
+	now := time.Now()
+	throttle := newLoginThrottler(newFallbackCache(unavailableCache{}, newMemoryCache()))
+	throttle.now = func() time.Time { return now }
+
+	for i := 1; i <= 3; i++ {
+		if _, blocked, err := throttle.Check("alice", "192.0.2.1"); err != nil || blocked {
+			t.Fatalf("attempt %d: Check() = %v, %v; want not blocked", i, blocked, err)
+		}
+		b, locked, err := throttle.Fail("alice", "192.0.2.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if locked != (i == 3) {
+			t.Fatalf("attempt %d: locked = %v", i, locked)
+		}
+		if i == 3 && !b.Until.Equal(now.Add(time.Minute)) {
+			t.Errorf("locked until %v; want %v", b.Until, now.Add(time.Minute))
+		}
+		// 待ち時間が過ぎてから次の試行をする
+		now = now.Add(2 * time.Second)
+	}
+
+	b, blocked, err := throttle.Check("alice", "192.0.2.2")
+	if err != nil || !blocked || !b.Lockout {
+		t.Fatalf("Check() after lockout = %+v, %v, %v", b, blocked, err)
+	}
+	// 他のアカウントは同じIPアドレスからでもログインできる
+	if _, blocked, _ := throttle.Check("bob", "192.0.2.1"); blocked {
+		t.Error("other accounts should not be blocked")
+	}
+
+	if err := throttle.Unlock("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, blocked, _ := throttle.Check("alice", "192.0.2.1"); blocked {
+		t.Error("account should be unlocked")
+	}
+}
+
+func TestLoginThrottlerIPNotResetBySuccess(t *testing.T) {
+	params := ipLoginThrottleParams
+	ipLoginThrottleParams = loginThrottleParams{Window: time.Minute, FreeAttempts: 1, BaseDelay: time.Second, MaxDelay: time.Second, LockoutThreshold: 3, LockoutDuration: time.Minute}
+	t.Cleanup(func() { ipLoginThrottleParams = params })
+
+	throttle := newLoginThrottler(newMemoryCache())
+	const ip = "198.51.100.1"
+	// 自分のアカウントへのログインを挟んでも、他のアカウントの失敗は同じIPアドレスで数え続ける
+	for _, victim := range []string{"bob", "carol"} {
+		if _, _, err := throttle.Fail(victim, ip); err != nil {
+			t.Fatal(err)
+		}
+		if err := throttle.Succeed("mallory"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, blocked, err := throttle.Check("dave", ip); err != nil || !blocked {
+		t.Errorf("Check() = %v, %v; want blocked", blocked, err)
+	}
+
+	// 制限しないネットワークからの失敗は、IPアドレスごとには数えない
+	for i := 0; i < 3; i++ {
+		if _, _, err := throttle.Fail("user"+strconv.Itoa(i), "10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, blocked, err := throttle.Check("dave", "10.0.0.1"); err != nil || blocked {
+		t.Errorf("Check() from an exempt network = %v, %v; want not blocked", blocked, err)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	testCases := []struct {
+		remoteAddr string
+		realIP     string
+		want       string
+	}{
+		{"203.0.113.1:1234", "", "203.0.113.1"},
+		{"127.0.0.1:1234", "203.0.113.2", "203.0.113.2"},
+		{"10.0.0.5:1234", "203.0.113.3", "203.0.113.3"},
+		// プロキシ以外からのX-Real-IPは信用しない
+		{"203.0.113.1:1234", "198.51.100.1", "203.0.113.1"},
+	}
+	for _, tc := range testCases {
+		r := &http.Request{RemoteAddr: tc.remoteAddr, Header: http.Header{}}
+		if tc.realIP != "" {
+			r.Header.Set("X-Real-IP", tc.realIP)
+		}
+		if got := clientIP(r); got != tc.want {
+			t.Errorf("clientIP(%q, %q) = %q; want %q", tc.remoteAddr, tc.realIP, got, tc.want)
+		}
+	}
+}
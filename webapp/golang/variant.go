@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// タイムラインのカードに表示するサムネイルの幅
+	thumbnailWidth = 320
+	// thumbnailSuffixは、サムネイルのURLとファイル名で投稿IDの後ろに付ける文字列です(/image/{id}_thumb.{ext})。
+	thumbnailSuffix = "_thumb"
+	// alternateSuffixは、Acceptヘッダーに応じて元画像の代わりに返す別の形式の画像のファイル名で投稿IDの後ろに付ける文字列です。
+	alternateSuffix = "_alt"
+)
+
+// variantCacheは、元画像から生成したサムネイルや別の形式の画像を{id}{suffix}.{ext}というファイル名でディレクトリに保存します。
+// ディレクトリを../public/imageにすると、サムネイルは2回目以降nginxのtry_filesで直接配信されます。
+type variantCache struct {
+	dir string
+}
+
+func newVariantCache(dir string) *variantCache {
+	return &variantCache{dir: dir}
+}
+
+// newVariantCacheFromEnv は、ISUCONP_THUMBNAIL_DIR(未設定の場合はISUCONP_IMAGE_DIR)に保存するvariantCacheを返します。
+func newVariantCacheFromEnv() *variantCache {
+	dir := os.Getenv("ISUCONP_THUMBNAIL_DIR")
+	if dir == "" {
+		dir = os.Getenv("ISUCONP_IMAGE_DIR")
+	}
+	if dir == "" {
+		dir = "../public/image"
+	}
+	return newVariantCache(dir)
+}
+
+func (c *variantCache) path(pid int, suffix, mime string) string {
+	return filepath.Join(c.dir, strconv.Itoa(pid)+suffix+"."+imageExt(mime))
+}
+
+// Put は、生成した画像を保存します。
+func (c *variantCache) Put(pid int, suffix, mime string, data []byte) error {
+	return writeFileAtomic(c.path(pid, suffix, mime), data)
+}
+
+// Get は、保存済みの画像を返します。保存されていなければgenerateで生成して保存します。
+func (c *variantCache) Get(pid int, suffix, mime string, generate func() ([]byte, error)) ([]byte, error) {
+	data, err := os.ReadFile(c.path(pid, suffix, mime))
+	if err == nil {
+		return data, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	data, err = generate()
+	if err != nil {
+		return nil, err
+	}
+	err = c.Put(pid, suffix, mime, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Delete は、投稿画像から生成して保存した画像をすべて削除します。
+func (c *variantCache) Delete(pid int, mime string) error {
+	paths := []string{c.path(pid, thumbnailSuffix, thumbnailMime(mime))}
+	if f, ok := imageFormatByMime(mime); ok && f.Alternate != "" {
+		paths = append(paths, c.path(pid, alternateSuffix, f.Alternate))
+	}
+	if f, ok := imageFormatByMime(mime); ok && f.Fallback != "" {
+		paths = append(paths, c.path(pid, alternateSuffix, f.Fallback))
+	}
+
+	for _, path := range paths {
+		err := removeImageFile(path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// thumbnailMime は、mimeの投稿画像のサムネイルの形式を返します。
+// 表示できないクライアントがある形式は、代わりの形式でサムネイルを作ります。
+func thumbnailMime(mime string) string {
+	if f, ok := imageFormatByMime(mime); ok && f.Fallback != "" {
+		return f.Fallback
+	}
+	return mime
+}
+
+// makeThumbnail は、画像を幅widthに縮小してthumbnailMime(mime)の形式でエンコードします。
+// 元画像の幅がwidth以下で形式も変わらない場合は、拡大せずにそのまま返します。GIFアニメーションは最初のフレームだけになります。
+func makeThumbnail(data []byte, mime string, width int) ([]byte, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	dstMime := thumbnailMime(mime)
+	b := src.Bounds()
+	if b.Dx() <= width {
+		if dstMime == mime {
+			return data, nil
+		}
+		return encodeImage(src, dstMime)
+	}
+
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+
+	return encodeImage(dst, dstMime)
+}
+
+// loadThumbnail は、投稿画像のサムネイルを返します。保存されていなければ元画像から生成します。
+func loadThumbnail(post Post) ([]byte, error) {
+	return variants.Get(post.ID, thumbnailSuffix, thumbnailMime(post.Mime), func() ([]byte, error) {
+		data, err := loadImage(post)
+		if err != nil {
+			return nil, err
+		}
+		return makeThumbnail(data, post.Mime, thumbnailWidth)
+	})
+}
+
+// loadAlternateImage は、投稿画像をmimeの形式に変換した画像を返します。保存されていなければ元画像から生成します。
+func loadAlternateImage(post Post, mime string) ([]byte, error) {
+	return variants.Get(post.ID, alternateSuffix, mime, func() ([]byte, error) {
+		data, err := loadImage(post)
+		if err != nil {
+			return nil, err
+		}
+		return convertImage(data, mime)
+	})
+}
+
+func thumbnailURL(p Post) string {
+	ext := imageExt(thumbnailMime(p.Mime))
+	if ext != "" {
+		ext = "." + ext
+	}
+
+	return "/image/" + strconv.Itoa(p.ID) + thumbnailSuffix + ext
+}
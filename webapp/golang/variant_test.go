@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func encodeTestPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, width, height)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestMakeThumbnail(t *testing.T) {
+	thumb, err := makeThumbnail(encodeTestPNG(t, 800, 600), "image/png", thumbnailWidth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(thumb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "png" || config.Width != 320 || config.Height != 240 {
+		t.Errorf("thumbnail = %s %dx%d; want png 320x240", format, config.Width, config.Height)
+	}
+
+	small := encodeTestPNG(t, 100, 50)
+	thumb, err = makeThumbnail(small, "image/png", thumbnailWidth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(thumb, small) {
+		t.Error("small image should not be resized")
+	}
+
+	for _, ext := range []string{"jpg", "gif"} {
+		_, err := makeThumbnail(encodeTestImage(t, ext), mimeFromExt(ext), 2)
+		if err != nil {
+			t.Errorf("%s: %v", ext, err)
+		}
+	}
+}
+
+func TestGetThumbnail(t *testing.T) {
+	ts, client := setupTestServer(t)
+
+	u := createTestUser(t, "mary")
+	pid, err := createPost(u, "image/png", encodeTestPNG(t, 640, 480), "thumbnail")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := variants.path(pid, thumbnailSuffix, "image/png")
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("thumbnail should be saved when posted: %v", err)
+	}
+
+	// 保存済みのサムネイルが消えていても、リクエスト時に生成し直す
+	os.Remove(path)
+	body := getBody(t, client, ts.URL+"/image/"+strconv.Itoa(pid)+thumbnailSuffix+".png")
+	config, _, err := image.DecodeConfig(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != thumbnailWidth {
+		t.Errorf("thumbnail width = %d; want %d", config.Width, thumbnailWidth)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("thumbnail should be cached after request: %v", err)
+	}
+
+	// ベンチマーカーはsrcの元画像のURLで投稿を確認するので、サムネイルはsrcsetで指定する
+	imgURL := `src="/image/` + strconv.Itoa(pid) + `.png"`
+	thumbURL := `srcset="/image/` + strconv.Itoa(pid) + thumbnailSuffix + `.png ` + strconv.Itoa(thumbnailWidth) + `w"`
+	index := getBody(t, client, ts.URL+"/")
+	if !strings.Contains(index, imgURL) {
+		t.Errorf("index should keep the original image in %s", imgURL)
+	}
+	if !strings.Contains(index, thumbURL) {
+		t.Errorf("index should show the thumbnail %s", thumbURL)
+	}
+	if post := getBody(t, client, ts.URL+"/posts/"+strconv.Itoa(pid)); strings.Contains(post, thumbURL) {
+		t.Error("post page should show the original image")
+	}
+}
+
+func getImageWithAccept(t *testing.T, client *http.Client, url, accept string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", accept)
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	return res
+}
+
+func TestGetImageNegotiatesFormat(t *testing.T) {
+	ts, client := setupTestServer(t)
+
+	u := createTestUser(t, "mary")
+	pngID, err := createPost(u, "image/png", encodeTestImage(t, "png"), "png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	webpID, err := createPost(u, "image/webp", encodeTestImage(t, "webp"), "webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pngURL := ts.URL + "/image/" + strconv.Itoa(pngID) + ".png"
+	webpURL := ts.URL + "/image/" + strconv.Itoa(webpID) + ".webp"
+
+	testCases := []struct {
+		url    string
+		accept string
+		want   string
+	}{
+		{pngURL, "*/*", "image/png"},
+		{pngURL, "image/webp,*/*", "image/webp"},
+		{webpURL, "*/*", "image/webp"},
+		{webpURL, "image/png,image/jpeg", "image/png"},
+	}
+
+	for _, tc := range testCases {
+		res := getImageWithAccept(t, client, tc.url, tc.accept)
+		if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != tc.want {
+			t.Errorf("GET %s with Accept %q: status = %d, Content-Type = %q; want %q", tc.url, tc.accept, res.StatusCode, res.Header.Get("Content-Type"), tc.want)
+		}
+		if res.Header.Get("Vary") != "Accept" {
+			t.Errorf("GET %s: Vary = %q; want Accept", tc.url, res.Header.Get("Vary"))
+		}
+	}
+
+	// WebPの投稿のサムネイルは、どのクライアントでも表示できるPNGで作る
+	res := getImageWithAccept(t, client, ts.URL+"/image/"+strconv.Itoa(webpID)+thumbnailSuffix+".png", "*/*")
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("webp thumbnail: status = %d, Content-Type = %q", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+}